@@ -0,0 +1,103 @@
+package compose
+
+import (
+	"bufio"
+	"errors"
+	"github.com/OctopusDeploy/go-octodiff/pkg/cmd/deltawriter"
+	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+type ComposeOptions struct {
+	FirstDeltaFile  string
+	SecondDeltaFile string
+	DeltaFile       string
+
+	// DeltaWriterOptions say how the delta is written
+	DeltaWriterOptions deltawriter.Options
+}
+
+func NewCmdCompose() *cobra.Command {
+	composeOpts := &ComposeOptions{}
+	cmd := &cobra.Command{
+		Use:  "compose <first-delta-file> <second-delta-file> <delta-file>",
+		Long: "Given a delta, and a second delta built against the output of the first, creates a single delta which does the same as applying both",
+		RunE: func(c *cobra.Command, args []string) error {
+			// pick up positional arguments if not explicitly specified using --first-delta-file etc
+			argOffset := 0
+			if composeOpts.FirstDeltaFile == "" && len(args) > argOffset {
+				composeOpts.FirstDeltaFile = args[argOffset]
+				argOffset += 1
+			}
+			if composeOpts.SecondDeltaFile == "" && len(args) > argOffset {
+				composeOpts.SecondDeltaFile = args[argOffset]
+				argOffset += 1
+			}
+			if composeOpts.DeltaFile == "" && len(args) > argOffset {
+				composeOpts.DeltaFile = args[argOffset]
+			}
+			return composeRun(composeOpts)
+		},
+	}
+
+	flags := cmd.Flags()
+
+	flags.StringVarP(&composeOpts.FirstDeltaFile, "first-delta-file", "", "", "The delta to apply first.")
+	flags.StringVarP(&composeOpts.SecondDeltaFile, "second-delta-file", "", "", "The delta to apply to the output of the first.")
+	flags.StringVarP(&composeOpts.DeltaFile, "delta-file", "", "", "The file to write the combined delta to.")
+
+	deltawriter.AddFlags(cmd, &composeOpts.DeltaWriterOptions)
+
+	return cmd
+}
+
+func composeRun(opts *ComposeOptions) error {
+	if opts.FirstDeltaFile == "" || opts.SecondDeltaFile == "" {
+		return errors.New("two delta files must be specified")
+	}
+	if opts.DeltaFile == "" {
+		return errors.New("no output delta file was specified")
+	}
+
+	firstDeltaFile, err := os.Open(opts.FirstDeltaFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New("first delta file does not exist or could not be opened")
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = firstDeltaFile.Close() }()
+	firstDeltaFileInfo, err := firstDeltaFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	secondDeltaFile, err := os.Open(opts.SecondDeltaFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New("second delta file does not exist or could not be opened")
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = secondDeltaFile.Close() }()
+	secondDeltaFileInfo, err := secondDeltaFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	deltaFile, err := os.Create(opts.DeltaFile)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = deltaFile.Close() }()
+
+	deltaFileWriter := bufio.NewWriter(deltaFile)
+	deltaWriter := opts.DeltaWriterOptions.NewWriter(deltaFileWriter)
+
+	err = octodiff.ComposeDeltas(firstDeltaFile, firstDeltaFileInfo.Size(), secondDeltaFile, secondDeltaFileInfo.Size(), deltaWriter)
+	if err != nil {
+		return err
+	}
+	return deltaFileWriter.Flush()
+}
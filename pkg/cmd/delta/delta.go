@@ -3,6 +3,9 @@ package delta
 import (
 	"bufio"
 	"errors"
+	"fmt"
+	"github.com/OctopusDeploy/go-octodiff/pkg/cmd/deltawriter"
+	"github.com/OctopusDeploy/go-octodiff/pkg/cmd/filesigning"
 	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
 	"github.com/spf13/cobra"
 	"io"
@@ -11,20 +14,30 @@ import (
 
 type DeltaOptions struct {
 	SignatureFile string
+	IndexFile     string
 	NewFile       string
 	DeltaFile     string
+	SinglePass    bool
+	Format        string
+	SignKey       string
+	EncryptionKey string
+	VerifyKey     string
+	Threads       int
 	Progress      bool
+
+	// DeltaWriterOptions say how a binary delta is written
+	DeltaWriterOptions deltawriter.Options
 }
 
 func NewCmdDelta() *cobra.Command {
 	deltaOpts := &DeltaOptions{}
 	cmd := &cobra.Command{
 		Use:  "delta <signature-file> <new-file> [<delta-file>]",
-		Long: "Given a signature file and a new file, creates a delta file",
+		Long: "Given a signature file and a new file, creates a delta file. With --index, the signature file is left out, unless given with --signature-file.",
 		RunE: func(c *cobra.Command, args []string) error {
 			// pick up positional arguments if not explicitly specified using --basis-file and --signature-file
 			argOffset := 0
-			if deltaOpts.SignatureFile == "" && len(args) > argOffset {
+			if deltaOpts.SignatureFile == "" && deltaOpts.IndexFile == "" && len(args) > argOffset {
 				deltaOpts.SignatureFile = args[argOffset]
 				argOffset += 1
 			}
@@ -43,9 +56,24 @@ func NewCmdDelta() *cobra.Command {
 	flags := cmd.Flags()
 
 	flags.StringVarP(&deltaOpts.SignatureFile, "signature-file", "", "", "The file containing the signature from the basis file.")
+	flags.StringVarP(&deltaOpts.IndexFile, "index", "", "", "An index built from the signature file by the index command, to use instead of the signature file. Chunks are looked up in the index as they are needed rather than all being read into memory, which suits very large basis files. "+
+		"The signature file can still be given with --signature-file, to check the index was built from it; with --verify-key it must be.")
 	flags.StringVarP(&deltaOpts.NewFile, "new-file", "", "", "The file to create the delta from.")
 	flags.StringVarP(&deltaOpts.DeltaFile, "delta-file", "", "", "The file to write the delta to.")
 
+	flags.BoolVarP(&deltaOpts.SinglePass, "single-pass", "", false, "Write the new file's hash at the end of the delta, so the new file doesn't need to be read in advance to hash it. The new file must still be seekable, not a pipe. Needs the version 2 format.")
+
+	deltawriter.AddFlags(cmd, &deltaOpts.DeltaWriterOptions)
+
+	flags.StringVarP(&deltaOpts.Format, "format", "", "binary", "The delta file format; binary, or json for a delta which can be read and edited by hand. The binary options above don't apply to json.")
+
+	flags.StringVarP(&deltaOpts.SignKey, "sign-key", "", "", "A PEM file containing an Ed25519 private key, to sign the delta file with. The signature of the delta file is written next to it, with a .sig extension.")
+	flags.StringVarP(&deltaOpts.VerifyKey, "verify-key", "", "", "A PEM file containing an Ed25519 public key. The signature file must have been signed with the matching private key, and with --index, the index must have been built from it.")
+
+	flags.StringVarP(&deltaOpts.EncryptionKey, "encryption-key", "", "", "A file containing a 32 byte key, either raw or as 64 hex characters, to encrypt the delta with using AES-256-GCM. The same key is needed to patch with the delta. C# octodiff can't read encrypted deltas.")
+
+	flags.IntVarP(&deltaOpts.Threads, "threads", "", 1, "How many parts of the new file to scan at once. The delta is the same for any number of threads.")
+
 	flags.BoolVarP(&deltaOpts.Progress, "progress", "", false, "Whether progress should be written to stdout")
 
 	return cmd
@@ -56,24 +84,66 @@ func deltaRun(opts *DeltaOptions) error {
 	newFilePath := opts.NewFile
 	deltaFilePath := opts.DeltaFile
 
-	if signatureFilePath == "" {
-		return errors.New("No signature file was specified")
+	if signatureFilePath == "" && opts.IndexFile == "" {
+		return errors.New("No signature file or index was specified")
+	}
+	if opts.IndexFile != "" && opts.VerifyKey != "" && signatureFilePath == "" {
+		return errors.New("--verify-key with --index needs the signature file the index was built from as --signature-file; the signature file is verified, and the index checked against it")
 	}
 	if newFilePath == "" {
 		return errors.New("No new file was specified")
 	}
-
-	signatureFile, err := os.Open(signatureFilePath)
-	if errors.Is(err, os.ErrNotExist) {
-		return errors.New("signature file does not exist or could not be opened")
+	if opts.Format != "binary" && opts.Format != "json" {
+		return fmt.Errorf("unknown delta format %s; expected binary or json", opts.Format)
 	}
-	if err != nil {
-		return err
+	if opts.Threads < 1 {
+		return errors.New("--threads must be at least 1")
 	}
-	defer func() { _ = signatureFile.Close() }()
-	signatureFileInfo, err := signatureFile.Stat()
-	if err != nil {
-		return err
+	if opts.Format == "json" && opts.EncryptionKey != "" {
+		return errors.New("json deltas can't be encrypted")
+	}
+	var encryptionKey []byte
+	if opts.EncryptionKey != "" {
+		keyFile, err := os.ReadFile(opts.EncryptionKey)
+		if err != nil {
+			return err
+		}
+		encryptionKey, err = octodiff.ParseEncryptionKey(keyFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	// with --index, the signature file is optional, and only used to check the index
+	var signatureFile, indexFile *os.File
+	var err error
+	if signatureFilePath != "" {
+		signatureFile, err = os.Open(signatureFilePath)
+		if errors.Is(err, os.ErrNotExist) {
+			return errors.New("signature file does not exist or could not be opened")
+		}
+		if err != nil {
+			return err
+		}
+		defer func() { _ = signatureFile.Close() }()
+
+		// verify the signature file we've opened, and use it, so it can't be swapped for another in between
+		if opts.VerifyKey != "" {
+			err = filesigning.VerifyFile(signatureFile, signatureFilePath, opts.VerifyKey)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if opts.IndexFile != "" {
+		indexFile, err = os.Open(opts.IndexFile)
+		if errors.Is(err, os.ErrNotExist) {
+			return errors.New("index file does not exist or could not be opened")
+		}
+		if err != nil {
+			return err
+		}
+		defer func() { _ = indexFile.Close() }()
 	}
 
 	newFile, err := os.Open(newFilePath)
@@ -103,17 +173,79 @@ func deltaRun(opts *DeltaOptions) error {
 	defer func() { _ = deltaFile.Close() }()
 
 	delta := octodiff.NewDeltaBuilder()
+	delta.Concurrency = opts.Threads
 	if opts.Progress {
 		delta.ProgressReporter = octodiff.NewStdoutProgressReporter()
 	}
 
-	// not using bufIo over newFile because we seek all over the place internally and bufio.Reader is not a ReadSeeker
-	var signatureFileReader io.Reader = bufio.NewReaderSize(signatureFile, 4*1024*1024)
 	var deltaFileWriter = bufio.NewWriter(deltaFile)
-	err = delta.Build(newFile, newFileInfo.Size(), signatureFileReader, signatureFileInfo.Size(), octodiff.NewBinaryDeltaWriter(deltaFileWriter))
+	var deltaWriter octodiff.DeltaWriter
+	var encryptingDeltaWriter *octodiff.EncryptingDeltaWriter
+	if opts.Format == "json" {
+		jsonDeltaWriter := octodiff.NewJSONDeltaWriter(deltaFileWriter)
+		jsonDeltaWriter.TrailingHash = opts.SinglePass
+		deltaWriter = jsonDeltaWriter
+	} else {
+		var binaryDeltaWriter *octodiff.BinaryDeltaWriter
+		if encryptionKey != nil {
+			// the encrypting writer is a BinaryDeltaWriter writing through an encryptor, which we close after the build
+			encryptingDeltaWriter, err = octodiff.NewEncryptingDeltaWriter(deltaFileWriter, encryptionKey)
+			if err != nil {
+				return err
+			}
+			binaryDeltaWriter = encryptingDeltaWriter.BinaryDeltaWriter
+		} else {
+			binaryDeltaWriter = octodiff.NewBinaryDeltaWriter(deltaFileWriter)
+		}
+		binaryDeltaWriter.TrailingHash = opts.SinglePass
+		opts.DeltaWriterOptions.Configure(binaryDeltaWriter)
+		deltaWriter = binaryDeltaWriter
+	}
+	if indexFile != nil {
+		err = buildWithIndex(delta, newFile, newFileInfo.Size(), indexFile, signatureFile, deltaWriter)
+	} else {
+		err = buildWithSignature(delta, newFile, newFileInfo.Size(), signatureFile, deltaWriter)
+	}
+	if err != nil {
+		return err
+	}
+	if encryptingDeltaWriter != nil {
+		err = encryptingDeltaWriter.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = deltaFileWriter.Flush()
+	if err != nil || opts.SignKey == "" {
+		return err
+	}
+	return filesigning.SignFile(deltaFilePath, opts.SignKey)
+}
+
+func buildWithSignature(delta *octodiff.DeltaBuilder, newFile *os.File, newFileLength int64, signatureFile *os.File, deltaWriter octodiff.DeltaWriter) error {
+	signatureFileInfo, err := signatureFile.Stat()
 	if err != nil {
 		return err
 	}
+	// not using bufIo over newFile because we seek all over the place internally and bufio.Reader is not a ReadSeeker
+	var signatureFileReader io.Reader = bufio.NewReaderSize(signatureFile, 4*1024*1024)
+	return delta.Build(newFile, newFileLength, signatureFileReader, signatureFileInfo.Size(), deltaWriter)
+}
 
-	return deltaFileWriter.Flush()
+// buildWithIndex checks the index was built from signatureFile, if there is one, then builds the delta from the index
+func buildWithIndex(delta *octodiff.DeltaBuilder, newFile *os.File, newFileLength int64, indexFile *os.File, signatureFile *os.File, deltaWriter octodiff.DeltaWriter) error {
+	// the index is read from all over the place as chunks are looked up, so it's memory mapped rather than buffered
+	index, err := octodiff.MapSignatureIndex(indexFile)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = index.Close() }()
+	if signatureFile != nil {
+		err = index.VerifySignatureFile(bufio.NewReaderSize(signatureFile, 4*1024*1024))
+		if err != nil {
+			return err
+		}
+	}
+	return delta.BuildWithIndex(newFile, newFileLength, index, deltaWriter)
 }
@@ -0,0 +1,42 @@
+package deltawriter
+
+import (
+	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
+	"github.com/spf13/cobra"
+	"io"
+)
+
+// Options are the flags which say how a binary delta is written, shared by the commands which write one
+type Options struct {
+	Compress             bool
+	CompressionThreshold int64
+	VarintCommands       bool
+	CommandChecksums     bool
+}
+
+// AddFlags adds the flags for opts to cmd
+func AddFlags(cmd *cobra.Command, opts *Options) {
+	flags := cmd.Flags()
+
+	flags.BoolVarP(&opts.Compress, "compress", "", false, "Compress new data in the delta using DEFLATE. Needs the version 2 format.")
+	flags.Int64VarP(&opts.CompressionThreshold, "compression-threshold", "", octodiff.DefaultCompressionThreshold, "With --compress, new data smaller than this many bytes is not compressed.")
+
+	flags.BoolVarP(&opts.VarintCommands, "varint-commands", "", false, "Write command offsets and lengths as variable-length integers, which makes deltas with many small commands smaller. Needs the version 2 format.")
+
+	flags.BoolVarP(&opts.CommandChecksums, "command-checksums", "", false, "Write a checksum after each command, and the number of commands at the end, so that damaged or truncated deltas are reported when patching. Needs the version 2 format.")
+}
+
+// Configure sets the options on deltaWriter
+func (opts *Options) Configure(deltaWriter *octodiff.BinaryDeltaWriter) {
+	deltaWriter.CompressData = opts.Compress
+	deltaWriter.CompressionThreshold = opts.CompressionThreshold
+	deltaWriter.VarintCommands = opts.VarintCommands
+	deltaWriter.CommandChecksums = opts.CommandChecksums
+}
+
+// NewWriter returns a BinaryDeltaWriter writing to output with the options set
+func (opts *Options) NewWriter(output io.Writer) *octodiff.BinaryDeltaWriter {
+	deltaWriter := octodiff.NewBinaryDeltaWriter(output)
+	opts.Configure(deltaWriter)
+	return deltaWriter
+}
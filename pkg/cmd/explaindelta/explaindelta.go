@@ -2,6 +2,7 @@ package explaindelta
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/hex"
 	"errors"
 	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
@@ -12,6 +13,7 @@ import (
 
 type ExplainDeltaOptions struct {
 	DeltaFile string
+	JSON      bool
 }
 
 func NewCmdExplainDelta() *cobra.Command {
@@ -33,6 +35,7 @@ func NewCmdExplainDelta() *cobra.Command {
 	flags := cmd.Flags()
 
 	flags.StringVarP(&deltaOpts.DeltaFile, "delta-file", "", "", "The file to explain.")
+	flags.BoolVarP(&deltaOpts.JSON, "json", "", false, "Print the delta as JSON, in the format written by delta --format json.")
 
 	return cmd
 }
@@ -57,8 +60,14 @@ func explainDeltaRun(cmd *cobra.Command, opts *ExplainDeltaOptions) error {
 	//	return err
 	//}
 
-	var deltaFileReader io.Reader = bufio.NewReaderSize(deltaFile, 4*1024*1024)
-	deltaReader := octodiff.NewBinaryDeltaReader(deltaFileReader)
+	deltaReader, err := octodiff.NewDeltaReader(bufio.NewReaderSize(deltaFile, 4*1024*1024))
+	if err != nil {
+		return err
+	}
+
+	if opts.JSON {
+		return explainDeltaAsJSON(cmd.OutOrStdout(), deltaReader)
+	}
 
 	return deltaReader.Apply(func(bytes []byte) error {
 		if len(bytes) > 20 {
@@ -72,3 +81,44 @@ func explainDeltaRun(cmd *cobra.Command, opts *ExplainDeltaOptions) error {
 		return nil
 	})
 }
+
+// explainDeltaAsJSON copies the delta to a JSONDeltaWriter, so it can be read, edited, and applied with patch
+func explainDeltaAsJSON(output io.Writer, deltaReader octodiff.BasisIdentityDeltaReader) error {
+	hashAlgorithm, err := deltaReader.HashAlgorithm()
+	if err != nil {
+		return err
+	}
+	basisLength, basisHash, err := deltaReader.BasisIdentity()
+	if err != nil {
+		return err
+	}
+
+	writer := octodiff.NewJSONDeltaWriter(output)
+	if basisHash != nil {
+		writer.SetBasisIdentity(basisLength, basisHash)
+	}
+	// the metadata has already been read, so this only fails when the hash follows the commands
+	expectedHash, err := deltaReader.ExpectedHash()
+	writer.TrailingHash = err != nil
+	err = writer.WriteMetadata(hashAlgorithm, expectedHash)
+	if err != nil {
+		return err
+	}
+
+	err = deltaReader.Apply(func(data []byte) error {
+		return writer.WriteDataCommand(bytes.NewReader(data), 0, int64(len(data)))
+	}, writer.WriteCopyCommand)
+	if err != nil {
+		return err
+	}
+	err = writer.Flush()
+	if err != nil || !writer.TrailingHash {
+		return err
+	}
+
+	expectedHash, err = deltaReader.ExpectedHash()
+	if err != nil {
+		return err
+	}
+	return writer.WriteTrailingHash(expectedHash)
+}
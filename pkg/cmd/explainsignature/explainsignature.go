@@ -0,0 +1,149 @@
+package explainsignature
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
+	"github.com/spf13/cobra"
+	"os"
+	"sort"
+)
+
+type ExplainSignatureOptions struct {
+	SignatureFile string
+	SummaryOnly   bool
+}
+
+func NewCmdExplainSignature() *cobra.Command {
+	signatureOpts := &ExplainSignatureOptions{}
+	cmd := &cobra.Command{
+		Use:  "explain-signature <signature-file>",
+		Long: "Prints the metadata and chunks from a signature file; useful when debugging.",
+		RunE: func(c *cobra.Command, args []string) error {
+			// pick up positional arguments if not explicitly specified using --signature-file
+			if signatureOpts.SignatureFile == "" && len(args) > 0 {
+				signatureOpts.SignatureFile = args[0]
+			}
+			return explainSignatureRun(c, signatureOpts)
+		},
+	}
+
+	flags := cmd.Flags()
+
+	flags.StringVarP(&signatureOpts.SignatureFile, "signature-file", "", "", "The file to explain.")
+	flags.BoolVarP(&signatureOpts.SummaryOnly, "summary-only", "", false, "Don't list the individual chunks.")
+
+	return cmd
+}
+
+func explainSignatureRun(cmd *cobra.Command, opts *ExplainSignatureOptions) error {
+	signatureFilePath := opts.SignatureFile
+
+	if signatureFilePath == "" {
+		return errors.New("no signature file was specified")
+	}
+
+	signatureFile, err := os.Open(signatureFilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New("signature file does not exist or could not be opened")
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = signatureFile.Close() }()
+	signatureFileInfo, err := signatureFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	signature, err := octodiff.NewSignatureReader().ReadSignature(bufio.NewReaderSize(signatureFile, 4*1024*1024), signatureFileInfo.Size())
+	if err != nil {
+		return err
+	}
+
+	cmd.Printf("Hash algorithm: %s\n", signature.HashAlgorithm.Name())
+	cmd.Printf("Rolling checksum algorithm: %s\n", signature.RollingChecksumAlgorithm.Name())
+	if signature.BasisHash != nil {
+		cmd.Printf("Basis file: %d bytes, hash %s\n", signature.BasisLength, hex.EncodeToString(signature.BasisHash))
+	} else {
+		cmd.Printf("Basis file: not recorded\n")
+	}
+	if c := signature.ContentDefinedChunking; c != nil {
+		cmd.Printf("Chunking: content defined, %d to %d bytes, averaging %d\n", c.MinChunkSize, c.MaxChunkSize, c.AverageChunkSize)
+	} else {
+		cmd.Printf("Chunking: fixed size\n")
+	}
+
+	coveredLength := int64(0)
+	lengthCounts := map[int]int{}
+	for _, chunk := range signature.Chunks {
+		coveredLength += int64(chunk.ChunkLength())
+		lengthCounts[chunk.ChunkLength()]++
+	}
+	cmd.Printf("Chunks: %d, covering %d bytes\n", len(signature.Chunks), coveredLength)
+
+	// the chunk size is normally the most common length, so list the lengths from most to least common
+	lengths := make([]int, 0, len(lengthCounts))
+	for length := range lengthCounts {
+		lengths = append(lengths, length)
+	}
+	sort.Slice(lengths, func(i, j int) bool {
+		if lengthCounts[lengths[i]] != lengthCounts[lengths[j]] {
+			return lengthCounts[lengths[i]] > lengthCounts[lengths[j]]
+		}
+		return lengths[i] > lengths[j]
+	})
+	cmd.Printf("Chunk lengths:\n")
+	for _, length := range lengths {
+		cmd.Printf("  %d bytes: %d\n", length, lengthCounts[length])
+	}
+
+	collisions := countChecksumCollisions(signature.Chunks)
+	cmd.Printf("Rolling checksum collisions: %d checksums are shared by %d chunks; %d of those chunks are duplicates with the same hash\n",
+		collisions.sharedChecksums, collisions.chunksSharingChecksums, collisions.duplicateChunks)
+
+	if opts.SummaryOnly {
+		return nil
+	}
+
+	cmd.Printf("%-16s %-6s %-8s %s\n", "Offset", "Length", "Checksum", "Hash")
+	for _, chunk := range signature.Chunks {
+		cmd.Printf("%-16d %-6d %08x %s\n", chunk.StartOffset, chunk.ChunkLength(), chunk.RollingChecksum, hex.EncodeToString(chunk.Hash))
+	}
+	return nil
+}
+
+type checksumCollisions struct {
+	sharedChecksums        int // distinct checksums which more than one chunk has
+	chunksSharingChecksums int // chunks which have one of those checksums
+	duplicateChunks        int // chunks which have the same hash as an earlier chunk with the same checksum
+}
+
+// countChecksumCollisions shows how well the rolling checksum separates the chunks. Chunks with a shared checksum
+// need their hash comparing when building a delta, which is slow if there are a lot of them.
+func countChecksumCollisions(chunks []*octodiff.ChunkSignature) checksumCollisions {
+	chunksByChecksum := map[uint32][]*octodiff.ChunkSignature{}
+	for _, chunk := range chunks {
+		chunksByChecksum[chunk.RollingChecksum] = append(chunksByChecksum[chunk.RollingChecksum], chunk)
+	}
+
+	var result checksumCollisions
+	for _, sharing := range chunksByChecksum {
+		if len(sharing) < 2 {
+			continue
+		}
+		result.sharedChecksums++
+		result.chunksSharingChecksums += len(sharing)
+
+		hashes := map[string]bool{}
+		for _, chunk := range sharing {
+			hash := string(chunk.Hash)
+			if hashes[hash] {
+				result.duplicateChunks++
+			}
+			hashes[hash] = true
+		}
+	}
+	return result
+}
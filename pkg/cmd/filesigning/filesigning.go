@@ -0,0 +1,78 @@
+package filesigning
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
+	"io"
+	"os"
+)
+
+// DetachedSignaturePath is where the signature of a signed signature or delta file is kept
+func DetachedSignaturePath(path string) string {
+	return path + ".sig"
+}
+
+// SignFile signs the file at path with the Ed25519 private key in keyPath, and writes the signature next to it
+func SignFile(path string, keyPath string) error {
+	keyPem, err := os.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+	privateKey, err := octodiff.ParseSigningKey(keyPem)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+
+	signatureFile, err := os.Create(DetachedSignaturePath(path))
+	if err != nil {
+		return err
+	}
+	err = octodiff.SignFile(privateKey, bufio.NewReader(file), signatureFile)
+	closeErr := signatureFile.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// VerifyFile checks file against the detached signature kept next to path, using the Ed25519 public key in keyPath.
+// file should be path already opened, so the file that is checked is the one which is then used; it is read to the
+// end and then seeked back to the start.
+func VerifyFile(file io.ReadSeeker, path string, keyPath string) error {
+	keyPem, err := os.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+	publicKey, err := octodiff.ParseVerificationKey(keyPem)
+	if err != nil {
+		return err
+	}
+
+	signatureFile, err := os.Open(DetachedSignaturePath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s is not signed; expected its signature in %s", path, DetachedSignaturePath(path))
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = signatureFile.Close() }()
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	err = octodiff.VerifyFileSignature(publicKey, bufio.NewReader(file), signatureFile)
+	if err != nil {
+		return fmt.Errorf("%s failed signature verification: %w", path, err)
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	return err
+}
@@ -0,0 +1,105 @@
+package index
+
+import (
+	"bufio"
+	"errors"
+	"github.com/OctopusDeploy/go-octodiff/pkg/cmd/filesigning"
+	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+type IndexOptions struct {
+	SignatureFile string
+	IndexFile     string
+	VerifyKey     string
+	TempDirectory string
+	Progress      bool
+}
+
+func NewCmdIndex() *cobra.Command {
+	indexOpts := &IndexOptions{}
+	cmd := &cobra.Command{
+		Use:  "index <signature-file> [<index-file>]",
+		Long: "Given a signature file, creates an index of its chunks, so delta --index can look them up on disk rather than reading them all into memory. The index records the hash of the signature file, so delta can check it against the signature.",
+		RunE: func(c *cobra.Command, args []string) error {
+			// pick up positional arguments if not explicitly specified using --signature-file and --index-file
+			argOffset := 0
+			if indexOpts.SignatureFile == "" && len(args) > argOffset {
+				indexOpts.SignatureFile = args[argOffset]
+				argOffset += 1
+			}
+			if indexOpts.IndexFile == "" && len(args) > argOffset {
+				indexOpts.IndexFile = args[argOffset]
+			}
+
+			return indexRun(indexOpts)
+		},
+	}
+
+	flags := cmd.Flags()
+
+	flags.StringVarP(&indexOpts.SignatureFile, "signature-file", "", "", "The signature file to index.")
+	flags.StringVarP(&indexOpts.IndexFile, "index-file", "", "", "The file to write the index to. Defaults to the signature file with a .octoidx extension added.")
+
+	flags.StringVarP(&indexOpts.VerifyKey, "verify-key", "", "", "A PEM file containing an Ed25519 public key. The signature file must have been signed with the matching private key.")
+
+	flags.StringVarP(&indexOpts.TempDirectory, "temp-dir", "", "", "Where to sort the chunks of signatures which are too large to sort in memory. Defaults to the system's directory for temporary files.")
+
+	flags.BoolVarP(&indexOpts.Progress, "progress", "", false, "Whether progress should be written to stdout")
+
+	return cmd
+}
+
+func indexRun(opts *IndexOptions) error {
+	signatureFilePath := opts.SignatureFile
+	indexFilePath := opts.IndexFile
+
+	if signatureFilePath == "" {
+		return errors.New("No signature file was specified")
+	}
+
+	signatureFile, err := os.Open(signatureFilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New("signature file does not exist or could not be opened")
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = signatureFile.Close() }()
+
+	// verify the signature file we've opened, and index it, so it can't be swapped for another in between
+	if opts.VerifyKey != "" {
+		err = filesigning.VerifyFile(signatureFile, signatureFilePath, opts.VerifyKey)
+		if err != nil {
+			return err
+		}
+	}
+	signatureFileInfo, err := signatureFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	if indexFilePath == "" {
+		indexFilePath = signatureFilePath + ".octoidx"
+	}
+
+	indexFile, err := os.Create(indexFilePath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = indexFile.Close() }()
+
+	indexBuilder := octodiff.NewSignatureIndexBuilder()
+	indexBuilder.TempDirectory = opts.TempDirectory
+	if opts.Progress {
+		indexBuilder.ProgressReporter = octodiff.NewStdoutProgressReporter()
+	}
+
+	// the index builder buffers its output itself
+	err = indexBuilder.Build(bufio.NewReaderSize(signatureFile, 4*1024*1024), signatureFileInfo.Size(), indexFile)
+	if err != nil {
+		return err
+	}
+	return indexFile.Close()
+}
@@ -0,0 +1,106 @@
+package invert
+
+import (
+	"bufio"
+	"errors"
+	"github.com/OctopusDeploy/go-octodiff/pkg/cmd/deltawriter"
+	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+type InvertOptions struct {
+	BasisFile        string
+	ForwardDeltaFile string
+	DeltaFile        string
+
+	// DeltaWriterOptions say how the delta is written
+	DeltaWriterOptions deltawriter.Options
+}
+
+func NewCmdInvert() *cobra.Command {
+	invertOpts := &InvertOptions{}
+	cmd := &cobra.Command{
+		Use:  "invert <basis-file> <delta-file> <inverted-delta-file>",
+		Long: "Given a basis file and a delta built against it, creates a delta which rebuilds the basis file from the output of the delta",
+		RunE: func(c *cobra.Command, args []string) error {
+			// pick up positional arguments if not explicitly specified using --basis-file etc
+			argOffset := 0
+			if invertOpts.BasisFile == "" && len(args) > argOffset {
+				invertOpts.BasisFile = args[argOffset]
+				argOffset += 1
+			}
+			if invertOpts.ForwardDeltaFile == "" && len(args) > argOffset {
+				invertOpts.ForwardDeltaFile = args[argOffset]
+				argOffset += 1
+			}
+			if invertOpts.DeltaFile == "" && len(args) > argOffset {
+				invertOpts.DeltaFile = args[argOffset]
+			}
+			return invertRun(invertOpts)
+		},
+	}
+
+	flags := cmd.Flags()
+
+	flags.StringVarP(&invertOpts.BasisFile, "basis-file", "", "", "The file that the delta was built against.")
+	flags.StringVarP(&invertOpts.ForwardDeltaFile, "delta-file", "", "", "The delta to invert.")
+	flags.StringVarP(&invertOpts.DeltaFile, "inverted-delta-file", "", "", "The file to write the inverted delta to.")
+
+	deltawriter.AddFlags(cmd, &invertOpts.DeltaWriterOptions)
+
+	return cmd
+}
+
+func invertRun(opts *InvertOptions) error {
+	if opts.BasisFile == "" {
+		return errors.New("no basis file was specified")
+	}
+	if opts.ForwardDeltaFile == "" {
+		return errors.New("no delta file was specified")
+	}
+	if opts.DeltaFile == "" {
+		return errors.New("no inverted delta file was specified")
+	}
+
+	basisFile, err := os.Open(opts.BasisFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New("basis file does not exist or could not be opened")
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = basisFile.Close() }()
+	basisFileInfo, err := basisFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	forwardDeltaFile, err := os.Open(opts.ForwardDeltaFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New("delta file does not exist or could not be opened")
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = forwardDeltaFile.Close() }()
+	forwardDeltaFileInfo, err := forwardDeltaFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	deltaFile, err := os.Create(opts.DeltaFile)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = deltaFile.Close() }()
+
+	deltaFileWriter := bufio.NewWriter(deltaFile)
+	deltaWriter := opts.DeltaWriterOptions.NewWriter(deltaFileWriter)
+
+	err = octodiff.InvertDelta(basisFile, basisFileInfo.Size(), forwardDeltaFile, forwardDeltaFileInfo.Size(), deltaWriter)
+	if err != nil {
+		return err
+	}
+	return deltaFileWriter.Flush()
+}
@@ -3,10 +3,13 @@ package patch
 import (
 	"bufio"
 	"errors"
+	"github.com/OctopusDeploy/go-octodiff/pkg/cmd/filesigning"
+	"github.com/OctopusDeploy/go-octodiff/pkg/cmd/signature"
 	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
 	"github.com/spf13/cobra"
 	"io"
 	"os"
+	"path/filepath"
 )
 
 type PatchOptions struct {
@@ -15,6 +18,12 @@ type PatchOptions struct {
 	NewFile          string
 	Progress         bool
 	SkipVerification bool
+	VerifyKey        string
+	EncryptionKey    string
+	SignatureOut     string
+
+	// SignatureOptions say how the --signature-out signature is built
+	SignatureOptions signature.BuilderOptions
 }
 
 func NewCmdPatch() *cobra.Command {
@@ -37,7 +46,7 @@ func NewCmdPatch() *cobra.Command {
 				patchOpts.NewFile = args[argOffset]
 				argOffset += 1
 			}
-			return patchRun(patchOpts)
+			return patchRun(c, patchOpts)
 		},
 	}
 
@@ -49,10 +58,18 @@ func NewCmdPatch() *cobra.Command {
 	flags.BoolVarP(&patchOpts.Progress, "progress", "", false, "Whether progress should be written to stdout.")
 	flags.BoolVarP(&patchOpts.SkipVerification, "skip-verification", "", false, "Skip checking whether the basis file is the same as the file used to produce the signature that created the delta.")
 
+	flags.StringVarP(&patchOpts.VerifyKey, "verify-key", "", "", "A PEM file containing an Ed25519 public key. The delta file must have been signed with the matching private key, or it won't be applied. This is checked even with --skip-verification.")
+
+	flags.StringVarP(&patchOpts.EncryptionKey, "encryption-key", "", "", "The key file the delta was encrypted with. The whole delta is authenticated before any of it is applied.")
+
+	flags.StringVarP(&patchOpts.SignatureOut, "signature-out", "", "", "Also write the signature of the new file here. This is built as the new file is written, so saves reading it back in with the signature command. "+
+		"It is built the way the signature command builds one, with the same --chunk-size, --chunking, --hash-algorithm and other flags, except that --chunk-size can't be auto.")
+	signature.AddBuilderFlags(cmd, &patchOpts.SignatureOptions)
+
 	return cmd
 }
 
-func patchRun(opts *PatchOptions) error {
+func patchRun(cmd *cobra.Command, opts *PatchOptions) error {
 	// validate args
 	basisFilePath := opts.BasisFile
 	if basisFilePath == "" {
@@ -67,16 +84,17 @@ func patchRun(opts *PatchOptions) error {
 		return errors.New("no new file was specified")
 
 	}
-	// open files
-	basisFile, err := os.Open(basisFilePath)
-	if errors.Is(err, os.ErrNotExist) {
-		return errors.New("basis file does not exist or could not be opened")
-	}
-	if err != nil {
-		return err
+	var signatureBuilder *octodiff.SignatureBuilder
+	if opts.SignatureOut != "" {
+		// the length of the new file isn't known until it has been written, so the chunk size can't be chosen
+		var err error
+		signatureBuilder, err = opts.SignatureOptions.NewBuilder(cmd, -1)
+		if err != nil {
+			return err
+		}
 	}
-	defer func() { _ = basisFile.Close() }()
 
+	// open files
 	deltaFile, err := os.Open(deltaFilePath)
 	if errors.Is(err, os.ErrNotExist) {
 		return errors.New("delta file does not exist or could not be opened")
@@ -86,46 +104,123 @@ func patchRun(opts *PatchOptions) error {
 	}
 	defer func() { _ = deltaFile.Close() }()
 
-	var deltaFileStream io.Reader = bufio.NewReader(deltaFile)
-	deltaReader := octodiff.NewBinaryDeltaReader(deltaFileStream)
+	// refuse a tampered delta before we go near the basis file. We verify the file we've opened, and apply
+	// the delta from it, so it can't be swapped for another in between
+	if opts.VerifyKey != "" {
+		err = filesigning.VerifyFile(deltaFile, deltaFilePath, opts.VerifyKey)
+		if err != nil {
+			return err
+		}
+	}
 
-	{ // nested lexical scope to contain the actual file writing, so we can ensure we flush/close properly
-		newFile, err := os.Create(newFilePath)
+	var deltaReader octodiff.BasisIdentityDeltaReader
+	if opts.EncryptionKey != "" {
+		keyFile, err := os.ReadFile(opts.EncryptionKey)
 		if err != nil {
 			return err
 		}
-		// we can't buffer IO for basisFile because it seeks all over the place
-		newFileOutputStream := bufio.NewWriter(newFile)
-
-		err = octodiff.ApplyDelta(
-			basisFile,
-			deltaReader,
-			newFileOutputStream)
-
-		flushErr := newFileOutputStream.Flush()
-		_ = newFile.Close()
-		if flushErr != nil {
-			return flushErr
+		encryptionKey, err := octodiff.ParseEncryptionKey(keyFile)
+		if err != nil {
+			return err
 		}
+		deltaReader, err = octodiff.NewDecryptingDeltaReader(deltaFile, encryptionKey)
+		if err != nil {
+			return err
+		}
+	} else {
+		// JSON deltas are detected by their opening brace
+		deltaReader, err = octodiff.NewDeltaReader(bufio.NewReader(deltaFile))
 		if err != nil {
 			return err
 		}
 	}
 
-	if opts.SkipVerification {
-		return nil
+	basisFile, err := os.Open(basisFilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New("basis file does not exist or could not be opened")
 	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = basisFile.Close() }()
 
-	// re-open the file to verify the hash
+	if !opts.SkipVerification {
+		// if the delta records which basis file it was built against, check it before we start writing the new file
+		err = octodiff.VerifyBasisFile(basisFile, deltaReader)
+		if err != nil {
+			return err
+		}
+	}
 
-	newFileRead, err := os.Open(newFilePath)
-	if errors.Is(err, os.ErrNotExist) {
-		return errors.New("new file does not exist or could not be opened for verification")
+	var signatureFile *os.File
+	var signatureFileWriter *bufio.Writer
+	var signatureWriter *octodiff.SignatureWriter
+	signatureWritten := false
+	if opts.SignatureOut != "" {
+		// the signature goes to a temporary file which is only moved into place once the new file has been written
+		// and verified, so a failed patch doesn't leave a truncated signature behind
+		signatureFile, err = os.CreateTemp(filepath.Dir(opts.SignatureOut), ".signature-out-*")
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = signatureFile.Close()
+			if !signatureWritten {
+				_ = os.Remove(signatureFile.Name())
+			}
+		}()
+		signatureFileWriter = bufio.NewWriter(signatureFile)
+		signatureWriter, err = signatureBuilder.NewWriter(signatureFileWriter)
+		if err != nil {
+			return err
+		}
+	}
+
+	newFile, err := os.Create(newFilePath)
+	if err != nil {
+		return err
+	}
+	// we can't buffer IO for basisFile because it seeks all over the place
+	newFileOutputStream := bufio.NewWriter(newFile)
+	var output io.Writer = newFileOutputStream
+	if signatureWriter != nil {
+		// the signature is built from the new file as it's written
+		output = io.MultiWriter(newFileOutputStream, signatureWriter)
 	}
+
+	if opts.SkipVerification {
+		err = octodiff.ApplyDelta(basisFile, deltaReader, output)
+	} else {
+		// the new file is hashed as it's written, so we don't need to re-read it to verify it
+		err = octodiff.ApplyDeltaAndVerify(basisFile, deltaReader, output)
+	}
+
+	flushErr := newFileOutputStream.Flush()
+	closeErr := newFile.Close()
 	if err != nil {
 		return err
 	}
-	defer func() { _ = newFileRead.Close() }()
-	newFileReadStream := bufio.NewReaderSize(newFileRead, 4*1024*1024)
-	return octodiff.VerifyNewFile(newFileReadStream, deltaReader)
+	if flushErr != nil {
+		return flushErr
+	}
+	if closeErr != nil || signatureWriter == nil {
+		return closeErr
+	}
+
+	err = signatureWriter.Close()
+	if err == nil {
+		err = signatureFileWriter.Flush()
+	}
+	if err == nil {
+		err = signatureFile.Chmod(0o644) // CreateTemp only gives the owner access
+	}
+	closeErr = signatureFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(signatureFile.Name(), opts.SignatureOut)
+	}
+	signatureWritten = err == nil
+	return err
 }
@@ -1,22 +1,35 @@
 package root
 
 import (
+	"github.com/OctopusDeploy/go-octodiff/pkg/cmd/compose"
 	"github.com/OctopusDeploy/go-octodiff/pkg/cmd/delta"
 	"github.com/OctopusDeploy/go-octodiff/pkg/cmd/explaindelta"
+	"github.com/OctopusDeploy/go-octodiff/pkg/cmd/explainsignature"
+	"github.com/OctopusDeploy/go-octodiff/pkg/cmd/index"
+	"github.com/OctopusDeploy/go-octodiff/pkg/cmd/invert"
 	"github.com/OctopusDeploy/go-octodiff/pkg/cmd/patch"
 	"github.com/OctopusDeploy/go-octodiff/pkg/cmd/signature"
+	"github.com/OctopusDeploy/go-octodiff/pkg/cmd/store"
 	"github.com/spf13/cobra"
 )
 
 func NewCmdRoot() *cobra.Command {
 	cmd := &cobra.Command{
 		Use: "octodiff <command>",
+		Long: "Creates and applies deltas between files, in the file formats of C# octodiff.\n\n" +
+			"Signatures and deltas are written in the version 1 formats, which C# octodiff can read, unless a flag which needs the version 2 formats is given; " +
+			"the flags which do say so in their help. C# octodiff can't read version 2 files, or encrypted deltas.",
 	}
 
 	cmd.AddCommand(signature.NewCmdSignature())
+	cmd.AddCommand(index.NewCmdIndex())
 	cmd.AddCommand(delta.NewCmdDelta())
 	cmd.AddCommand(patch.NewCmdPatch())
+	cmd.AddCommand(compose.NewCmdCompose())
+	cmd.AddCommand(invert.NewCmdInvert())
+	cmd.AddCommand(store.NewCmdStore())
 	cmd.AddCommand(explaindelta.NewCmdExplainDelta())
+	cmd.AddCommand(explainsignature.NewCmdExplainSignature())
 
 	return cmd
 }
@@ -4,19 +4,36 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"github.com/OctopusDeploy/go-octodiff/pkg/cmd/filesigning"
 	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
 	"github.com/spf13/cobra"
 	"io"
 	"os"
+	"strconv"
 )
 
 type SignatureOptions struct {
+	BuilderOptions
 	BasisFile     string
 	SignatureFile string
-	ChunkSize     int
+	SignKey       string
+	Threads       int
 	Progress      bool
 }
 
+// BuilderOptions are the flags which say how a signature is built. patch --signature-out takes them too, so it can
+// build the same signature this command would.
+type BuilderOptions struct {
+	ChunkSize       string
+	Chunking        string
+	MinChunkSize    int
+	MaxChunkSize    int
+	LargeChunks     bool
+	HashAlgorithm   string
+	RollingChecksum string
+	BasisIdentity   bool
+}
+
 func NewCmdSignature() *cobra.Command {
 	signatureOpts := &SignatureOptions{}
 	cmd := &cobra.Command{
@@ -34,7 +51,7 @@ func NewCmdSignature() *cobra.Command {
 				signatureOpts.SignatureFile = args[argOffset]
 			}
 
-			return signatureRun(signatureOpts)
+			return signatureRun(c, signatureOpts)
 		},
 	}
 
@@ -43,16 +60,110 @@ func NewCmdSignature() *cobra.Command {
 	flags.StringVarP(&signatureOpts.BasisFile, "basis-file", "f", "", "The file to read and create a signature from.")
 	flags.StringVarP(&signatureOpts.SignatureFile, "signature-file", "o", "", "The file to write the signature to.")
 
-	flags.IntVarP(&signatureOpts.ChunkSize, "chunk-size", "", octodiff.SignatureDefaultChunkSize,
-		fmt.Sprintf("Maximum bytes per chunk. Defaults to %d. Min of %d, max of %d.",
-			octodiff.SignatureDefaultChunkSize, octodiff.SignatureMinimumChunkSize, octodiff.SignatureMaximumChunkSize))
+	AddBuilderFlags(cmd, &signatureOpts.BuilderOptions)
+
+	flags.StringVarP(&signatureOpts.SignKey, "sign-key", "", "", "A PEM file containing an Ed25519 private key, to sign the signature file with. The signature of the signature file is written next to it, with a .sig extension.")
+
+	flags.IntVarP(&signatureOpts.Threads, "threads", "", 1, "How many chunks to hash at once. Large files on machines with spare cores build faster with more; the signature is the same either way.")
 
 	flags.BoolVarP(&signatureOpts.Progress, "progress", "", false, "Whether progress should be written to stdout")
 
 	return cmd
 }
 
-func signatureRun(opts *SignatureOptions) error {
+// AddBuilderFlags adds the flags for opts to cmd
+func AddBuilderFlags(cmd *cobra.Command, opts *BuilderOptions) {
+	flags := cmd.Flags()
+
+	flags.StringVarP(&opts.ChunkSize, "chunk-size", "", strconv.Itoa(octodiff.SignatureDefaultChunkSize),
+		fmt.Sprintf("Maximum bytes per chunk. Defaults to %d. Min of %d, max of %d, or %d with --large-chunks. "+
+			"Use auto to pick one from the size of the file, which gives larger files larger chunks and keeps their signatures small.",
+			octodiff.SignatureDefaultChunkSize, octodiff.SignatureMinimumChunkSize, octodiff.SignatureMaximumChunkSize, octodiff.SignatureMaximumLargeChunkSize))
+
+	flags.StringVarP(&opts.Chunking, "chunking", "", "fixed",
+		"How the file is cut into chunks. One of fixed, which cuts a chunk every --chunk-size bytes, or fastcdc, which cuts chunks where the content says to, so they line up between versions of a file even after bytes are inserted or removed. "+
+			"With fastcdc, --chunk-size is the average chunk length. fastcdc needs the version 2 format.")
+	flags.IntVarP(&opts.MinChunkSize, "min-chunk-size", "", 0, "The shortest chunk fastcdc cuts, other than at the end of the file. Defaults to a quarter of --chunk-size.")
+	flags.IntVarP(&opts.MaxChunkSize, "max-chunk-size", "", 0, "The longest chunk fastcdc cuts. Defaults to four times --chunk-size.")
+
+	flags.BoolVarP(&opts.LargeChunks, "large-chunks", "", false, "Record chunk lengths in 32 bits, allowing much larger chunks, so very large files get signatures of a manageable size. Needs the version 2 format.")
+
+	flags.StringVarP(&opts.HashAlgorithm, "hash-algorithm", "", octodiff.DefaultHashAlgorithm.Name(),
+		"The algorithm used to hash each chunk and the new file. One of SHA1, SHA256 or SHA512/256.")
+
+	flags.StringVarP(&opts.RollingChecksum, "rolling-checksum", "", octodiff.DefaultChecksumAlgorithm.Name(),
+		"The rolling checksum used to find matching chunks. One of Adler32, Adler32V2, Buzhash or RabinKarp.")
+
+	flags.BoolVarP(&opts.BasisIdentity, "basis-identity", "", false, "Record the file's length and hash in the signature, so patch can check it has the right basis file before it starts. Needs the version 2 format.")
+}
+
+// NewBuilder validates the options, and returns a SignatureBuilder for a file of inputLength bytes. With an automatic
+// chunk size, the size chosen is printed to cmd. An inputLength of -1 means it isn't known, which doesn't allow one.
+func (opts *BuilderOptions) NewBuilder(cmd *cobra.Command, inputLength int64) (*octodiff.SignatureBuilder, error) {
+	hashAlgorithm, ok := octodiff.LookupHashAlgorithm(opts.HashAlgorithm)
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash algorithm %s", opts.HashAlgorithm)
+	}
+	rollingChecksum, ok := octodiff.LookupRollingChecksum(opts.RollingChecksum)
+	if !ok {
+		return nil, fmt.Errorf("unsupported rolling checksum %s", opts.RollingChecksum)
+	}
+	chunkSize := octodiff.SignatureAutoChunkSize
+	if opts.ChunkSize != "auto" {
+		var err error
+		chunkSize, err = strconv.Atoi(opts.ChunkSize)
+		if err != nil || chunkSize == octodiff.SignatureAutoChunkSize {
+			return nil, fmt.Errorf("invalid chunk size %s; it must be a number of bytes, or auto", opts.ChunkSize)
+		}
+	}
+	switch opts.Chunking {
+	case "fixed":
+		if opts.MinChunkSize != 0 || opts.MaxChunkSize != 0 {
+			return nil, errors.New("--min-chunk-size and --max-chunk-size only apply to --chunking fastcdc")
+		}
+	case "fastcdc":
+	default:
+		return nil, fmt.Errorf("unsupported chunking %s", opts.Chunking)
+	}
+
+	if chunkSize == octodiff.SignatureAutoChunkSize {
+		if inputLength < 0 {
+			return nil, errors.New("--chunk-size auto needs the length of the file, which isn't known until it has been written")
+		}
+		chunkSize = octodiff.ChooseChunkSize(inputLength)
+		if opts.LargeChunks {
+			chunkSize = octodiff.ChooseLargeChunkSize(inputLength)
+		}
+		cmd.Printf("Using a chunk size of %d bytes for a %d byte file\n", chunkSize, inputLength)
+	}
+
+	signatureBuilder := octodiff.NewSignatureBuilder()
+	signatureBuilder.ChunkSize = chunkSize
+	signatureBuilder.LargeChunks = opts.LargeChunks
+	if opts.Chunking == "fastcdc" {
+		contentDefinedChunking := octodiff.NewContentDefinedChunking(chunkSize)
+		if opts.LargeChunks {
+			// NewContentDefinedChunking keeps within the 16 bit lengths of the default format
+			contentDefinedChunking.MaxChunkSize = chunkSize * 4
+			if contentDefinedChunking.MaxChunkSize > octodiff.SignatureMaximumLargeChunkSize {
+				contentDefinedChunking.MaxChunkSize = octodiff.SignatureMaximumLargeChunkSize
+			}
+		}
+		if opts.MinChunkSize != 0 {
+			contentDefinedChunking.MinChunkSize = opts.MinChunkSize
+		}
+		if opts.MaxChunkSize != 0 {
+			contentDefinedChunking.MaxChunkSize = opts.MaxChunkSize
+		}
+		signatureBuilder.ContentDefinedChunking = contentDefinedChunking
+	}
+	signatureBuilder.HashAlgorithm = hashAlgorithm
+	signatureBuilder.RollingChecksumAlgorithm = rollingChecksum
+	signatureBuilder.RecordBasisIdentity = opts.BasisIdentity
+	return signatureBuilder, nil
+}
+
+func signatureRun(cmd *cobra.Command, opts *SignatureOptions) error {
 	basisFilePath := opts.BasisFile
 	signatureFilePath := opts.SignatureFile
 
@@ -60,6 +171,10 @@ func signatureRun(opts *SignatureOptions) error {
 		return errors.New("No basis file was specified")
 	}
 
+	if opts.Threads < 1 {
+		return errors.New("--threads must be at least 1")
+	}
+
 	basisFile, err := os.Open(basisFilePath)
 	if errors.Is(err, os.ErrNotExist) {
 		return errors.New("basis file does not exist or could not be opened")
@@ -73,6 +188,10 @@ func signatureRun(opts *SignatureOptions) error {
 	if err != nil {
 		return err
 	}
+	signatureBuilder, err := opts.NewBuilder(cmd, basisFileInfo.Size())
+	if err != nil {
+		return err
+	}
 
 	if signatureFilePath == "" {
 		signatureFilePath = basisFilePath + ".octosig"
@@ -86,7 +205,7 @@ func signatureRun(opts *SignatureOptions) error {
 	}
 	defer func() { _ = signatureFile.Close() }()
 
-	signatureBuilder := octodiff.NewSignatureBuilder()
+	signatureBuilder.Concurrency = opts.Threads
 	if opts.Progress {
 		signatureBuilder.ProgressReporter = octodiff.NewStdoutProgressReporter()
 	}
@@ -101,5 +220,9 @@ func signatureRun(opts *SignatureOptions) error {
 	if err != nil {
 		return err
 	}
-	return signatureFileWriter.Flush()
+	err = signatureFileWriter.Flush()
+	if err != nil || opts.SignKey == "" {
+		return err
+	}
+	return filesigning.SignFile(signatureFilePath, opts.SignKey)
 }
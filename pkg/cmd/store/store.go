@@ -0,0 +1,229 @@
+package store
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	versionstore "github.com/OctopusDeploy/go-octodiff/pkg/store"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+type StoreOptions struct {
+	StoreDirectory string
+	Version        string
+	File           string
+	MaxChainLength int
+	Compress       bool
+}
+
+func NewCmdStore() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:  "store <command>",
+		Long: "Keeps versions of a file in a directory as a full snapshot followed by a chain of deltas",
+	}
+
+	cmd.AddCommand(newCmdStoreAdd())
+	cmd.AddCommand(newCmdStoreCheckout())
+	cmd.AddCommand(newCmdStoreList())
+	cmd.AddCommand(newCmdStoreVerify())
+
+	return cmd
+}
+
+// pickUpArgs fills in positional arguments which were not explicitly specified using --store-directory etc
+func pickUpArgs(args []string, targets ...*string) {
+	argOffset := 0
+	for _, target := range targets {
+		if *target == "" && len(args) > argOffset {
+			*target = args[argOffset]
+			argOffset += 1
+		}
+	}
+}
+
+func newCmdStoreAdd() *cobra.Command {
+	storeOpts := &StoreOptions{}
+	cmd := &cobra.Command{
+		Use:  "add <store-directory> <version> <file>",
+		Long: "Adds a new version of the file to the store, as a delta against the latest version",
+		RunE: func(c *cobra.Command, args []string) error {
+			pickUpArgs(args, &storeOpts.StoreDirectory, &storeOpts.Version, &storeOpts.File)
+			return storeAddRun(c, storeOpts)
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVarP(&storeOpts.StoreDirectory, "store-directory", "", "", "The directory the versions are kept in. It is created if it doesn't exist.")
+	flags.StringVarP(&storeOpts.Version, "version", "", "", "The name of the new version.")
+	flags.StringVarP(&storeOpts.File, "file", "", "", "The new version of the file.")
+	flags.IntVarP(&storeOpts.MaxChainLength, "max-chain-length", "", versionstore.DefaultMaxChainLength, "Store a full snapshot rather than a delta if the version would be more than this many deltas from the last snapshot.")
+	flags.BoolVarP(&storeOpts.Compress, "compress", "", false, "Compress new data in the delta using DEFLATE.")
+
+	return cmd
+}
+
+func newCmdStoreCheckout() *cobra.Command {
+	storeOpts := &StoreOptions{}
+	cmd := &cobra.Command{
+		Use:  "checkout <store-directory> <version> <file>",
+		Long: "Writes out a version of the file, applying each delta between it and the last snapshot",
+		RunE: func(c *cobra.Command, args []string) error {
+			pickUpArgs(args, &storeOpts.StoreDirectory, &storeOpts.Version, &storeOpts.File)
+			return storeCheckoutRun(storeOpts)
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVarP(&storeOpts.StoreDirectory, "store-directory", "", "", "The directory the versions are kept in.")
+	flags.StringVarP(&storeOpts.Version, "version", "", "", "The name of the version to check out.")
+	flags.StringVarP(&storeOpts.File, "file", "", "", "The file to write the version to.")
+
+	return cmd
+}
+
+func newCmdStoreList() *cobra.Command {
+	storeOpts := &StoreOptions{}
+	cmd := &cobra.Command{
+		Use:  "list <store-directory>",
+		Long: "Lists the versions in the store, in the order they were added",
+		RunE: func(c *cobra.Command, args []string) error {
+			pickUpArgs(args, &storeOpts.StoreDirectory)
+			return storeListRun(c, storeOpts)
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVarP(&storeOpts.StoreDirectory, "store-directory", "", "", "The directory the versions are kept in.")
+
+	return cmd
+}
+
+func newCmdStoreVerify() *cobra.Command {
+	storeOpts := &StoreOptions{}
+	cmd := &cobra.Command{
+		Use:  "verify <store-directory>",
+		Long: "Checks every snapshot and delta in the store against the hashes in its manifest",
+		RunE: func(c *cobra.Command, args []string) error {
+			pickUpArgs(args, &storeOpts.StoreDirectory)
+			return storeVerifyRun(c, storeOpts)
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVarP(&storeOpts.StoreDirectory, "store-directory", "", "", "The directory the versions are kept in.")
+
+	return cmd
+}
+
+func openStore(opts *StoreOptions) (*versionstore.Store, error) {
+	if opts.StoreDirectory == "" {
+		return nil, errors.New("no store directory was specified")
+	}
+	return versionstore.Open(opts.StoreDirectory)
+}
+
+func storeAddRun(cmd *cobra.Command, opts *StoreOptions) error {
+	if opts.Version == "" {
+		return errors.New("no version was specified")
+	}
+	if opts.File == "" {
+		return errors.New("no file was specified")
+	}
+	if opts.MaxChainLength < 0 {
+		return errors.New("the maximum chain length can't be negative")
+	}
+	s, err := openStore(opts)
+	if err != nil {
+		return err
+	}
+	s.MaxChainLength = opts.MaxChainLength
+	s.CompressData = opts.Compress
+
+	file, err := os.Open(opts.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New("file does not exist or could not be opened")
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+
+	version, err := s.Add(opts.Version, file)
+	if err != nil {
+		return err
+	}
+	if version.IsSnapshot() {
+		cmd.Printf("Added %s as a full snapshot\n", version.Name)
+	} else {
+		cmd.Printf("Added %s as a delta against %s\n", version.Name, version.Basis)
+	}
+	return nil
+}
+
+func storeCheckoutRun(opts *StoreOptions) error {
+	if opts.Version == "" {
+		return errors.New("no version was specified")
+	}
+	if opts.File == "" {
+		return errors.New("no file was specified")
+	}
+	s, err := openStore(opts)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.Version(opts.Version); !ok {
+		return fmt.Errorf("the store has no version %s", opts.Version)
+	}
+
+	file, err := os.Create(opts.File)
+	if err != nil {
+		return err
+	}
+	fileWriter := bufio.NewWriter(file)
+	err = s.Checkout(opts.Version, fileWriter)
+
+	flushErr := fileWriter.Flush()
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	if flushErr != nil {
+		return flushErr
+	}
+	return closeErr
+}
+
+func storeListRun(cmd *cobra.Command, opts *StoreOptions) error {
+	s, err := openStore(opts)
+	if err != nil {
+		return err
+	}
+
+	output := cmd.OutOrStdout()
+	for _, version := range s.Versions() {
+		storedAs := "snapshot"
+		if !version.IsSnapshot() {
+			storedAs = fmt.Sprintf("delta %d against %s", version.ChainLength, version.Basis)
+		}
+		_, err = fmt.Fprintf(output, "%s\t%d bytes\t%s\t%s\n", version.Name, version.Length, hex.EncodeToString(version.Hash), storedAs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func storeVerifyRun(cmd *cobra.Command, opts *StoreOptions) error {
+	s, err := openStore(opts)
+	if err != nil {
+		return err
+	}
+	err = s.Verify()
+	if err != nil {
+		return err
+	}
+	cmd.Printf("Verified %d versions\n", len(s.Versions()))
+	return nil
+}
@@ -2,10 +2,14 @@ package octodiff
 
 import (
 	"bytes"
+	"compress/flate"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
+	"math"
 )
 
 type DeltaReader interface {
@@ -21,12 +25,30 @@ type DeltaReader interface {
 	) error
 }
 
+// BasisIdentityDeltaReader is implemented by DeltaReaders which can report the basis file the delta was built against
+type BasisIdentityDeltaReader interface {
+	DeltaReader
+
+	// BasisIdentity returns a nil hash if the delta doesn't record the basis file
+	BasisIdentity() (basisLength int64, basisHash []byte, err error)
+}
+
 type BinaryDeltaReader struct {
-	input io.Reader
+	input           io.Reader
+	commandInput    io.Reader
+	byteInput       io.ByteReader
+	commandChecksum hash.Hash32
+	decompressor    io.ReadCloser
 
 	expectedHash    []byte
 	hashAlgorithm   HashAlgorithm
+	basisLength     int64
+	basisHash       []byte
+	previousCopyEnd int64
+	flags           DeltaFlags
+	isVersion2      bool
 	hasReadMetadata bool
+	hasReadTrailer  bool
 
 	ProgressReporter ProgressReporter
 }
@@ -43,6 +65,9 @@ func (b *BinaryDeltaReader) ExpectedHash() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if b.flags&DeltaFlagTrailingHash != 0 && !b.hasReadTrailer {
+		return nil, errors.New("the delta file records the expected hash after its commands; it is only available once Apply has completed")
+	}
 	return b.expectedHash, nil
 }
 
@@ -54,20 +79,68 @@ func (b *BinaryDeltaReader) HashAlgorithm() (HashAlgorithm, error) {
 	return b.hashAlgorithm, nil
 }
 
+func (b *BinaryDeltaReader) BasisIdentity() (int64, []byte, error) {
+	err := b.ensureMetadata()
+	if err != nil {
+		return 0, nil, err
+	}
+	return b.basisLength, b.basisHash, nil
+}
+
 func (b *BinaryDeltaReader) Apply(writeData func([]byte) error, copyData func(int64, int64) error) error {
+	return b.readCommands(&applyingCommandHandler{
+		reader:    b,
+		buffer:    make([]byte, defaultReadBufferSize),
+		writeData: writeData,
+		copyData:  copyData,
+	})
+}
+
+// deltaCommandHandler receives the commands parsed by readCommands. The data handlers must consume exactly the
+// command's data from input, so that the next command can be read.
+type deltaCommandHandler interface {
+	copyCommand(start int64, length int64) error
+	dataCommand(input io.Reader, length int64) error
+	compressedDataCommand(input io.Reader, length int64, compressedLength int64) error
+}
+
+// DeltaCorruptError is returned by BinaryDeltaReader when a delta can't be read because it is damaged or truncated.
+// The output of the commands before CommandIndex has already been passed on. With command checksums, a command
+// whose header is damaged is never passed on, but when the data of a data command fails its checksum, that data has.
+type DeltaCorruptError struct {
+	// CommandIndex counts from zero. When the end of delta marker is missing, it is the number of commands read
+	CommandIndex int64
+	Reason       string
+}
+
+func (e *DeltaCorruptError) Error() string {
+	return fmt.Sprintf("%s (at command %d)", e.Reason, e.CommandIndex)
+}
+
+// corruptDeltaReason is returned while reading a command, and becomes a DeltaCorruptError once we know which command
+type corruptDeltaReason string
+
+func (r corruptDeltaReason) Error() string {
+	return string(r)
+}
+
+// readCommands parses the commands in the delta, passing each to the handler, and reads the trailer
+func (b *BinaryDeltaReader) readCommands(handler deltaCommandHandler) error {
 	err := b.ensureMetadata()
 	if err != nil {
 		return err
 	}
 
-	buffer := make([]byte, defaultReadBufferSize)
-
+	newFileLength := int64(0)
 	cmdTypeByte := make([]byte, 1)
-	for {
+	for commandIndex := int64(0); ; commandIndex++ {
 		// we should not reach EOF when reading other expected bytes like EOF, but we
 		// can rech it here once we've consumed all the commands in a file
-		bytesRead, err := b.input.Read(cmdTypeByte)
+		bytesRead, err := b.commandInput.Read(cmdTypeByte)
 		if err == io.EOF {
+			if b.isVersion2 {
+				return &DeltaCorruptError{CommandIndex: commandIndex, Reason: "the delta file appears to be truncated; the end of delta marker is missing"}
+			}
 			return nil // all done, finished reading the file
 		}
 		if err != nil {
@@ -79,47 +152,196 @@ func (b *BinaryDeltaReader) Apply(writeData func([]byte) error, copyData func(in
 
 		//b.ProgressReporter.ReportProgress("Applying delta", reader.BaseStream.Position, fileLength)
 
-		if bytes.Equal(cmdTypeByte, BinaryCopyCommand) {
-			var start, length int64
-			err = binary.Read(b.input, binary.LittleEndian, &start)
-			if err != nil {
-				return err
-			}
-			err = binary.Read(b.input, binary.LittleEndian, &length)
-			if err != nil {
-				return err
-			}
-			err = copyData(start, length)
-			if err != nil {
-				return err
-			}
-			// loop round to read the next command
-		} else if bytes.Equal(cmdTypeByte, BinaryDataCommand) {
-			var length int64
-			err = binary.Read(b.input, binary.LittleEndian, &length)
-			if err != nil {
-				return err
+		if b.isVersion2 && bytes.Equal(cmdTypeByte, BinaryEndOfDeltaCommand) {
+			err = b.readEndOfDelta(commandIndex, newFileLength)
+			if err == nil {
+				err = b.readTrailer()
 			}
+			return commandError(commandIndex, err)
+		}
 
-			iter := NewReaderIteratorBufferNBytes(b.input, buffer, length)
-			for iter.Next() {
-				err = writeData(iter.Current)
-				if err != nil {
-					return err
-				}
-			}
-			err = iter.Err()
-			if err != nil {
-				return err
-			}
-			// loop round to read the next command
-		} else {
-			return errors.New("unexpected cmd byte in delta file")
+		length, err := b.readCommand(cmdTypeByte, handler)
+		if err != nil {
+			return commandError(commandIndex, err)
+		}
+		newFileLength += length
+	}
+}
+
+// readCommand reads a single command, passing it to the handler, and returns the length of its output. The header
+// of each command is checked against its checksum before the handler is given it, so a damaged offset or length is
+// never acted on. The data of data commands is checked once the handler has consumed it.
+func (b *BinaryDeltaReader) readCommand(cmdTypeByte []byte, handler deltaCommandHandler) (int64, error) {
+	if bytes.Equal(cmdTypeByte, BinaryCopyCommand) {
+		start, length, err := b.readCopyCommand()
+		if err == nil {
+			err = b.verifyCommandChecksum()
+		}
+		if err != nil {
+			return 0, err
+		}
+		return length, handler.copyCommand(start, length)
+	} else if bytes.Equal(cmdTypeByte, BinaryDataCommand) {
+		length, err := b.readCommandLength()
+		if err == nil {
+			err = b.verifyCommandChecksum()
+		}
+		if err != nil {
+			return 0, err
+		}
+		err = handler.dataCommand(b.commandInput, length)
+		if err != nil {
+			return 0, err
+		}
+		return length, b.verifyCommandChecksum()
+	} else if b.flags&DeltaFlagCompressedData != 0 && bytes.Equal(cmdTypeByte, BinaryCompressedDataCommand) {
+		length, err := b.readCommandLength()
+		if err != nil {
+			return 0, err
+		}
+		compressedLength, err := b.readCommandLength()
+		if err == nil {
+			err = b.verifyCommandChecksum()
+		}
+		if err != nil {
+			return 0, err
+		}
+		compressedInput := io.LimitReader(b.commandInput, compressedLength)
+		err = handler.compressedDataCommand(compressedInput, length, compressedLength)
+		if err != nil {
+			return 0, err
+		}
+		// the decompressor may not have needed to read the end of the compressed block; skip it so we are at the next command
+		err = skipBytes(compressedInput, compressedInput.(*io.LimitedReader).N)
+		if err != nil {
+			return 0, err
 		}
+		return length, b.verifyCommandChecksum()
+	}
+	return 0, corruptDeltaReason("unexpected cmd byte in delta file")
+}
+
+// commandError turns errors which mean the delta is damaged into a DeltaCorruptError
+func commandError(commandIndex int64, err error) error {
+	var reason corruptDeltaReason
+	var flateErr flate.CorruptInputError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &reason):
+		return &DeltaCorruptError{CommandIndex: commandIndex, Reason: string(reason)}
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		return &DeltaCorruptError{CommandIndex: commandIndex, Reason: "the delta file appears to be truncated"}
+	case errors.As(err, &flateErr):
+		return &DeltaCorruptError{CommandIndex: commandIndex, Reason: "the delta file appears to be corrupt; " + err.Error()}
 	}
+	return err
 }
 
-var _ DeltaReader = (*BinaryDeltaReader)(nil)
+// verifyCommandChecksum reads the checksum which follows a command, if the delta has them
+func (b *BinaryDeltaReader) verifyCommandChecksum() error {
+	if b.flags&DeltaFlagCommandChecksums == 0 {
+		return nil
+	}
+	var recordedChecksum uint32
+	err := binary.Read(b.input, binary.LittleEndian, &recordedChecksum)
+	if err != nil {
+		return err
+	}
+	actualChecksum := b.commandChecksum.Sum32()
+	b.commandChecksum.Reset()
+	if recordedChecksum != actualChecksum {
+		return corruptDeltaReason("the delta file appears to be corrupt; the command does not match its checksum")
+	}
+	return nil
+}
+
+// readEndOfDelta checks the number of commands and the length of the new file against the end of delta marker,
+// if the delta records them
+func (b *BinaryDeltaReader) readEndOfDelta(commandCount int64, newFileLength int64) error {
+	if b.flags&DeltaFlagCommandChecksums == 0 {
+		return nil
+	}
+	var recordedCommandCount, recordedNewFileLength int64
+	err := binary.Read(b.commandInput, binary.LittleEndian, &recordedCommandCount)
+	if err != nil {
+		return err
+	}
+	err = binary.Read(b.commandInput, binary.LittleEndian, &recordedNewFileLength)
+	if err != nil {
+		return err
+	}
+	err = b.verifyCommandChecksum()
+	if err != nil {
+		return err
+	}
+	if recordedCommandCount != commandCount {
+		return corruptDeltaReason(fmt.Sprintf("the delta file appears to be corrupt; it should have %d commands, but has %d", recordedCommandCount, commandCount))
+	}
+	if recordedNewFileLength != newFileLength {
+		return corruptDeltaReason(fmt.Sprintf("the delta file appears to be corrupt; it should produce %d bytes, but produces %d", recordedNewFileLength, newFileLength))
+	}
+	return nil
+}
+
+// applyingCommandHandler passes the commands to the callbacks given to Apply
+type applyingCommandHandler struct {
+	reader    *BinaryDeltaReader
+	buffer    []byte
+	writeData func([]byte) error
+	copyData  func(int64, int64) error
+}
+
+func (a *applyingCommandHandler) copyCommand(start int64, length int64) error {
+	return a.copyData(start, length)
+}
+
+func (a *applyingCommandHandler) dataCommand(input io.Reader, length int64) error {
+	dataLength := int64(0)
+	iter := NewReaderIteratorBufferNBytes(input, a.buffer, length)
+	for iter.Next() {
+		dataLength += int64(len(iter.Current))
+		err := a.writeData(iter.Current)
+		if err != nil {
+			return err
+		}
+	}
+	err := iter.Err()
+	if err != nil {
+		return err
+	}
+	if dataLength < length {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func (a *applyingCommandHandler) compressedDataCommand(input io.Reader, length int64, _ int64) error {
+	decompressor, err := a.reader.resetDecompressor(input)
+	if err != nil {
+		return err
+	}
+
+	inflatedLength := int64(0)
+	iter := NewReaderIteratorBufferNBytes(decompressor, a.buffer, length)
+	for iter.Next() {
+		inflatedLength += int64(len(iter.Current))
+		err = a.writeData(iter.Current)
+		if err != nil {
+			return err
+		}
+	}
+	err = iter.Err()
+	if err != nil {
+		return err
+	}
+	if inflatedLength != length {
+		return corruptDeltaReason(fmt.Sprintf("the delta file appears to be corrupt; expecting compressed data to inflate to %d bytes but got %d", length, inflatedLength))
+	}
+	return nil
+}
+
+var _ BasisIdentityDeltaReader = (*BinaryDeltaReader)(nil)
 
 func (b *BinaryDeltaReader) ensureMetadata() error {
 	if b.hasReadMetadata {
@@ -140,7 +362,9 @@ func (b *BinaryDeltaReader) ensureMetadata() error {
 	if err != nil {
 		return err
 	}
-	if bytesRead != len(BinaryVersion) || !bytes.Equal(versionBytes, BinaryVersion) {
+	if bytesRead == len(BinaryDeltaVersion2) && bytes.Equal(versionBytes, BinaryDeltaVersion2) {
+		b.isVersion2 = true
+	} else if bytesRead != len(BinaryVersion) || !bytes.Equal(versionBytes, BinaryVersion) {
 		return errors.New("the delta file uses a newer file format than this program can handle")
 	}
 
@@ -148,30 +372,54 @@ func (b *BinaryDeltaReader) ensureMetadata() error {
 	if err != nil {
 		return err
 	}
-	if hashAlgorithmName != DefaultHashAlgorithm.Name() {
-		return errors.New("the delta file uses an unsupported hashing algorithm")
+	hashAlgorithm, ok := LookupHashAlgorithm(hashAlgorithmName)
+	if !ok {
+		return fmt.Errorf("the delta file uses an unsupported hashing algorithm %s", hashAlgorithmName)
 	}
-	hashAlgorithm := DefaultHashAlgorithm
 	b.hashAlgorithm = hashAlgorithm
 
-	var hashLength int32
-	err = binary.Read(b.input, binary.LittleEndian, &hashLength)
-	if err != nil {
-		return err
+	if b.isVersion2 {
+		var flags DeltaFlags
+		err = binary.Read(b.input, binary.LittleEndian, &flags)
+		if err != nil {
+			return err
+		}
+		if flags&^knownDeltaFlags != 0 {
+			return errors.New("the delta file uses features this program can't handle")
+		}
+		b.flags = flags
 	}
-	if int(hashLength) != hashAlgorithm.HashLength() {
-		return errors.New("the delta file contains an invalid hash length")
+
+	b.commandInput = b.input
+	if b.flags&DeltaFlagCommandChecksums != 0 {
+		b.commandChecksum = crc32.NewIEEE()
+		b.commandInput = &checksummingReader{reader: b.input, checksum: b.commandChecksum}
+	}
+	if b.flags&DeltaFlagVarintCommands != 0 {
+		if byteInput, ok := b.commandInput.(io.ByteReader); ok {
+			b.byteInput = byteInput
+		} else {
+			b.byteInput = &singleByteReader{reader: b.commandInput}
+		}
 	}
 
-	hashBytes := make([]byte, hashLength)
-	bytesRead, err = b.input.Read(hashBytes)
-	if err != nil {
-		return err
+	if b.flags&DeltaFlagBasisIdentity != 0 {
+		err = binary.Read(b.input, binary.LittleEndian, &b.basisLength)
+		if err != nil {
+			return err
+		}
+		b.basisHash, err = b.readHash()
+		if err != nil {
+			return err
+		}
 	}
-	if bytesRead != len(hashBytes) {
-		return fmt.Errorf("the delta file appears to be corrupt; expecting hash length of %d but only read %d bytes", hashLength, len(hashBytes))
+
+	if b.flags&DeltaFlagTrailingHash == 0 {
+		b.expectedHash, err = b.readHash()
+		if err != nil {
+			return err
+		}
 	}
-	b.expectedHash = hashBytes
 
 	endOfMetaBytes := make([]byte, len(BinaryEndOfMetadata))
 	bytesRead, err = b.input.Read(endOfMetaBytes)
@@ -185,3 +433,126 @@ func (b *BinaryDeltaReader) ensureMetadata() error {
 	b.hasReadMetadata = true
 	return nil
 }
+
+func (b *BinaryDeltaReader) readHash() ([]byte, error) {
+	var hashLength int32
+	err := binary.Read(b.input, binary.LittleEndian, &hashLength)
+	if err != nil {
+		return nil, err
+	}
+	if int(hashLength) != b.hashAlgorithm.HashLength() {
+		return nil, errors.New("the delta file contains an invalid hash length")
+	}
+
+	hashBytes := make([]byte, hashLength)
+	bytesRead, err := io.ReadFull(b.input, hashBytes)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if bytesRead != len(hashBytes) {
+		return nil, fmt.Errorf("the delta file appears to be corrupt; expecting hash length of %d but only read %d bytes", hashLength, bytesRead)
+	}
+	return hashBytes, nil
+}
+
+// readCopyCommand reads the offset and length which follow BinaryCopyCommand
+func (b *BinaryDeltaReader) readCopyCommand() (int64, int64, error) {
+	if b.flags&DeltaFlagVarintCommands == 0 {
+		var start, length int64
+		err := binary.Read(b.commandInput, binary.LittleEndian, &start)
+		if err != nil {
+			return 0, 0, err
+		}
+		err = binary.Read(b.commandInput, binary.LittleEndian, &length)
+		if err != nil {
+			return 0, 0, err
+		}
+		return start, length, nil
+	}
+
+	relativeStart, err := binary.ReadVarint(b.byteInput)
+	if err != nil {
+		return 0, 0, err
+	}
+	length, err := b.readCommandLength()
+	if err != nil {
+		return 0, 0, err
+	}
+	start := b.previousCopyEnd + relativeStart
+	if start < 0 {
+		return 0, 0, corruptDeltaReason("the delta file appears to be corrupt; a copy command starts before the beginning of the basis file")
+	}
+	b.previousCopyEnd = start + length
+	return start, length, nil
+}
+
+// readCommandLength reads one of the lengths which follow a data or compressed data command
+func (b *BinaryDeltaReader) readCommandLength() (int64, error) {
+	if b.flags&DeltaFlagVarintCommands == 0 {
+		var length int64
+		err := binary.Read(b.commandInput, binary.LittleEndian, &length)
+		return length, err
+	}
+
+	length, err := binary.ReadUvarint(b.byteInput)
+	if err != nil {
+		return 0, err
+	}
+	if length > math.MaxInt64 {
+		return 0, corruptDeltaReason("the delta file appears to be corrupt; a command length is out of range")
+	}
+	return int64(length), nil
+}
+
+// singleByteReader lets binary.ReadUvarint read from an io.Reader without a bufio.Reader, which would
+// read ahead into the data that follows the command
+type singleByteReader struct {
+	reader io.Reader
+	b      [1]byte
+}
+
+func (r *singleByteReader) ReadByte() (byte, error) {
+	_, err := io.ReadFull(r.reader, r.b[:])
+	return r.b[0], err
+}
+
+// checksummingReader adds everything read from a command to the command's checksum
+type checksummingReader struct {
+	reader   io.Reader
+	checksum hash.Hash32
+	b        [1]byte
+}
+
+func (r *checksummingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.checksum.Write(p[:n])
+	return n, err
+}
+
+func (r *checksummingReader) ReadByte() (byte, error) {
+	_, err := io.ReadFull(r, r.b[:])
+	return r.b[0], err
+}
+
+// readTrailer reads whatever follows BinaryEndOfDeltaCommand in a version 2 delta
+func (b *BinaryDeltaReader) readTrailer() error {
+	if b.flags&DeltaFlagTrailingHash != 0 {
+		hash, err := b.readHash()
+		if err != nil {
+			return err
+		}
+		b.expectedHash = hash
+	}
+	b.hasReadTrailer = true
+	return nil
+}
+
+// resetDecompressor points the reader's decompressor at the next block of compressed data, creating it if needed
+func (b *BinaryDeltaReader) resetDecompressor(compressedInput io.Reader) (io.Reader, error) {
+	if b.decompressor == nil {
+		b.decompressor = flate.NewReader(compressedInput)
+		return b.decompressor, nil
+	}
+	err := b.decompressor.(flate.Resetter).Reset(compressedInput, nil)
+	return b.decompressor, err
+}
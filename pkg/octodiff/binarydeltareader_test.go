@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
+	"github.com/OctopusDeploy/go-octodiff/pkg/test"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -88,3 +89,228 @@ func TestReadsDeltaFileWithSmallChangesLargerFile_DisjointChanges(t *testing.T)
 		"write 06082a8648ce3d03010703420004504b77248d83e2e3e209bbb2297a0e4d24ff45e79eff88dd165e6419ae98512dabd2219da46e93d7ff98d5a1cb80314a57f37d0931ecf7f3bd4bce212cfd2cbaa3533051301d0603551d0e04160414badd278a31e012776afbfda4ead8fdce904f0efc301f0603551d23041830168014badd278a31e012776afbfda4ead8fdce904f0efc300f0603551d130101ff040530030101ff300a06082a8648ce3d04030203470030440220599cef920115b64a7d0bc7de55a84bba7f05ee78b9e903af7cb52b4a5dcc8ea2022006575445dab9c21325a48de3bd7ce51a34612015a74648787c7a7e032645377030820204308201aba003020102021418d83f07718be4121df0a18d7610faf8d7a3bec4300a06082a8648ce3d0403023058310b30090603550406130241553113301106035504080c0a536f6d652d537461746531173015060355040a0c0e4f63746f707573204465706c6f79310c300a060355040b0c03522644310d300b06035504030c0454455354301e170d3233303332303039343834325a170d3234303331393039343834325a3058310b30090603550406130241553113301106035504080c0a536f6d652d537461746531173015060355040a0c0e4f63746f707573204465706c6f79310c300a060355040b0c03522644310d300b06035504030c04544553543059301306072a8648ce3d020106082a8648ce3d03010703420004504b77248d83e2e3e209bbb2297a0e4d24ff45e79eff88dd165e6419ae98512dabd2219da46e93d7ff98d5a1cb80314a57f37d0931ecf7f3bd4bce212cfd2cbaa3533051301d0603551d0e04160414badd278a31e012776afbfda4ead8fdce904f0efc301f0603551d23041830168014badd278a31e012776afbfda4ead8fdce904f0efc300f0603551d130101ff040530030101ff300a06082a8648ce3d04030203470030440220599cef920115b64a7d0bc7de55a84bba7f05ee78b9e903af7cb52b4a5dcc8ea2022006575445dab9c21325a48de3bd7ce51a34612015a74648787c7a7e032645377030820204308201aba003020102021418d83f07718be4121df0a18d7610faf8d7",
 	}, logDeltaFile(input))
 }
+
+func TestReadsDeltaFileWithTrailingHash(t *testing.T) {
+	input, _ := hex.DecodeString("4f43544f44454c5441020453484131013e3e3e6000000000000000000802000000000000ff14000000330bd06982d3b5dbda6c1a6ad16687a0cdb03c0d")
+
+	reader := octodiff.NewBinaryDeltaReader(bytes.NewReader(input))
+	_, err := reader.ExpectedHash()
+	assert.NotNil(t, err) // not available until we've read the commands
+
+	assert.Equal(t, []string{
+		"copy start=0, length=520",
+	}, logDeltaFile(input))
+
+	err = reader.Apply(func([]byte) error { return nil }, func(int64, int64) error { return nil })
+	assert.Nil(t, err)
+	hash, err := reader.ExpectedHash()
+	assert.Nil(t, err)
+	assert.Equal(t, "330bd06982d3b5dbda6c1a6ad16687a0cdb03c0d", hex.EncodeToString(hash))
+}
+
+func TestRejectsVersion2DeltaFileWithoutEndMarker(t *testing.T) {
+	input, _ := hex.DecodeString("4f43544f44454c5441020453484131013e3e3e6000000000000000000802000000000000")
+
+	reader := octodiff.NewBinaryDeltaReader(bytes.NewReader(input))
+	err := reader.Apply(func([]byte) error { return nil }, func(int64, int64) error { return nil })
+	assert.EqualError(t, err, "the delta file appears to be truncated; the end of delta marker is missing (at command 1)")
+	var corruptErr *octodiff.DeltaCorruptError
+	assert.ErrorAs(t, err, &corruptErr)
+	assert.Equal(t, int64(1), corruptErr.CommandIndex)
+}
+
+func TestRejectsDeltaFileWithUnknownFlags(t *testing.T) {
+	input, _ := hex.DecodeString("4f43544f44454c5441020453484131803e3e3eff")
+
+	reader := octodiff.NewBinaryDeltaReader(bytes.NewReader(input))
+	_, err := reader.HashAlgorithm()
+	assert.EqualError(t, err, "the delta file uses features this program can't handle")
+}
+
+func TestReadsCompressedDataCommands(t *testing.T) {
+	b := bytes.NewBuffer(nil)
+	w := octodiff.NewBinaryDeltaWriter(b)
+	w.CompressData = true
+
+	data := test.GenerateTestData(3 * 1024 * 1024) // spans several compressed blocks
+	_ = w.WriteMetadata(&octodiff.Sha1HashAlgorithm{}, test.GenerateTestData(20))
+	_ = w.WriteDataCommand(bytes.NewReader(data), 0, int64(len(data)))
+	_ = w.WriteCopyCommand(0, 520)
+	_ = w.WriteDataCommand(bytes.NewReader(data), 0, 10) // too small to compress
+	_ = w.Flush()
+
+	var written bytes.Buffer
+	var copies []string
+	reader := octodiff.NewBinaryDeltaReader(bytes.NewReader(b.Bytes()))
+	err := reader.Apply(
+		func(bytes []byte) error {
+			written.Write(bytes)
+			return nil
+		}, func(start int64, length int64) error {
+			copies = append(copies, fmt.Sprintf("copy start=%v, length=%v", start, length))
+			return nil
+		})
+	assert.Nil(t, err)
+
+	assert.Equal(t, append(append([]byte(nil), data...), data[:10]...), written.Bytes())
+	assert.Equal(t, []string{"copy start=0, length=520"}, copies)
+}
+
+func TestRejectsCompressedDataCommandWithoutFlag(t *testing.T) {
+	// version 2 delta with no flags, but a compressed data command
+	input, _ := hex.DecodeString("4f43544f44454c54410204534841310014000000330bd06982d3b5dbda6c1a6ad16687a0cdb03c0d3e3e3ea000000000000000000000000000000000ff")
+
+	reader := octodiff.NewBinaryDeltaReader(bytes.NewReader(input))
+	err := reader.Apply(func([]byte) error { return nil }, func(int64, int64) error { return nil })
+	assert.EqualError(t, err, "unexpected cmd byte in delta file (at command 0)")
+}
+
+func TestReadsVarintCommands(t *testing.T) {
+	b := bytes.NewBuffer(nil)
+	w := octodiff.NewBinaryDeltaWriter(b)
+	w.VarintCommands = true
+	w.CompressData = true
+
+	data := test.GenerateTestData(4096)
+	_ = w.WriteMetadata(&octodiff.Sha1HashAlgorithm{}, test.GenerateTestData(20))
+	_ = w.WriteCopyCommand(5000000000, 520)
+	_ = w.WriteDataCommand(bytes.NewReader(data), 0, 3)
+	_ = w.WriteCopyCommand(1040, 1040)
+	_ = w.WriteCopyCommand(0, 520)
+	_ = w.WriteDataCommand(bytes.NewReader(data), 0, int64(len(data))) // compressed
+	_ = w.WriteCopyCommand(0, 520)
+	_ = w.Flush()
+
+	assert.Equal(t, []string{
+		"copy start=5000000000, length=520",
+		"write 308202",
+		"copy start=1040, length=1040",
+		"copy start=0, length=520",
+		"write " + hex.EncodeToString(data),
+		"copy start=0, length=520",
+	}, logDeltaFile(b.Bytes()))
+}
+
+// buildChecksummedDelta returns a delta with command checksums, and the offsets at which 0, 1, 3 and 5 commands
+// (including the end of delta marker) have been written
+func buildChecksummedDelta(data []byte) ([]byte, []int) {
+	b := bytes.NewBuffer(nil)
+	w := octodiff.NewBinaryDeltaWriter(b)
+	w.CommandChecksums = true
+	w.CompressData = true
+	w.VarintCommands = true
+
+	var commandEnds []int
+	_ = w.WriteMetadata(&octodiff.Sha1HashAlgorithm{}, test.GenerateTestData(20))
+	commandEnds = append(commandEnds, b.Len())
+	_ = w.WriteDataCommand(bytes.NewReader(data), 0, 100)
+	commandEnds = append(commandEnds, b.Len())
+	_ = w.WriteCopyCommand(0, 520)
+	_ = w.WriteDataCommand(bytes.NewReader(data), 0, int64(len(data))) // flushes the copy, then is compressed
+	commandEnds = append(commandEnds, b.Len())
+	_ = w.WriteCopyCommand(520, 520)
+	_ = w.Flush()
+	commandEnds = append(commandEnds, b.Len())
+	return b.Bytes(), commandEnds
+}
+
+func applyDeltaForError(delta []byte) error {
+	reader := octodiff.NewBinaryDeltaReader(bytes.NewReader(delta))
+	return reader.Apply(func([]byte) error { return nil }, func(int64, int64) error { return nil })
+}
+
+func TestReadsCommandChecksums(t *testing.T) {
+	data := test.GenerateTestData(8192)
+	delta, _ := buildChecksummedDelta(data)
+
+	assert.Equal(t, []string{
+		"write " + hex.EncodeToString(data[:100]),
+		"copy start=0, length=520",
+		"write " + hex.EncodeToString(data),
+		"copy start=520, length=520",
+	}, logDeltaFile(delta))
+}
+
+func TestReportsCommandWhichFailsChecksum(t *testing.T) {
+	data := test.GenerateTestData(8192)
+	delta, commandEnds := buildChecksummedDelta(data)
+
+	damaged := append([]byte(nil), delta...)
+	damaged[commandEnds[0]+10] ^= 0x01 // in the literal data of the first command
+
+	err := applyDeltaForError(damaged)
+	var corruptErr *octodiff.DeltaCorruptError
+	assert.ErrorAs(t, err, &corruptErr)
+	assert.Equal(t, int64(0), corruptErr.CommandIndex)
+	assert.Equal(t, "the delta file appears to be corrupt; the command does not match its checksum", corruptErr.Reason)
+
+	damaged = append([]byte(nil), delta...)
+	damaged[commandEnds[2]-10] ^= 0x01 // in the compressed data of the third command
+
+	err = applyDeltaForError(damaged)
+	assert.ErrorAs(t, err, &corruptErr)
+	assert.Equal(t, int64(2), corruptErr.CommandIndex)
+}
+
+func TestDoesNotApplyCommandWithDamagedHeader(t *testing.T) {
+	data := test.GenerateTestData(8192)
+	delta, commandEnds := buildChecksummedDelta(data)
+
+	// the length of the first data command, and the length of the copy command after it
+	for commandIndex, lengthOffset := range []int{commandEnds[0] + 1, commandEnds[1] + 2} {
+		damaged := append([]byte(nil), delta...)
+		damaged[lengthOffset] ^= 0x02
+
+		var applied []string
+		reader := octodiff.NewBinaryDeltaReader(bytes.NewReader(damaged))
+		err := reader.Apply(func(data []byte) error {
+			applied = append(applied, fmt.Sprintf("write %d", len(data)))
+			return nil
+		}, func(start int64, length int64) error {
+			applied = append(applied, fmt.Sprintf("copy %d %d", start, length))
+			return nil
+		})
+		var corruptErr *octodiff.DeltaCorruptError
+		assert.ErrorAs(t, err, &corruptErr)
+		assert.Equal(t, int64(commandIndex), corruptErr.CommandIndex)
+		assert.Equal(t, "the delta file appears to be corrupt; the command does not match its checksum", corruptErr.Reason)
+		assert.Len(t, applied, commandIndex, "only the commands before the damaged one are applied")
+	}
+}
+
+func TestReportsTruncatedDelta(t *testing.T) {
+	data := test.GenerateTestData(8192)
+	delta, commandEnds := buildChecksummedDelta(data)
+
+	for i, commandCount := range []int64{0, 1, 3} {
+		// truncated at a command boundary, and part way through the next command
+		for _, truncatedLength := range []int{commandEnds[i], commandEnds[i] + 3} {
+			err := applyDeltaForError(delta[:truncatedLength])
+			var corruptErr *octodiff.DeltaCorruptError
+			assert.ErrorAs(t, err, &corruptErr)
+			assert.Equal(t, commandCount, corruptErr.CommandIndex)
+		}
+	}
+
+	err := applyDeltaForError(delta[:len(delta)-1]) // the end of delta marker's checksum
+	assert.EqualError(t, err, "the delta file appears to be truncated (at command 4)")
+}
+
+func TestReportsMissingCommand(t *testing.T) {
+	data := test.GenerateTestData(8192)
+	delta, commandEnds := buildChecksummedDelta(data)
+
+	// remove the second and third commands, checksums and all
+	damaged := append(append([]byte(nil), delta[:commandEnds[1]]...), delta[commandEnds[2]:]...)
+
+	err := applyDeltaForError(damaged)
+	assert.EqualError(t, err, "the delta file appears to be corrupt; it should have 4 commands, but has 2 (at command 2)")
+}
+
+func TestReportsTruncatedDataCommand(t *testing.T) {
+	// version 1 delta, where the data command says there are 8 bytes but there are only 3
+	input, _ := hex.DecodeString("4f43544f44454c544101045348413114000000330bd06982d3b5dbda6c1a6ad16687a0cdb03c0d3e3e3e" + "800800000000000000308202")
+
+	err := applyDeltaForError(input)
+	assert.EqualError(t, err, "the delta file appears to be truncated (at command 0)")
+}
@@ -1,30 +1,126 @@
 package octodiff
 
 import (
+	"bytes"
+	"compress/flate"
 	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
 	"io"
 )
 
 type BinaryDeltaWriter struct {
-	Output             io.Writer
+	Output io.Writer
+
+	// TrailingHash writes the expected hash of the new file after the last command, rather than in the metadata,
+	// so the delta can be built in a single pass. The new file must still be seekable; see DeltaBuilder.Build.
+	// This needs the version 2 format.
+	TrailingHash bool
+
+	// CompressData writes Data commands of at least CompressionThreshold bytes compressed with DEFLATE, in blocks of
+	// up to 1MB. Blocks which don't get any smaller are written uncompressed.
+	// This needs the version 2 format.
+	CompressData         bool
+	CompressionThreshold int64
+
+	// VarintCommands writes the offsets and lengths in commands as varints, with each copy offset relative to the end
+	// of the previous copy, rather than as int64s. A copy command usually shrinks from 17 bytes to a handful.
+	// This needs the version 2 format.
+	VarintCommands bool
+
+	// CommandChecksums writes the CRC-32 of each command after it, and records the number of commands and the length
+	// of the new file at the end. Data commands have one CRC-32 after their header and another after their data. This
+	// lets BinaryDeltaReader report which command is damaged, or that the delta is truncated.
+	// This needs the version 2 format.
+	CommandChecksums bool
+
+	compressor       *flate.Writer
+	compressedBuffer bytes.Buffer
+	dataBuffer       []byte
+
+	basisLength        int64
+	basisHash          []byte
 	bufferedCopyOffset int64
 	bufferedCopyLength int64
+	previousCopyEnd    int64
+	commandBuffer      []byte
+	commandChecksum    hash.Hash32
+	checksummedOutput  io.Writer
+	commandCount       int64
+	newFileLength      int64
+	flags              DeltaFlags
+	hasWrittenEnd      bool
 }
 
-var _ DeltaWriter = (*BinaryDeltaWriter)(nil)
+// DefaultCompressionThreshold is the smallest Data command BinaryDeltaWriter will compress.
+// Below this, the compressed block usually isn't any smaller once the command header is included.
+const DefaultCompressionThreshold = 512
+
+// compressedBlockSize is the most data that goes into a single BinaryCompressedDataCommand, which bounds
+// the memory needed to write and read them.
+const compressedBlockSize = 1024 * 1024
+
+var _ TrailingHashDeltaWriter = (*BinaryDeltaWriter)(nil)
+var _ BasisIdentityDeltaWriter = (*BinaryDeltaWriter)(nil)
 
 func NewBinaryDeltaWriter(output io.Writer) *BinaryDeltaWriter {
 	return &BinaryDeltaWriter{
-		Output: output,
+		Output:               output,
+		CompressionThreshold: DefaultCompressionThreshold,
 	}
 }
 
+// SetBasisIdentity makes the writer record the basis file in the metadata. This needs the version 2 format.
+func (w *BinaryDeltaWriter) SetBasisIdentity(basisLength int64, basisHash []byte) {
+	w.basisLength = basisLength
+	w.basisHash = basisHash
+}
+
+func (w *BinaryDeltaWriter) WritesTrailingHash() bool {
+	return w.TrailingHash
+}
+
+// WriteMetadata writes the C# compatible version 1 format, unless one of the options on the writer needs version 2.
+// It starts a new delta, so a writer can be used for another once the last has been flushed. Anything left over from
+// the last delta, such as a copy command that was never flushed, is dropped.
 func (w *BinaryDeltaWriter) WriteMetadata(hashAlgorithm HashAlgorithm, expectedNewFileHash []byte) error {
+	w.flags = 0
+	if w.TrailingHash {
+		w.flags |= DeltaFlagTrailingHash
+	}
+	if w.basisHash != nil {
+		w.flags |= DeltaFlagBasisIdentity
+	}
+	if w.CompressData {
+		w.flags |= DeltaFlagCompressedData
+	}
+	if w.VarintCommands {
+		w.flags |= DeltaFlagVarintCommands
+	}
+	w.commandChecksum = nil
+	w.checksummedOutput = nil
+	if w.CommandChecksums {
+		w.flags |= DeltaFlagCommandChecksums
+		w.commandChecksum = crc32.NewIEEE()
+		w.checksummedOutput = io.MultiWriter(w.Output, w.commandChecksum)
+	}
+	w.bufferedCopyOffset = 0
+	w.bufferedCopyLength = 0
+	w.previousCopyEnd = 0
+	w.commandCount = 0
+	w.newFileLength = 0
+	w.hasWrittenEnd = false
+
 	_, err := w.Output.Write(BinaryDeltaHeader)
 	if err != nil {
 		return err
 	}
-	_, err = w.Output.Write(BinaryVersion)
+	if w.flags == 0 {
+		_, err = w.Output.Write(BinaryVersion)
+	} else {
+		_, err = w.Output.Write(BinaryDeltaVersion2)
+	}
 	if err != nil {
 		return err
 	}
@@ -32,15 +128,46 @@ func (w *BinaryDeltaWriter) WriteMetadata(hashAlgorithm HashAlgorithm, expectedN
 	if err != nil {
 		return err
 	}
-	err = binary.Write(w.Output, binary.LittleEndian, int32(len(expectedNewFileHash)))
-	if err != nil {
-		return err
+	if w.flags != 0 {
+		_, err = w.Output.Write([]byte{byte(w.flags)})
+		if err != nil {
+			return err
+		}
 	}
-	_, err = w.Output.Write(expectedNewFileHash)
+	if w.flags&DeltaFlagBasisIdentity != 0 {
+		err = writeBasisIdentity(w.Output, w.basisLength, w.basisHash)
+		if err != nil {
+			return err
+		}
+	}
+	if w.flags&DeltaFlagTrailingHash == 0 {
+		err = writeHash(w.Output, expectedNewFileHash)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = w.Output.Write(BinaryEndOfMetadata)
+	return err
+}
+
+// WriteTrailingHash writes the expected hash of the new file after the end of the commands.
+// Flush must have been called first.
+func (w *BinaryDeltaWriter) WriteTrailingHash(expectedNewFileHash []byte) error {
+	if w.flags&DeltaFlagTrailingHash == 0 {
+		return errors.New("the delta writer was not configured to write a trailing hash")
+	}
+	if !w.hasWrittenEnd {
+		return errors.New("the delta writer must be flushed before writing the trailing hash")
+	}
+	return writeHash(w.Output, expectedNewFileHash)
+}
+
+func writeHash(output io.Writer, hash []byte) error {
+	err := binary.Write(output, binary.LittleEndian, int32(len(hash)))
 	if err != nil {
 		return err
 	}
-	_, err = w.Output.Write(BinaryEndOfMetadata)
+	_, err = output.Write(hash)
 	return err
 }
 
@@ -54,7 +181,7 @@ func (w *BinaryDeltaWriter) WriteCopyCommand(offset int64, length int64) error {
 		if w.bufferedCopyOffset+w.bufferedCopyLength == offset { // merge
 			w.bufferedCopyLength += length
 		} else { // write previous and buffer this one
-			err := writeCopyCommand(w.Output, w.bufferedCopyOffset, w.bufferedCopyLength)
+			err := w.writeCopyCommand(w.bufferedCopyOffset, w.bufferedCopyLength)
 			w.bufferedCopyOffset = offset
 			w.bufferedCopyLength = length
 			return err
@@ -76,9 +203,95 @@ func writeCopyCommand(output io.Writer, offset, length int64) error {
 	return binary.Write(output, binary.LittleEndian, length)
 }
 
+func (w *BinaryDeltaWriter) writeCopyCommand(offset, length int64) error {
+	var err error
+	if w.flags&DeltaFlagVarintCommands == 0 {
+		err = writeCopyCommand(w.commandOutput(), offset, length)
+	} else {
+		cmd := append(w.commandBuffer[:0], BinaryCopyCommand...)
+		cmd = binary.AppendVarint(cmd, offset-w.previousCopyEnd)
+		cmd = binary.AppendUvarint(cmd, uint64(length))
+		w.commandBuffer = cmd
+		w.previousCopyEnd = offset + length
+		_, err = w.commandOutput().Write(cmd)
+	}
+	if err != nil {
+		return err
+	}
+	return w.endCommand(length)
+}
+
+// commandOutput is where commands are written, so that they are included in the command checksum if there is one
+func (w *BinaryDeltaWriter) commandOutput() io.Writer {
+	if w.flags&DeltaFlagCommandChecksums == 0 {
+		return w.Output
+	}
+	return w.checksummedOutput
+}
+
+// endCommand is called after each command has been written, to write its checksum if needed
+func (w *BinaryDeltaWriter) endCommand(outputLength int64) error {
+	w.commandCount++
+	w.newFileLength += outputLength
+	return w.writeCommandChecksum()
+}
+
+func (w *BinaryDeltaWriter) writeCommandChecksum() error {
+	if w.flags&DeltaFlagCommandChecksums == 0 {
+		return nil
+	}
+	err := binary.Write(w.Output, binary.LittleEndian, w.commandChecksum.Sum32())
+	w.commandChecksum.Reset()
+	return err
+}
+
+// writeCommandLengths writes a command byte followed by its lengths, as int64s or varints depending on the flags
+func (w *BinaryDeltaWriter) writeCommandLengths(command []byte, lengths ...int64) error {
+	cmd := append(w.commandBuffer[:0], command...)
+	for _, length := range lengths {
+		if w.flags&DeltaFlagVarintCommands == 0 {
+			cmd = binary.LittleEndian.AppendUint64(cmd, uint64(length))
+		} else {
+			cmd = binary.AppendUvarint(cmd, uint64(length))
+		}
+	}
+	w.commandBuffer = cmd
+	_, err := w.commandOutput().Write(cmd)
+	if err != nil {
+		return err
+	}
+	// the header has a checksum of its own, so the reader can check the lengths before it reads the data
+	return w.writeCommandChecksum()
+}
+
+// Flush writes any buffered copy command, and for the version 2 format, marks the end of the commands.
 func (w *BinaryDeltaWriter) Flush() error {
+	err := w.flushCopyCommand()
+	if err != nil {
+		return err
+	}
+	if w.flags != 0 && !w.hasWrittenEnd {
+		w.hasWrittenEnd = true
+		if w.flags&DeltaFlagCommandChecksums == 0 {
+			_, err = w.Output.Write(BinaryEndOfDeltaCommand)
+			return err
+		}
+		end := append(w.commandBuffer[:0], BinaryEndOfDeltaCommand...)
+		end = binary.LittleEndian.AppendUint64(end, uint64(w.commandCount))
+		end = binary.LittleEndian.AppendUint64(end, uint64(w.newFileLength))
+		w.commandBuffer = end
+		_, err = w.checksummedOutput.Write(end)
+		if err != nil {
+			return err
+		}
+		return w.writeCommandChecksum()
+	}
+	return err
+}
+
+func (w *BinaryDeltaWriter) flushCopyCommand() error {
 	if w.bufferedCopyLength != 0 {
-		err := writeCopyCommand(w.Output, w.bufferedCopyOffset, w.bufferedCopyLength)
+		err := w.writeCopyCommand(w.bufferedCopyOffset, w.bufferedCopyLength)
 		w.bufferedCopyOffset = 0
 		w.bufferedCopyLength = 0
 		return err
@@ -90,16 +303,7 @@ func (w *BinaryDeltaWriter) Flush() error {
 // WriteDataCommand writes the "Data Command" header to `output`
 // then proceeds to read `length` bytes from `source`, seeking to `offset` and write those to `output`
 func (w *BinaryDeltaWriter) WriteDataCommand(source io.ReadSeeker, offset int64, length int64) (err error) {
-	err = w.Flush()
-	if err != nil {
-		return
-	}
-
-	_, err = w.Output.Write(BinaryDataCommand)
-	if err != nil {
-		return
-	}
-	err = binary.Write(w.Output, binary.LittleEndian, length)
+	err = w.flushCopyCommand()
 	if err != nil {
 		return
 	}
@@ -122,9 +326,77 @@ func (w *BinaryDeltaWriter) WriteDataCommand(source io.ReadSeeker, offset int64,
 		return
 	}
 
+	if w.flags&DeltaFlagCompressedData != 0 && length >= w.CompressionThreshold {
+		return w.writeCompressedData(source, length)
+	}
+
+	err = w.writeCommandLengths(BinaryDataCommand, length)
+	if err != nil {
+		return
+	}
+
+	output := w.commandOutput()
 	iter := NewReaderIteratorSizeNBytes(source, 1024*1024, length)
 	for iter.Next() {
-		_, err = w.Output.Write(iter.Current)
+		_, err = output.Write(iter.Current)
+		if err != nil {
+			return err
+		}
+	}
+	err = iter.Err()
+	if err != nil {
+		return err
+	}
+	return w.endCommand(length)
+}
+
+// writeCompressedData writes `length` bytes from the current position of `source` as a sequence of
+// compressed data commands, falling back to plain data commands for blocks which don't compress
+func (w *BinaryDeltaWriter) writeCompressedData(source io.Reader, length int64) error {
+	if w.dataBuffer == nil {
+		w.dataBuffer = make([]byte, compressedBlockSize)
+	}
+
+	iter := NewReaderIteratorBufferNBytes(source, w.dataBuffer, length)
+	for iter.Next() {
+		block := iter.Current
+
+		w.compressedBuffer.Reset()
+		if w.compressor == nil {
+			compressor, err := flate.NewWriter(&w.compressedBuffer, flate.DefaultCompression)
+			if err != nil {
+				return err
+			}
+			w.compressor = compressor
+		} else {
+			w.compressor.Reset(&w.compressedBuffer)
+		}
+		_, err := w.compressor.Write(block)
+		if err != nil {
+			return err
+		}
+		err = w.compressor.Close()
+		if err != nil {
+			return err
+		}
+
+		if w.compressedBuffer.Len() < len(block) {
+			err = w.writeCommandLengths(BinaryCompressedDataCommand, int64(len(block)), int64(w.compressedBuffer.Len()))
+			if err != nil {
+				return err
+			}
+			_, err = w.commandOutput().Write(w.compressedBuffer.Bytes())
+		} else {
+			err = w.writeCommandLengths(BinaryDataCommand, int64(len(block)))
+			if err != nil {
+				return err
+			}
+			_, err = w.commandOutput().Write(block)
+		}
+		if err != nil {
+			return err
+		}
+		err = w.endCommand(int64(len(block)))
 		if err != nil {
 			return err
 		}
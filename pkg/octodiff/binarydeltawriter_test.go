@@ -2,10 +2,13 @@ package octodiff_test
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
 	"github.com/OctopusDeploy/go-octodiff/pkg/test"
 	"github.com/stretchr/testify/assert"
+	"hash/crc32"
+	"math/rand"
 	"testing"
 )
 
@@ -89,3 +92,181 @@ func TestDataCommandFlushesCopyCommand(t *testing.T) {
 
 	assert.Equal(t, "6000000000000000008000000000000000808000000000000000bd7ce51a34612015a74648787c7a7e032645377030820204308201aba003020102021418d83f07718be4121df0a18d7610faf8d7a3bec4300a06082a8648ce3d0403023058310b30090603550406130241553113301106035504080c0a536f6d652d537461746531173015060355040a0c0e4f63746f707573204465706c6f796080000000000000008000000000000000", hex.EncodeToString(b.Bytes()))
 }
+
+func TestWritesTrailingHash(t *testing.T) {
+	b := bytes.NewBuffer(nil)
+	w := octodiff.NewBinaryDeltaWriter(b)
+	w.TrailingHash = true
+
+	err := w.WriteMetadata(&octodiff.Sha1HashAlgorithm{}, nil)
+	assert.Nil(t, err)
+	// version 2 header with flags of 0x01, and no hash
+	assert.Equal(t, "4f43544f44454c5441020453484131013e3e3e", hex.EncodeToString(b.Bytes()))
+
+	err = w.WriteCopyCommand(0, 520)
+	assert.Nil(t, err)
+	err = w.Flush()
+	assert.Nil(t, err)
+	err = w.WriteTrailingHash(test.GenerateTestData(20))
+	assert.Nil(t, err)
+
+	assert.Equal(t, "4f43544f44454c5441020453484131013e3e3e"+
+		"6000000000000000000802000000000000"+ // copy
+		"ff"+ // end of delta
+		"1400000030820204308201aba003020102021418d83f0771", // hash
+		hex.EncodeToString(b.Bytes()))
+}
+
+func TestWriteTrailingHashRequiresFlush(t *testing.T) {
+	b := bytes.NewBuffer(nil)
+	w := octodiff.NewBinaryDeltaWriter(b)
+	w.TrailingHash = true
+
+	err := w.WriteMetadata(&octodiff.Sha1HashAlgorithm{}, nil)
+	assert.Nil(t, err)
+	err = w.WriteTrailingHash(test.GenerateTestData(20))
+	assert.NotNil(t, err)
+}
+
+func TestWritesCompressedDataCommand(t *testing.T) {
+	b := bytes.NewBuffer(nil)
+	w := octodiff.NewBinaryDeltaWriter(b)
+	w.CompressData = true
+
+	err := w.WriteMetadata(&octodiff.Sha1HashAlgorithm{}, test.GenerateTestData(20))
+	assert.Nil(t, err)
+	headerLength := b.Len()
+
+	// the test data repeats every 520 bytes, so compresses well
+	source := bytes.NewReader(test.GenerateTestData(64 * 1024))
+	err = w.WriteDataCommand(source, 0, 64*1024)
+	assert.Nil(t, err)
+
+	command := b.Bytes()[headerLength:]
+	assert.Equal(t, "a0"+"0000010000000000", hex.EncodeToString(command[:9])) // command, then 64k uncompressed
+	compressedLength := binary.LittleEndian.Uint64(command[9:17])
+	assert.Equal(t, int(compressedLength), len(command)-17)
+	assert.Less(t, compressedLength, uint64(2048))
+}
+
+func TestWritesSmallDataUncompressed(t *testing.T) {
+	b := bytes.NewBuffer(nil)
+	w := octodiff.NewBinaryDeltaWriter(b)
+	w.CompressData = true
+
+	err := w.WriteMetadata(&octodiff.Sha1HashAlgorithm{}, test.GenerateTestData(20))
+	assert.Nil(t, err)
+	headerLength := b.Len()
+
+	source := bytes.NewReader(make([]byte, 1024))
+	err = w.WriteDataCommand(source, 0, octodiff.DefaultCompressionThreshold-1)
+	assert.Nil(t, err)
+
+	command := b.Bytes()[headerLength:]
+	assert.Equal(t, "80"+"ff01000000000000", hex.EncodeToString(command[:9]))
+	assert.Equal(t, 9+octodiff.DefaultCompressionThreshold-1, len(command))
+}
+
+func TestWritesIncompressibleDataUncompressed(t *testing.T) {
+	b := bytes.NewBuffer(nil)
+	w := octodiff.NewBinaryDeltaWriter(b)
+	w.CompressData = true
+
+	err := w.WriteMetadata(&octodiff.Sha1HashAlgorithm{}, test.GenerateTestData(20))
+	assert.Nil(t, err)
+	headerLength := b.Len()
+
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	err = w.WriteDataCommand(bytes.NewReader(random), 0, int64(len(random)))
+	assert.Nil(t, err)
+
+	command := b.Bytes()[headerLength:]
+	assert.Equal(t, "80"+"0010000000000000", hex.EncodeToString(command[:9]))
+	assert.Equal(t, random, command[9:])
+}
+
+func TestWritesVarintCommands(t *testing.T) {
+	b := bytes.NewBuffer(nil)
+	w := octodiff.NewBinaryDeltaWriter(b)
+	w.VarintCommands = true
+
+	err := w.WriteMetadata(&octodiff.Sha1HashAlgorithm{}, test.GenerateTestData(20))
+	assert.Nil(t, err)
+	headerLength := b.Len()
+
+	err = w.WriteCopyCommand(1000, 520)
+	assert.Nil(t, err)
+	err = w.WriteCopyCommand(0, 520) // offsets are relative to the end of the previous copy, so this one is negative
+	assert.Nil(t, err)
+	err = w.WriteDataCommand(bytes.NewReader(test.GenerateTestData(1024)), 0, 3)
+	assert.Nil(t, err)
+	err = w.Flush()
+	assert.Nil(t, err)
+
+	assert.Equal(t, "08", hex.EncodeToString(b.Bytes()[15:16])) // flags after "OCTODELTA" 0x02 0x04 "SHA1"
+	assert.Equal(t, "60"+"d00f"+"8804"+"60"+"df17"+"8804"+"80"+"03"+"308202"+"ff", hex.EncodeToString(b.Bytes()[headerLength:]))
+}
+
+func TestWritesCommandChecksums(t *testing.T) {
+	b := bytes.NewBuffer(nil)
+	w := octodiff.NewBinaryDeltaWriter(b)
+	w.CommandChecksums = true
+
+	err := w.WriteMetadata(&octodiff.Sha1HashAlgorithm{}, test.GenerateTestData(20))
+	assert.Nil(t, err)
+	headerLength := b.Len()
+
+	err = w.WriteCopyCommand(315412, 9874563)
+	assert.Nil(t, err)
+	err = w.WriteDataCommand(bytes.NewReader(test.GenerateTestData(1024)), 0, 3)
+	assert.Nil(t, err)
+	err = w.Flush()
+	assert.Nil(t, err)
+
+	copyCommand, _ := hex.DecodeString("6014d004000000000083ac960000000000")
+	dataCommandHeader, _ := hex.DecodeString("800300000000000000")
+	data, _ := hex.DecodeString("308202")                                             // the data command's header and data have a checksum each
+	endOfDelta, _ := hex.DecodeString("ff" + "0200000000000000" + "86ac960000000000") // 2 commands, 9874566 bytes
+
+	var expected []byte
+	for _, command := range [][]byte{copyCommand, dataCommandHeader, data, endOfDelta} {
+		expected = append(expected, command...)
+		expected = binary.LittleEndian.AppendUint32(expected, crc32.ChecksumIEEE(command))
+	}
+	assert.Equal(t, hex.EncodeToString(expected), hex.EncodeToString(b.Bytes()[headerLength:]))
+}
+
+func TestBinaryDeltaWriterCanBeReused(t *testing.T) {
+	basis, newFile := buildPatchedFileTestData()
+	signature := buildSignature(basis)
+
+	var first bytes.Buffer
+	w := octodiff.NewBinaryDeltaWriter(&first)
+	w.TrailingHash = true
+	w.CommandChecksums = true
+	buildDeltaWith := func(output *bytes.Buffer) {
+		w.Output = output
+		err := octodiff.NewDeltaBuilder().Build(bytes.NewReader(newFile), int64(len(newFile)), bytes.NewReader(signature), int64(len(signature)), w)
+		assert.Nil(t, err)
+	}
+	buildDeltaWith(&first)
+
+	// the second delta gets its own end marker
+	var second bytes.Buffer
+	buildDeltaWith(&second)
+	assert.Equal(t, first.Bytes(), second.Bytes())
+
+	// and a copy left over from a delta which was abandoned before it was flushed doesn't end up in the next one
+	w.Output = &bytes.Buffer{}
+	assert.Nil(t, w.WriteMetadata(octodiff.DefaultHashAlgorithm, nil))
+	assert.Nil(t, w.WriteCopyCommand(0, 100))
+	var third bytes.Buffer
+	buildDeltaWith(&third)
+	assert.Equal(t, first.Bytes(), third.Bytes())
+
+	var patched bytes.Buffer
+	err := octodiff.ApplyDeltaAndVerify(bytes.NewReader(basis), octodiff.NewBinaryDeltaReader(bytes.NewReader(third.Bytes())), &patched)
+	assert.Nil(t, err)
+	assert.Equal(t, newFile, patched.Bytes())
+}
@@ -0,0 +1,51 @@
+package octodiff
+
+import "math/bits"
+
+// BuzhashRollingChecksum is a cyclic polynomial rolling hash. Every byte value is mapped to a random 32-bit
+// value, and the checksum is the XOR of those values each rotated by their distance from the end of the block.
+// Unlike the Adler variants, every bit of the checksum depends on every byte, so it spreads out well over
+// low-entropy input such as data drawn from a handful of byte values.
+// Note that rotating a 32-bit value repeats every 32 bytes, so blocks which differ only by moving some bytes
+// a multiple of 32 positions (e.g. a fragment of data moving around inside zero padding) share a checksum.
+// RabinKarpRollingChecksum doesn't have this weakness.
+type BuzhashRollingChecksum struct{}
+
+const BuzhashRollingChecksumName = "Buzhash"
+
+func NewBuzhashRollingChecksum() *BuzhashRollingChecksum {
+	return &BuzhashRollingChecksum{}
+}
+
+func (_ *BuzhashRollingChecksum) Name() string {
+	return BuzhashRollingChecksumName
+}
+
+func (_ *BuzhashRollingChecksum) Calculate(block []byte) uint32 {
+	h := uint32(0)
+	for _, z := range block {
+		h = bits.RotateLeft32(h, 1) ^ buzhashTable[z]
+	}
+	return h
+}
+
+func (_ *BuzhashRollingChecksum) Rotate(checksum uint32, remove byte, add byte, chunkSize int) uint32 {
+	return bits.RotateLeft32(checksum, 1) ^ bits.RotateLeft32(buzhashTable[remove], chunkSize%32) ^ buzhashTable[add]
+}
+
+var _ RollingChecksum = (*BuzhashRollingChecksum)(nil)
+
+// buzhashTable is part of the signature file format; changing how it is generated breaks every existing Buzhash signature.
+var buzhashTable = func() (table [256]uint32) {
+	// splitmix64, with a fixed seed so the table is the same everywhere
+	state := uint64(0x4f43544f44494646) // "OCTODIFF"
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		z = z ^ (z >> 31)
+		table[i] = uint32(z >> 32)
+	}
+	return
+}()
@@ -0,0 +1,43 @@
+package octodiff_test
+
+import (
+	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
+	"github.com/OctopusDeploy/go-octodiff/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBuzhashRollingChecksum_Name(t *testing.T) {
+	c := octodiff.NewBuzhashRollingChecksum()
+
+	assert.Equal(t, "Buzhash", c.Name())
+}
+
+func TestBuzhashRollingChecksum_Calculate(t *testing.T) {
+	c := octodiff.NewBuzhashRollingChecksum()
+	block := test.TestData()
+
+	assert.Equal(t, uint32(2973670854), c.Calculate(block[:100]))
+	assert.Equal(t, uint32(123594188), c.Calculate(block[1:101]))
+	assert.Equal(t, uint32(1529070943), c.Calculate(block[2:102]))
+	assert.Equal(t, uint32(3120349196), c.Calculate(block[93:193]))
+	assert.Equal(t, uint32(1654698833), c.Calculate(block))
+
+	largeBlock := test.GenerateTestData(100 * 1024)
+	assert.Equal(t, uint32(2532906060), c.Calculate(largeBlock))
+}
+
+func TestBuzhashRollingChecksum_RotateMatchesCalculate(t *testing.T) {
+	c := octodiff.NewBuzhashRollingChecksum()
+	block := test.GenerateTestData(4096)
+
+	for _, chunkSize := range []int{31, 32, 128, 2048} {
+		checksum := c.Calculate(block[:chunkSize])
+		for i := 1; i+chunkSize <= len(block); i++ {
+			checksum = c.Rotate(checksum, block[i-1], block[i+chunkSize-1], chunkSize)
+			if !assert.Equal(t, c.Calculate(block[i:i+chunkSize]), checksum, "chunkSize %d offset %d", chunkSize, i) {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package octodiff
+
+import (
+	"bytes"
+	"sort"
+)
+
+// chunkLookup finds the chunks of a signature by their rolling checksum. It isn't changed once it is built, so
+// scans of different parts of the new file can share it.
+type chunkLookup struct {
+	signature *Signature
+	lengths   []int // the distinct chunk lengths in the signature, longest first
+	finder    chunkFinder
+}
+
+// chunkFinder returns the first chunk, in checksum then offset order, with the checksum, length and hash of block,
+// or nil if there isn't one. It is called concurrently when the new file is scanned in segments.
+type chunkFinder interface {
+	findChunk(checksum uint32, block []byte) (*ChunkSignature, error)
+}
+
+const checksumFilterBits = 20
+
+func checksumFilterIndex(checksum uint32, bits uint) uint32 {
+	// the low bits of some rolling checksums vary less than the high ones, so mix them all in
+	return (checksum * 0x9e3779b1) >> (32 - bits)
+}
+
+func (d *DeltaBuilder) createChunkLookup(signature *Signature) *chunkLookup {
+	chunks := signature.Chunks
+	sort.Slice(chunks, func(i, j int) bool {
+		// aligns with C# ChunkSignatureChecksumComparer
+		x, y := chunks[i], chunks[j]
+		if x.RollingChecksum == y.RollingChecksum {
+			return x.StartOffset < y.StartOffset
+		}
+		return x.RollingChecksum < y.RollingChecksum
+	})
+
+	d.ProgressReporter.ReportProgress("Creating chunk map", 0, int64(len(chunks)))
+
+	finder := &chunkMap{
+		hashAlgorithm:  signature.HashAlgorithm,
+		chunks:         chunks,
+		chunkMap:       make(map[uint32]int),
+		checksumFilter: make([]uint64, (1<<checksumFilterBits)/64),
+	}
+	seenLengths := make(map[int]bool)
+	var lengths []int
+
+	for chunkIdx, chunk := range chunks {
+		if length := chunk.ChunkLength(); !seenLengths[length] && length > 0 {
+			seenLengths[length] = true
+			lengths = append(lengths, length)
+		}
+
+		if _, ok := finder.chunkMap[chunk.RollingChecksum]; !ok {
+			finder.chunkMap[chunk.RollingChecksum] = chunkIdx
+			index := checksumFilterIndex(chunk.RollingChecksum, checksumFilterBits)
+			finder.checksumFilter[index/64] |= 1 << (index % 64)
+		}
+		d.ProgressReporter.ReportProgress("Creating chunk map", int64(chunkIdx), int64(len(chunks)))
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(lengths)))
+
+	return &chunkLookup{signature: signature, lengths: lengths, finder: finder}
+}
+
+// minChunkLength and maxChunkLength are zero if the signature has no chunks
+func (c *chunkLookup) minChunkLength() int {
+	if len(c.lengths) == 0 {
+		return 0
+	}
+	return c.lengths[len(c.lengths)-1]
+}
+
+func (c *chunkLookup) maxChunkLength() int {
+	if len(c.lengths) == 0 {
+		return 0
+	}
+	return c.lengths[0]
+}
+
+// chunkMap finds chunks in a signature which has been read into memory
+type chunkMap struct {
+	hashAlgorithm HashAlgorithm
+	// chunks are sorted by rolling checksum, then by offset, so the first of any duplicates is found first
+	chunks   []*ChunkSignature
+	chunkMap map[uint32]int // the index in chunks of the first chunk with each checksum
+
+	// checksumFilter has a bit set for each checksum in chunkMap. Most positions in the new file don't match
+	// anything, and checking the bit is much quicker than looking in the map.
+	checksumFilter []uint64
+}
+
+var _ chunkFinder = (*chunkMap)(nil)
+
+func (c *chunkMap) findChunk(checksum uint32, block []byte) (*ChunkSignature, error) {
+	index := checksumFilterIndex(checksum, checksumFilterBits)
+	if c.checksumFilter[index/64]&(1<<(index%64)) == 0 {
+		return nil, nil
+	}
+	startIndex, ok := c.chunkMap[checksum]
+	if !ok {
+		return nil, nil
+	}
+	var hash []byte
+	for j := startIndex; j < len(c.chunks) && c.chunks[j].RollingChecksum == checksum; j++ {
+		if c.chunks[j].ChunkLength() != len(block) {
+			continue
+		}
+		if hash == nil {
+			hash = c.hashAlgorithm.HashOverData(block)
+		}
+		if bytes.Equal(hash, c.chunks[j].Hash) {
+			return c.chunks[j], nil
+		}
+	}
+	return nil, nil
+}
+
+// ----------------------------------------------------------------------------
+
+// chunkMatcher keeps a rolling checksum for each distinct chunk length as it moves along the new file, so a chunk of
+// any length in the signature can be found at any position. Each scan needs its own.
+type chunkMatcher struct {
+	lookup    *chunkLookup
+	rotators  []func(checksum uint32, remove byte, add byte) uint32 // one for each length
+	checksums []uint32
+	positions []int64 // where in the new file each checksum was calculated, or -1
+}
+
+// chunkSizeRotator is implemented by rolling checksums which can do some of the work of Rotate once for each chunk
+// size, rather than at every position
+type chunkSizeRotator interface {
+	rotatorFor(chunkSize int) func(checksum uint32, remove byte, add byte) uint32
+}
+
+func (c *chunkLookup) newMatcher() *chunkMatcher {
+	m := &chunkMatcher{
+		lookup:    c,
+		rotators:  make([]func(uint32, byte, byte) uint32, len(c.lengths)),
+		checksums: make([]uint32, len(c.lengths)),
+		positions: make([]int64, len(c.lengths)),
+	}
+	checksumAlgorithm := c.signature.RollingChecksumAlgorithm
+	for k, length := range c.lengths {
+		m.positions[k] = -1
+		if r, ok := checksumAlgorithm.(chunkSizeRotator); ok {
+			m.rotators[k] = r.rotatorFor(length)
+		} else {
+			length := length
+			m.rotators[k] = func(checksum uint32, remove byte, add byte) uint32 {
+				return checksumAlgorithm.Rotate(checksum, remove, add, length)
+			}
+		}
+	}
+	return m
+}
+
+// match looks for a chunk starting at data[i], which is at position in the new file, trying the longest chunks
+// first. Lengths which would run past the end of data are skipped. Where the last call was for the position before,
+// the checksums are rotated rather than calculated again.
+func (m *chunkMatcher) match(data []byte, i int, position int64) (*ChunkSignature, error) {
+	checksumAlgorithm := m.lookup.signature.RollingChecksumAlgorithm
+	for k, length := range m.lookup.lengths {
+		if i+length > len(data) {
+			continue
+		}
+		if i > 0 && m.positions[k] == position-1 {
+			m.checksums[k] = m.rotators[k](m.checksums[k], data[i-1], data[i+length-1])
+		} else {
+			m.checksums[k] = checksumAlgorithm.Calculate(data[i : i+length])
+		}
+		m.positions[k] = position
+
+		chunk, err := m.lookup.finder.findChunk(m.checksums[k], data[i:i+length])
+		if chunk != nil || err != nil {
+			return chunk, err
+		}
+	}
+	return nil, nil
+}
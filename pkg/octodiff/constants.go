@@ -7,3 +7,68 @@ var BinaryEndOfMetadata = []byte(">>>")
 var BinaryCopyCommand = []byte{0x60}
 var BinaryDataCommand = []byte{0x80}
 var BinaryVersion = []byte{0x01}
+
+// BinarySignatureVersion2 is only written when a feature which needs it is enabled; see the package documentation.
+// Its metadata has a SignatureFlags byte after the rolling checksum name, and there may be a trailer after the chunks
+var BinarySignatureVersion2 = []byte{0x02}
+
+// SignatureFlags records which optional features a version 2 signature uses
+type SignatureFlags uint8
+
+const (
+	// SignatureFlagBasisIdentity means the length and hash of the whole basis file follow the chunks
+	SignatureFlagBasisIdentity SignatureFlags = 1 << iota
+
+	// SignatureFlagContentDefinedChunks means the chunks were cut by content defined chunking. The minimum, average
+	// and maximum chunk sizes follow the flags byte, each as a little endian uint32.
+	SignatureFlagContentDefinedChunks
+
+	// SignatureFlagLargeChunks means the length of each chunk is a uint32 rather than a uint16
+	SignatureFlagLargeChunks
+)
+
+const knownSignatureFlags = SignatureFlagBasisIdentity | SignatureFlagContentDefinedChunks | SignatureFlagLargeChunks
+
+// BinaryDeltaVersion2 is only written when a feature which needs it is enabled; see the package documentation.
+// Its metadata has a DeltaFlags byte after the hash algorithm name, and its commands end with BinaryEndOfDeltaCommand
+var BinaryDeltaVersion2 = []byte{0x02}
+var BinaryEndOfDeltaCommand = []byte{0xFF}
+
+// BinaryCompressedDataCommand is like BinaryDataCommand, but the data is compressed with DEFLATE.
+// It is followed by the uncompressed length and the compressed length, then the compressed data
+var BinaryCompressedDataCommand = []byte{0xA0}
+
+// DeltaFlags records which optional features a version 2 delta uses
+type DeltaFlags uint8
+
+const (
+	// DeltaFlagTrailingHash means the expected hash of the new file follows BinaryEndOfDeltaCommand,
+	// rather than being part of the metadata
+	DeltaFlagTrailingHash DeltaFlags = 1 << iota
+	// DeltaFlagBasisIdentity means the metadata has the length and hash of the basis file the delta was built against
+	DeltaFlagBasisIdentity
+	// DeltaFlagCompressedData means the delta may contain BinaryCompressedDataCommand
+	DeltaFlagCompressedData
+	// DeltaFlagVarintCommands means the lengths in commands are unsigned varints rather than int64s, and copy offsets
+	// are signed varints relative to the end of the previous copy
+	DeltaFlagVarintCommands
+	// DeltaFlagCommandChecksums means every command is followed by the CRC-32 of its bytes, and BinaryEndOfDeltaCommand
+	// is followed by the number of commands and the length of the new file, and the CRC-32 of those. Data and
+	// compressed data commands have a CRC-32 of their header before the data, and another of the data after it
+	DeltaFlagCommandChecksums
+)
+
+const knownDeltaFlags = DeltaFlagTrailingHash | DeltaFlagBasisIdentity | DeltaFlagCompressedData | DeltaFlagVarintCommands | DeltaFlagCommandChecksums
+
+// BinaryFileSignatureHeader starts a detached Ed25519 signature of a signature or delta file.
+// It is followed by a version byte, then the 64 byte signature
+var BinaryFileSignatureHeader = []byte("OCTOEDSIG")
+
+// BinaryEncryptedHeader starts a file encrypted by NewEncryptingWriter. It is followed by a version byte, the segment
+// size as a little-endian uint32, and a 32 byte salt, then the encrypted segments
+var BinaryEncryptedHeader = []byte("OCTOCRYPT")
+
+// BinarySignatureIndexHeader starts an index built by SignatureIndexBuilder. It is followed by a version byte, the
+// hash and rolling checksum names, the basis length as an int64 and the basis hash, the hash of the signature file,
+// then BinaryEndOfMetadata
+var BinarySignatureIndexHeader = []byte("OCTOSIGIDX")
@@ -0,0 +1,205 @@
+package octodiff
+
+import (
+	"errors"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// ContentDefinedChunking holds the parameters of the FastCDC chunker, which ends a chunk where a gear hash of the
+// last few bytes has enough zero bits, rather than every ChunkSize bytes. The boundaries depend only on the nearby
+// content, so inserting or removing bytes only moves the boundaries next to the change, and the chunks of two
+// versions of a file line up wherever the content is the same.
+//
+// Chunks are at least MinChunkSize and at most MaxChunkSize bytes long. Boundaries are harder to find before
+// AverageChunkSize and easier after it ("normalized chunking"), which keeps most chunks near the average.
+type ContentDefinedChunking struct {
+	MinChunkSize     int
+	AverageChunkSize int
+	MaxChunkSize     int
+}
+
+// NewContentDefinedChunking returns the parameters SignatureBuilder uses for an average chunk size, with the
+// minimum a quarter of it and the maximum four times it
+func NewContentDefinedChunking(averageChunkSize int) *ContentDefinedChunking {
+	maxChunkSize := averageChunkSize * 4
+	if maxChunkSize > math.MaxUint16 {
+		maxChunkSize = math.MaxUint16
+	}
+	return &ContentDefinedChunking{
+		MinChunkSize:     averageChunkSize / 4,
+		AverageChunkSize: averageChunkSize,
+		MaxChunkSize:     maxChunkSize,
+	}
+}
+
+// validate checks the parameters, with chunks of up to maximumChunkSize allowed
+func (c *ContentDefinedChunking) validate(maximumChunkSize int) error {
+	if c.MinChunkSize < 1 {
+		return errors.New("content defined chunking MinChunkSize must be at least 1")
+	}
+	if c.AverageChunkSize < c.MinChunkSize || c.AverageChunkSize > c.MaxChunkSize {
+		return errors.New("content defined chunking AverageChunkSize must be between MinChunkSize and MaxChunkSize")
+	}
+	if c.MaxChunkSize > maximumChunkSize {
+		return errors.New("content defined chunking MaxChunkSize is greater than maximum allowed")
+	}
+	return nil
+}
+
+// nextChunkLength returns the length of the chunk at the start of data. Unless data runs to the end of the input,
+// it must hold at least MaxChunkSize bytes.
+func (c *ContentDefinedChunking) nextChunkLength(data []byte) int {
+	n := len(data)
+	if n <= c.MinChunkSize {
+		return n
+	}
+	if n > c.MaxChunkSize {
+		n = c.MaxChunkSize
+	}
+	normal := c.AverageChunkSize
+	if normal > n {
+		normal = n
+	}
+
+	// the hash shifts left a bit per byte, so the top bits depend on the most bytes
+	averageBits := bits.Len(uint(c.AverageChunkSize)) - 1
+	smallMask := highBitsMask(averageBits + 1)
+	largeMask := highBitsMask(averageBits - 1)
+
+	hash := uint64(0)
+	i := c.MinChunkSize
+	for ; i < normal; i++ {
+		hash = hash<<1 + gearTable[data[i]]
+		if hash&smallMask == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = hash<<1 + gearTable[data[i]]
+		if hash&largeMask == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+func highBitsMask(count int) uint64 {
+	if count <= 0 {
+		return 0
+	}
+	return ^uint64(0) << (64 - count)
+}
+
+// gearTable has a random 64-bit value for each byte. It is part of the signature format, as changing it would move
+// the chunk boundaries, so it is generated from a fixed seed rather than the math/rand generator, which may change.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x6f63746f64696666) // "octodiff"
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// ----------------------------------------------------------------------------
+
+// chunker cuts input into chunks, either every chunkSize bytes, or where content defined chunking finds a boundary
+type chunker struct {
+	chunkSize      int
+	contentDefined *ContentDefinedChunking
+}
+
+func (c chunker) maxChunkLength() int {
+	if c.contentDefined != nil {
+		return c.contentDefined.MaxChunkSize
+	}
+	return c.chunkSize
+}
+
+// nextChunkLength returns the length of the chunk at the start of data. Unless data runs to the end of the input,
+// it must hold at least maxChunkLength bytes.
+func (c chunker) nextChunkLength(data []byte) int {
+	if c.contentDefined != nil {
+		return c.contentDefined.nextChunkLength(data)
+	}
+	if len(data) < c.chunkSize {
+		return len(data)
+	}
+	return c.chunkSize
+}
+
+// ----------------------------------------------------------------------------
+
+// buildContentDefined writes the commands of a delta against a signature built with content defined chunking. The
+// chunk boundaries depend only on the content, so rather than sliding a window along the new file, we cut it into
+// chunks with the same parameters and look each one up by its hash. If newFileHash is not nil, the new file is
+// written to it as it is read.
+func (d *DeltaBuilder) buildContentDefined(newFile io.ReadSeeker, newFileLength int64, signature *Signature, deltaWriter DeltaWriter, newFileHash io.Writer) error {
+	// where the same chunk appears more than once in the basis, copy the first one
+	chunksByHash := make(map[string]*ChunkSignature, len(signature.Chunks))
+	for _, chunk := range signature.Chunks {
+		if _, ok := chunksByHash[string(chunk.Hash)]; !ok {
+			chunksByHash[string(chunk.Hash)] = chunk
+		}
+	}
+
+	chunker := chunker{contentDefined: signature.ContentDefinedChunking}
+	maxChunkLength := chunker.maxChunkLength()
+	buffer := make([]byte, defaultReadBufferSize+maxChunkLength)
+	buffered := 0
+	bufferStart := int64(0) // the offset in the new file of buffer[0]
+	lastMatchEnd := int64(0)
+	d.ProgressReporter.ReportProgress("Building delta", 0, newFileLength)
+
+	for atEnd := false; !atEnd; {
+		n, err := io.ReadFull(newFile, buffer[buffered:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			atEnd = true
+		} else if err != nil {
+			return err
+		}
+		if newFileHash != nil {
+			_, _ = newFileHash.Write(buffer[buffered : buffered+n]) // hash.Hash never returns an error
+		}
+		buffered += n
+
+		// cut the chunks we have all of; the rest waits for the next read
+		offset := 0
+		for offset < buffered && (atEnd || buffered-offset >= maxChunkLength) {
+			length := chunker.nextChunkLength(buffer[offset:buffered])
+			hash := signature.HashAlgorithm.HashOverData(buffer[offset : offset+length])
+			chunk, ok := chunksByHash[string(hash)]
+			if ok && chunk.ChunkLength() == length {
+				position := bufferStart + int64(offset)
+				if position > lastMatchEnd {
+					err = deltaWriter.WriteDataCommand(newFile, lastMatchEnd, position-lastMatchEnd)
+					if err != nil {
+						return err
+					}
+				}
+				err = deltaWriter.WriteCopyCommand(chunk.StartOffset, int64(length))
+				if err != nil {
+					return err
+				}
+				lastMatchEnd = position + int64(length)
+			}
+			offset += length
+		}
+
+		buffered = copy(buffer, buffer[offset:buffered])
+		bufferStart += int64(offset)
+		d.ProgressReporter.ReportProgress("Building delta", bufferStart, newFileLength)
+	}
+
+	if newFileLength != lastMatchEnd {
+		return deltaWriter.WriteDataCommand(newFile, lastMatchEnd, newFileLength-lastMatchEnd)
+	}
+	return nil
+}
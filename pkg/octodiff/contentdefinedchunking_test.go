@@ -0,0 +1,143 @@
+package octodiff_test
+
+import (
+	"bytes"
+	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+// randomTestData doesn't repeat, unlike test.GenerateTestData, so content defined chunks are all different
+func randomTestData(length int) []byte {
+	data := make([]byte, length)
+	rand.New(rand.NewSource(7)).Read(data)
+	return data
+}
+
+func buildContentDefinedSignature(input []byte) []byte {
+	b := octodiff.NewSignatureBuilder()
+	b.ContentDefinedChunking = octodiff.NewContentDefinedChunking(2048)
+	return buildSignatureBuilder(b, input)
+}
+
+func TestContentDefinedSignatureRecordsItsParameters(t *testing.T) {
+	input := randomTestData(1024 * 1024)
+	signature, err := readSignature(buildContentDefinedSignature(input))
+	assert.Nil(t, err)
+
+	assert.Equal(t, &octodiff.ContentDefinedChunking{MinChunkSize: 512, AverageChunkSize: 2048, MaxChunkSize: 8192}, signature.ContentDefinedChunking)
+
+	covered := int64(0)
+	for i, chunk := range signature.Chunks {
+		assert.Equal(t, covered, chunk.StartOffset)
+		assert.LessOrEqual(t, int(chunk.Length), 8192)
+		if i < len(signature.Chunks)-1 {
+			assert.GreaterOrEqual(t, int(chunk.Length), 512)
+		}
+		covered += int64(chunk.Length)
+	}
+	assert.Equal(t, int64(len(input)), covered)
+
+	// the lengths should vary, and average out somewhere near the target
+	average := len(input) / len(signature.Chunks)
+	assert.Greater(t, average, 1024)
+	assert.Less(t, average, 4096)
+}
+
+func TestContentDefinedChunksLineUpAfterAnInsertion(t *testing.T) {
+	basis := randomTestData(256 * 1024)
+	newFile := append(append(append([]byte(nil), basis[:1000]...), []byte("inserted bytes")...), basis[1000:]...)
+
+	basisSignature, err := readSignature(buildContentDefinedSignature(basis))
+	assert.Nil(t, err)
+	newSignature, err := readSignature(buildContentDefinedSignature(newFile))
+	assert.Nil(t, err)
+
+	basisChunks := map[string]bool{}
+	for _, chunk := range basisSignature.Chunks {
+		basisChunks[string(chunk.Hash)] = true
+	}
+
+	// only the chunk with the insertion in it, and perhaps the one after, should be different
+	different := 0
+	for _, chunk := range newSignature.Chunks {
+		if !basisChunks[string(chunk.Hash)] {
+			different++
+		}
+	}
+	assert.LessOrEqual(t, different, 2)
+}
+
+func TestBuildsAndAppliesDeltaWithContentDefinedSignature(t *testing.T) {
+	basis := randomTestData(5 * 1024 * 1024) // more than one read buffer
+	newFile := append(append([]byte("a new header"), basis[:3*1024*1024]...), basis[3*1024*1024+100:]...)
+
+	for _, trailingHash := range []bool{false, true} {
+		var delta bytes.Buffer
+		writer := octodiff.NewBinaryDeltaWriter(&delta)
+		writer.TrailingHash = trailingHash
+		signatureFile := buildContentDefinedSignature(basis)
+		err := octodiff.NewDeltaBuilder().Build(bytes.NewReader(newFile), int64(len(newFile)), bytes.NewReader(signatureFile), int64(len(signatureFile)), writer)
+		assert.Nil(t, err)
+
+		// only the chunks around the two changes should need sending
+		assert.Less(t, delta.Len(), 4*8192)
+
+		var output bytes.Buffer
+		err = octodiff.ApplyDeltaAndVerify(bytes.NewReader(basis), octodiff.NewBinaryDeltaReader(bytes.NewReader(delta.Bytes())), &output)
+		assert.Nil(t, err)
+		assert.Equal(t, newFile, output.Bytes())
+	}
+}
+
+func TestContentDefinedSignatureIsTheSameHoweverItIsBuilt(t *testing.T) {
+	for _, length := range []int{0, 100, 8192, 1024*1024 + 5} {
+		input := randomTestData(length)
+		expected := buildContentDefinedSignature(input)
+
+		for _, concurrency := range []int{2, 3} {
+			b := octodiff.NewSignatureBuilder()
+			b.ContentDefinedChunking = octodiff.NewContentDefinedChunking(2048)
+			b.Concurrency = concurrency
+			assert.Equal(t, expected, buildSignatureBuilder(b, input), "length %d, concurrency %d", length, concurrency)
+		}
+
+		for _, writeSize := range []int{1, 1000, 10000} {
+			b := octodiff.NewSignatureBuilder()
+			b.ContentDefinedChunking = octodiff.NewContentDefinedChunking(2048)
+			var output bytes.Buffer
+			writer, err := b.NewWriter(&output)
+			assert.Nil(t, err)
+			for offset := 0; offset < len(input); offset += writeSize {
+				end := offset + writeSize
+				if end > len(input) {
+					end = len(input)
+				}
+				_, err = writer.Write(input[offset:end])
+				assert.Nil(t, err)
+			}
+			assert.Nil(t, writer.Close())
+			assert.Equal(t, expected, output.Bytes(), "length %d, write size %d", length, writeSize)
+		}
+	}
+}
+
+func TestContentDefinedSignatureIgnoresChunkSize(t *testing.T) {
+	input := randomTestData(100 * 1024)
+	expected := buildContentDefinedSignature(input)
+
+	for _, chunkSize := range []int{octodiff.SignatureAutoChunkSize, 128, octodiff.SignatureMaximumChunkSize} {
+		b := octodiff.NewSignatureBuilder()
+		b.ChunkSize = chunkSize
+		b.ContentDefinedChunking = octodiff.NewContentDefinedChunking(2048)
+		assert.Equal(t, expected, buildSignatureBuilder(b, input), "chunk size %d", chunkSize)
+	}
+}
+
+func TestContentDefinedChunkingRejectsBadParameters(t *testing.T) {
+	b := octodiff.NewSignatureBuilder()
+	b.ContentDefinedChunking = &octodiff.ContentDefinedChunking{MinChunkSize: 4096, AverageChunkSize: 2048, MaxChunkSize: 8192}
+	_, err := b.NewWriter(&bytes.Buffer{})
+	assert.EqualError(t, err, "content defined chunking AverageChunkSize must be between MinChunkSize and MaxChunkSize")
+}
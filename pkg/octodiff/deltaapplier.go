@@ -1,8 +1,9 @@
 package octodiff
 
 import (
+	"bufio"
 	"bytes"
-	"errors"
+	"fmt"
 	"io"
 )
 
@@ -34,11 +35,66 @@ func ApplyDelta(basisFile io.ReadSeeker, deltaReader DeltaReader, output io.Writ
 		})
 }
 
-func VerifyNewFile(newFile io.Reader, deltaReader DeltaReader) error {
-	sourceFileHash, err := deltaReader.ExpectedHash()
+// ApplyDeltaAndVerify builds the new file like ApplyDelta, but hashes the output as it is written and
+// checks it against the hash recorded in the delta. This saves reading the new file back in with VerifyNewFile.
+func ApplyDeltaAndVerify(basisFile io.ReadSeeker, deltaReader DeltaReader, output io.Writer) error {
+	algorithm, err := deltaReader.HashAlgorithm()
+	if err != nil {
+		return err
+	}
+	hash := algorithm.NewHash()
+
+	err = ApplyDelta(basisFile, deltaReader, io.MultiWriter(output, hash))
+	if err != nil {
+		return err
+	}
+	return verifyHash(deltaReader, hash.Sum(nil))
+}
+
+// VerifyBasisFile checks that basisFile is the file the delta was built against, so a patch using the wrong basis
+// can be refused before writing anything. Deltas which don't record their basis file are assumed to be fine.
+// basisFile is read in full to hash it, then left positioned at the start.
+func VerifyBasisFile(basisFile io.ReadSeeker, deltaReader DeltaReader) error {
+	basisIdentityReader, ok := deltaReader.(BasisIdentityDeltaReader)
+	if !ok {
+		return nil
+	}
+	expectedLength, expectedHash, err := basisIdentityReader.BasisIdentity()
+	if err != nil || expectedHash == nil {
+		return err
+	}
+	algorithm, err := deltaReader.HashAlgorithm()
+	if err != nil {
+		return err
+	}
+
+	actualLength, err := basisFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if actualLength != expectedLength {
+		return fmt.Errorf("the basis file is %d bytes, but the delta was built against a basis file of %d bytes", actualLength, expectedLength)
+	}
+
+	_, err = basisFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	actualHash, err := algorithm.HashOverReader(bufio.NewReaderSize(basisFile, defaultReadBufferSize))
+	if err != nil {
+		return err
+	}
+	_, err = basisFile.Seek(0, io.SeekStart)
 	if err != nil {
 		return err
 	}
+	if !bytes.Equal(actualHash, expectedHash) {
+		return fmt.Errorf("the %s hash of the basis file does not match the basis file the delta was built against", algorithm.Name())
+	}
+	return nil
+}
+
+func VerifyNewFile(newFile io.Reader, deltaReader DeltaReader) error {
 	algorithm, err := deltaReader.HashAlgorithm()
 	if err != nil {
 		return err
@@ -48,9 +104,21 @@ func VerifyNewFile(newFile io.Reader, deltaReader DeltaReader) error {
 	if err != nil {
 		return err
 	}
+	return verifyHash(deltaReader, actualHash)
+}
+
+func verifyHash(deltaReader DeltaReader, actualHash []byte) error {
+	sourceFileHash, err := deltaReader.ExpectedHash()
+	if err != nil {
+		return err
+	}
+	algorithm, err := deltaReader.HashAlgorithm()
+	if err != nil {
+		return err
+	}
 
 	if !bytes.Equal(sourceFileHash, actualHash) {
-		return errors.New("verification of the patched file failed. The SHA1 hash of the patch result file, and the file that was used as input for the delta, do not match. This can happen if the basis file changed since the signatures were calculated")
+		return fmt.Errorf("verification of the patched file failed. The %s hash of the patch result file, and the file that was used as input for the delta, do not match. This can happen if the basis file changed since the signatures were calculated", algorithm.Name())
 	}
 	return nil
 }
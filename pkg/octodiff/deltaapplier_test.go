@@ -0,0 +1,68 @@
+package octodiff_test
+
+import (
+	"bytes"
+	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
+	"github.com/OctopusDeploy/go-octodiff/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+func TestApplyDeltaAndVerify(t *testing.T) {
+	original := test.GenerateTestData(128 * 1024)
+	newFile := append([]byte(nil), original...)
+	newFile[32000] = 0xaa
+
+	deltaFile := buildDelta(newFile, buildSignature(original))
+
+	var patched bytes.Buffer
+	err := octodiff.ApplyDeltaAndVerify(bytes.NewReader(original), octodiff.NewBinaryDeltaReader(bytes.NewReader(deltaFile)), &patched)
+	assert.Nil(t, err)
+	assert.Equal(t, newFile, patched.Bytes())
+}
+
+func TestApplyDeltaAndVerify_FailsIfBasisChanged(t *testing.T) {
+	original := test.GenerateTestData(128 * 1024)
+	newFile := append([]byte(nil), original...)
+	newFile[32000] = 0xaa
+
+	deltaFile := buildDelta(newFile, buildSignature(original))
+
+	changedBasis := append([]byte(nil), original...)
+	changedBasis[100] = 0xff
+
+	var patched bytes.Buffer
+	err := octodiff.ApplyDeltaAndVerify(bytes.NewReader(changedBasis), octodiff.NewBinaryDeltaReader(bytes.NewReader(deltaFile)), &patched)
+	assert.EqualError(t, err, "verification of the patched file failed. The SHA1 hash of the patch result file, and the file that was used as input for the delta, do not match. This can happen if the basis file changed since the signatures were calculated")
+}
+
+func TestVerifyBasisFile(t *testing.T) {
+	original := test.GenerateTestData(128 * 1024)
+	newFile := append([]byte(nil), original...)
+	newFile[32000] = 0xaa
+
+	deltaFile := buildDelta(newFile, buildSignatureWithBasisIdentity(original))
+
+	basisFile := bytes.NewReader(original)
+	err := octodiff.VerifyBasisFile(basisFile, octodiff.NewBinaryDeltaReader(bytes.NewReader(deltaFile)))
+	assert.Nil(t, err)
+
+	position, _ := basisFile.Seek(0, io.SeekCurrent)
+	assert.Equal(t, int64(0), position)
+
+	err = octodiff.VerifyBasisFile(bytes.NewReader(original[1:]), octodiff.NewBinaryDeltaReader(bytes.NewReader(deltaFile)))
+	assert.EqualError(t, err, "the basis file is 131071 bytes, but the delta was built against a basis file of 131072 bytes")
+
+	err = octodiff.VerifyBasisFile(bytes.NewReader(newFile), octodiff.NewBinaryDeltaReader(bytes.NewReader(deltaFile)))
+	assert.EqualError(t, err, "the SHA1 hash of the basis file does not match the basis file the delta was built against")
+}
+
+func TestVerifyBasisFile_NoBasisIdentity(t *testing.T) {
+	original := test.GenerateTestData(128 * 1024)
+	deltaFile := buildDelta(original, buildSignature(original))
+
+	// a delta which doesn't record the basis can't be checked, so any basis is accepted
+	err := octodiff.VerifyBasisFile(bytes.NewReader(nil), octodiff.NewBinaryDeltaReader(bytes.NewReader(deltaFile)))
+	assert.Nil(t, err)
+}
@@ -2,13 +2,22 @@ package octodiff
 
 import (
 	"bytes"
+	"fmt"
 	"io"
-	"math"
-	"sort"
 )
 
 type DeltaBuilder struct {
 	ProgressReporter ProgressReporter
+
+	// Concurrency is how many goroutines scan the new file for chunks. With more than one, and a new file larger than
+	// SegmentSize which is also an io.ReaderAt, the new file is split into segments which are scanned in parallel,
+	// then stitched back together. The delta is the same as a serial scan builds, whatever the Concurrency.
+	// ReadAt is called concurrently with Read and Seek, which *os.File and bytes.Reader allow.
+	// Signatures built with content defined chunking are always matched serially, as the new file is cut into chunks
+	// the same way and each one is looked up by its hash, which is much less work than a rolling checksum scan.
+	Concurrency int
+	// SegmentSize is how much of the new file each goroutine scans at a time. Zero means DefaultDeltaSegmentSize.
+	SegmentSize int64
 }
 
 func NewDeltaBuilder() *DeltaBuilder {
@@ -20,6 +29,11 @@ func NewDeltaBuilder() *DeltaBuilder {
 // Build creates a new delta file, writing it out using `deltaWriter`
 // confusing naming: "newFile" isn't a new file that we are creating, but rather an existing file which is
 // "new" in that we haven't created a delta for it yet.
+// If `deltaWriter` is a TrailingHashDeltaWriter configured to write a trailing hash, newFile is hashed while it is
+// scanned, so the delta can be streamed out as it is built; otherwise it needs a separate pass to hash it before any
+// of the delta can be written.
+// newFile must be seekable either way, as the scan steps back to overlap its reads and the literal data for Data
+// commands is read back from it. A newFile which can't seek, like a pipe, is rejected before anything is written.
 func (d *DeltaBuilder) Build(newFile io.ReadSeeker, newFileLength int64, signatureFile io.Reader, signatureFileLength int64, deltaWriter DeltaWriter) error {
 	signatureReader := NewSignatureReader()
 	signatureReader.ProgressReporter = d.ProgressReporter
@@ -28,119 +42,183 @@ func (d *DeltaBuilder) Build(newFile io.ReadSeeker, newFileLength int64, signatu
 	if err != nil {
 		return err
 	}
+	return d.build(newFile, newFileLength, signature, func() *chunkLookup { return d.createChunkLookup(signature) }, deltaWriter)
+}
 
-	chunks := signature.Chunks
-	hash, err := signature.HashAlgorithm.HashOverReader(newFile)
+// BuildWithIndex creates a new delta file like Build, but finds the chunks of the signature in a SignatureIndex
+// rather than reading them all into memory. The index is read from while the new file is scanned.
+func (d *DeltaBuilder) BuildWithIndex(newFile io.ReadSeeker, newFileLength int64, index *SignatureIndex, deltaWriter DeltaWriter) error {
+	return d.build(newFile, newFileLength, index.signature(), index.chunkLookup, deltaWriter)
+}
+
+// build creates the delta once the signature's metadata has been read. createLookup is only called if the new file
+// has to be scanned for chunks.
+func (d *DeltaBuilder) build(newFile io.ReadSeeker, newFileLength int64, signature *Signature, createLookup func() *chunkLookup, deltaWriter DeltaWriter) error {
+	_, err := newFile.Seek(0, io.SeekCurrent)
 	if err != nil {
-		return err
+		return fmt.Errorf("the new file must be seekable to build a delta from it; %w", err)
 	}
-	_, err = newFile.Seek(0, io.SeekStart) // HashOverReader reads the entire newFile; we need to seek back to the start to process it
-	if err != nil {
-		return err
+	if basisIdentityWriter, ok := deltaWriter.(BasisIdentityDeltaWriter); ok && signature.BasisHash != nil {
+		basisIdentityWriter.SetBasisIdentity(signature.BasisLength, signature.BasisHash)
 	}
 
-	err = deltaWriter.WriteMetadata(signature.HashAlgorithm, hash)
-	if err != nil {
-		return err
+	// If the writer can put the hash of the new file at the end of the delta, we hash the new file as we scan it.
+	// Otherwise we need to read the whole thing up front so we can write the hash into the metadata
+	trailingHashWriter, writesTrailingHash := deltaWriter.(TrailingHashDeltaWriter)
+	writesTrailingHash = writesTrailingHash && trailingHashWriter.WritesTrailingHash()
+
+	newFileHash := signature.HashAlgorithm.NewHash()
+	hashedUpTo := int64(0)
+
+	if writesTrailingHash {
+		err = deltaWriter.WriteMetadata(signature.HashAlgorithm, nil)
+		if err != nil {
+			return err
+		}
+	} else {
+		hash, err := signature.HashAlgorithm.HashOverReader(newFile)
+		if err != nil {
+			return err
+		}
+		_, err = newFile.Seek(0, io.SeekStart) // HashOverReader reads the entire newFile; we need to seek back to the start to process it
+		if err != nil {
+			return err
+		}
+
+		err = deltaWriter.WriteMetadata(signature.HashAlgorithm, hash)
+		if err != nil {
+			return err
+		}
+
+		// if the new file is the same as the basis, we can skip looking for matches and just copy the whole thing
+		if signature.BasisHash != nil && newFileLength == signature.BasisLength && bytes.Equal(hash, signature.BasisHash) {
+			d.ProgressReporter.ReportProgress("Building delta", newFileLength, newFileLength)
+			if newFileLength > 0 {
+				err = deltaWriter.WriteCopyCommand(0, newFileLength)
+				if err != nil {
+					return err
+				}
+			}
+			return deltaWriter.Flush()
+		}
 	}
 
-	sort.Slice(chunks, func(i, j int) bool {
-		// aligns with C# ChunkSignatureChecksumComparer
-		x, y := chunks[i], chunks[j]
-		if x.RollingChecksum == y.RollingChecksum {
-			return x.StartOffset < y.StartOffset
+	if signature.ContentDefinedChunking != nil {
+		var hashOutput io.Writer
+		if writesTrailingHash {
+			hashOutput = newFileHash
 		}
-		return x.RollingChecksum < y.RollingChecksum
-	})
+		err = d.buildContentDefined(newFile, newFileLength, signature, deltaWriter, hashOutput)
+		if err != nil {
+			return err
+		}
+		err = deltaWriter.Flush()
+		if err != nil || !writesTrailingHash {
+			return err
+		}
+		return trailingHashWriter.WriteTrailingHash(newFileHash.Sum(nil))
+	}
 
-	chunkMap, minChunkSize, maxChunkSize := d.createChunkMap(chunks)
+	lookup := createLookup()
+
+	if newFileAt, ok := newFile.(io.ReaderAt); ok && d.Concurrency > 1 && newFileLength > d.segmentSize() {
+		scanner := &deltaScanner{
+			newFile:       newFileAt,
+			newFileLength: newFileLength,
+			lookup:        lookup,
+		}
+		var hashOutput io.Writer
+		if writesTrailingHash {
+			hashOutput = newFileHash
+		}
+		err = d.buildConcurrently(newFile, scanner, deltaWriter, hashOutput)
+		if err != nil {
+			return err
+		}
+		err = deltaWriter.Flush()
+		if err != nil || !writesTrailingHash {
+			return err
+		}
+		return trailingHashWriter.WriteTrailingHash(newFileHash.Sum(nil))
+	}
+
+	minChunkSize := lookup.minChunkLength()
+	maxChunkSize := lookup.maxChunkLength()
+	matcher := lookup.newMatcher()
 
 	lastMatchPosition := int64(0)
-	buffer := make([]byte, defaultReadBufferSize)
+	buffer := make([]byte, defaultReadBufferSize+maxChunkSize)
 	d.ProgressReporter.ReportProgress("Building delta", int64(0), newFileLength)
 
 	startPosition := int64(0)
 
 	for {
 		bytesRead, fileReadErr := newFile.Read(buffer)
-		if bytesRead > 0 { // we got some bytes, process them
-			checksumAlgorithm := signature.RollingChecksumAlgorithm
-			checksum := uint32(0)
-
-			remainingPossibleChunkSize := maxChunkSize
-
-			// slide a window over the buffer, looking for anything that matches our known list of chunks
-			for i := 0; i < (bytesRead - minChunkSize + 1); i++ {
-				readSoFar := startPosition + int64(i)
-
-				remainingBytes := bytesRead - i
-				if remainingBytes < maxChunkSize {
-					remainingPossibleChunkSize = minChunkSize
-				}
-
-				if i == 0 || remainingBytes < maxChunkSize { // we are either at the start or end of buffer; calculate a full checksum
-					checksum = checksumAlgorithm.Calculate(buffer[i : i+remainingPossibleChunkSize])
-				} else { // we are stepping through the buffer, just rotate the existing checksum
-					remove := buffer[i-1]
-					add := buffer[i+remainingPossibleChunkSize-1]
-					checksum = checksumAlgorithm.Rotate(checksum, remove, add, remainingPossibleChunkSize)
+		if writesTrailingHash && startPosition+int64(bytesRead) > hashedUpTo {
+			// we seek backwards between reads, so only hash the part of the buffer we haven't seen before
+			_, _ = newFileHash.Write(buffer[hashedUpTo-startPosition : bytesRead]) // hash.Hash never returns an error
+			hashedUpTo = startPosition + int64(bytesRead)
+		}
+		// If we didn't read a full buffer size, then assume we reached the end of newFile.
+		// Note that Go's reader interface doesn't promise that it will always give you N bytes, even if N
+		// bytes are available, in practice for file readers it does, and because we jump around seeking within
+		// newFile there's not a great way of otherwise determining EOF without rewriting this whole thing
+		atEnd := bytesRead < len(buffer) || fileReadErr == io.EOF
+
+		if bytesRead > 0 && maxChunkSize > 0 { // we got some bytes, process them
+			// slide a window of each chunk length over the buffer, looking for anything that matches our known list of
+			// chunks. Unless this is the end of the file, stop where the longest chunk no longer fits, and pick up from
+			// there in the next buffer
+			for i := 0; i+minChunkSize <= bytesRead; i++ {
+				if !atEnd && i+maxChunkSize > bytesRead {
+					break
 				}
+				readSoFar := startPosition + int64(i)
 
 				d.ProgressReporter.ReportProgress("Building delta", readSoFar, newFileLength)
 
-				if readSoFar-(lastMatchPosition-int64(remainingPossibleChunkSize)) < int64(remainingPossibleChunkSize) {
+				if readSoFar < lastMatchPosition {
 					continue
 				}
 
-				startIndex, ok := chunkMap[checksum]
-				if !ok {
+				chunk, err := matcher.match(buffer[:bytesRead], i, readSoFar)
+				if err != nil {
+					return err
+				}
+				if chunk == nil {
 					continue // we didn't match any known chunks. Skip, and the skipped data will be picked up later in a Data command based on lastMatchPosition
 				}
 
-				for j := startIndex; j < len(chunks) && chunks[j].RollingChecksum == checksum; j++ {
-					chunk := chunks[j]
-
-					sha := signature.HashAlgorithm.HashOverData(buffer[i : i+remainingPossibleChunkSize])
-
-					if bytes.Equal(sha, chunk.Hash) {
-						// we matched a chunk. Write any data in between it and the previous match as data, then write the 'copy' command for a chunk
-						readSoFar = readSoFar + int64(remainingPossibleChunkSize)
-
-						missing := readSoFar - lastMatchPosition
-						if missing > int64(remainingPossibleChunkSize) {
-							err = deltaWriter.WriteDataCommand(newFile, lastMatchPosition, missing-int64(remainingPossibleChunkSize))
-							if err != nil {
-								return err
-							}
-						}
-
-						err = deltaWriter.WriteCopyCommand(chunk.StartOffset, int64(chunk.Length))
-						if err != nil {
-							return err
-						}
-						lastMatchPosition = readSoFar
-						break
+				// we matched a chunk. Write any data in between it and the previous match as data, then write the 'copy' command for a chunk
+				if readSoFar > lastMatchPosition {
+					err = deltaWriter.WriteDataCommand(newFile, lastMatchPosition, readSoFar-lastMatchPosition)
+					if err != nil {
+						return err
 					}
 				}
+
+				err = deltaWriter.WriteCopyCommand(chunk.StartOffset, int64(chunk.ChunkLength()))
+				if err != nil {
+					return err
+				}
+				lastMatchPosition = readSoFar + int64(chunk.ChunkLength())
 			}
 		}
-		if fileReadErr != nil {
-			if fileReadErr == io.EOF { // all done
-				break
-			}
-			return fileReadErr // something else went wrong after processing bytes, fail!
+		if fileReadErr != nil && fileReadErr != io.EOF {
+			return fileReadErr // something went wrong after processing bytes, fail!
 		}
-		// If we didn't read a full buffer size, then assume we reached the end of newFile and exit the loop.
-		// Note that Go's reader interface doesn't promise that it will always give you N bytes, even if N
-		// bytes are available, in practice for file readers it does, and because we jump around seeking within
-		// newFile there's not a great way of otherwise determining EOF without rewriting this whole thing
-		if bytesRead < len(buffer) {
+		if atEnd {
 			break
 		}
 
-		// seek backwards by maxChunkSize+1, so we can read that stuff, and continue sliding the window over the file
-		// note we mutate startPosition, so it is ready for the next time round the loop
-		startPosition, err = newFile.Seek(-int64(maxChunkSize)+1, io.SeekCurrent)
+		// seek backwards by maxChunkSize-1, to the first position we didn't look at, and continue sliding the window
+		// over the file. Note we mutate startPosition, so it is ready for the next time round the loop
+		// (if the signature has no chunks, maxChunkSize is 0 and there's nothing to overlap)
+		overlap := int64(maxChunkSize) - 1
+		if overlap < 0 {
+			overlap = 0
+		}
+		startPosition, err = newFile.Seek(-overlap, io.SeekCurrent)
 		if err != nil {
 			return err
 		}
@@ -154,30 +232,12 @@ func (d *DeltaBuilder) Build(newFile io.ReadSeeker, newFileLength int64, signatu
 		}
 	}
 
-	return deltaWriter.Flush()
-}
-
-// returns chunkMap, minChunkSize, maxChunkSize
-func (d *DeltaBuilder) createChunkMap(chunks []*ChunkSignature) (map[uint32]int, int, int) {
-	d.ProgressReporter.ReportProgress("Creating chunk map", 0, int64(len(chunks)))
-
-	maxChunkSize := uint16(0)
-	minChunkSize := uint16(math.MaxUint16)
-
-	chunkMap := make(map[uint32]int)
-
-	for chunkIdx, chunk := range chunks {
-		if chunk.Length > maxChunkSize {
-			maxChunkSize = chunk.Length
-		}
-		if chunk.Length < minChunkSize {
-			minChunkSize = chunk.Length
-		}
-
-		if _, ok := chunkMap[chunk.RollingChecksum]; !ok {
-			chunkMap[chunk.RollingChecksum] = chunkIdx
-		}
-		d.ProgressReporter.ReportProgress("Creating chunk map", int64(chunkIdx), int64(len(chunks)))
+	err = deltaWriter.Flush()
+	if err != nil {
+		return err
+	}
+	if writesTrailingHash {
+		return trailingHashWriter.WriteTrailingHash(newFileHash.Sum(nil))
 	}
-	return chunkMap, int(minChunkSize), int(maxChunkSize)
+	return nil
 }
@@ -2,10 +2,14 @@ package octodiff_test
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
 	"github.com/OctopusDeploy/go-octodiff/pkg/test"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"math/rand"
 	"testing"
 )
 
@@ -131,3 +135,368 @@ func TestBuildsDeltaForSmallChangesInFileEvenWhenFileIsLarger_MultipleDisjointCh
 
 	assert.Equal(t, "4f43544f44454c544101045348413114000000645a41cab32226e8e9212c54db711c22653c00513e3e3e80280000000000000030820204308201aba003020102021418d83f07718be4121df0a18d7610faf8d7aaabac300a06082a600078000000000000007800000000000080b00c00000000000061746531173015060355040a0c0e4f63746f707573204465706c6f79310c300a060355040b0c03522644310d300b06035504030c0454455354301e170d3233303332303039343834325a170d3234303331393039343834325a3058310b30090603550406130241553113301106035504080c0a536f6d652d537461746531173015060355040a0c0e4f63746f707573204465706c6f79310c300a060355040b0c03522644310d300b06035504030c04544553543059301306072a8648ce3d020106082a8648ce3d03010703420004504b77248d83e2e3e209bbb2297a0e4d24ff45e79eff88dd165e6419ae98512dabd2219da46e93d7ff98d5a1cb80314a57f37d0931ecf7f3bd4bce212cfd2cbaa3533051301d0603551d0e04160414badd278a31e012776afbfda4ead8fdce904f0efc301f0603551d23041830168014badd278a31e012776afbfda4ead8fdce904f0efc300f0603551d130101ff040530030101ff300a06082a8648ce3d04030203470030440220599cef920115b64a7d0bc7de55a84bba7f05ee78b9e903af7cb52b4a5dcc8ea2022006575445dab9c21325a48de3bd7ce51a34612015a74648787c7a7e032645377030820204308201aba003020102021418d83f07718be4121df0a18d7610faf8d7a3bec4300a06082a8648ce3d0403023058310b30090603550406130241553113301106035504080c0a536f6d652d537461746531173015060355040a0c0e4f63746f707573204465706c6f79310c300a060355040b0c03522644310d300b06035504030c0454455354301e170d3233303332303039343834325a170d3234303331393039343834325a3058310b30090603550406130241553113301106035504080c0a536f6d652d537461746531173015060355040a0c0e4f63746f707573204465706c6f79310c300a060355040b0c03522644310d300b06035504030c04544553543059301306072a8648ce3d020106082a8648ce3d03010703420004504b77248d83e2e3e209bbb2297a0e4d24ff45e79eff88dd165e6419ae98512dabd2219da46e93d7ff98d5a1cb80314a57f37d0931ecf7f3bd4bce212cfd2cbaa3533051301d0603551d0e04160414badd278a31e012776afbfda4ead8fdce904f0efc301f0603551d23041830168014badd278a31e012776afbfda4ead8fdce904f0efc300f0603551d130101ff040530030101ff300a06082a8648ce3d04030203470030440220599cef920115b64a7d0bc7de55a84bba7f05ee78b9e903af7cb52b4a5dcc8ea2022006575445dab9c21325a48de3bd7ce51a34612015a74648787c7a7e032645377030820204308201aba003020102021418d83f07718be4121df0a18d7610faf8d7a3bec4300a06082a8648ce3d0403023058310b30090603550406130241553113301106035504080c0a536f6d652d537461746531173015060355040a0c0e4f63746f707573204465706c6f79310c300a060355040b0c03522644310d300b06035504030c0454455354301e170d3233303332303039343834325a170d3234303331393039343834325a3058310b30090603550406130241553113301106035504080c0a536f6d652d537461746531173015060355040a0c0e4f63746f707573204465706c6f79310c300a060355040b0c03522644310d300b06035504030c04544553543059301306072a8648ce3d020106082a8648ce3d03aa0703420004504b77248d83e2e3e209bbb2297a0e4d24ff45e79eff88dd165e6419ae98512dabd2219da46e93d7ff98d5a1cb80314a57f37d0931ecf7f3bd4bce212cfd2cbaa3533051301d0603551d0e04160414badd278a31e012776afbfda4ead8fdce904f0efc301f0603551d23041830168014badd278a31e012776afbfda4ead8fdce904f0efc300f0603551d130101ff040530030101ff300a06082a8648ce3d04030203470030440220599cef920115b64a7d0bc7de55a84bba7f05ee78b9e903af7cb52b4a5dcc8ea2022006575445dab9c21325a48de3bd7ce51a34612015a74648787c7a7e032645377030820204308201aba003020102021418d83f07718be4121df0a18d7610faf8d7a3bec4300a06082a8648ce3d0403023058310b30090603550406130241553113301106035504080c0a536f6d652d537461746531173015060355040a0c0e4f63746f707573204465706c6f79310c300a060355040b0c03522644310d300b06035504030c0454455354301e170d3233303332303039343834325a170d3234303331393039343834325a3058310b30090603550406130241553113301106035504080c0a536f6d652d537461746531173015060355040a0c0e4f63746f707573204465706c6f79310c300a060355040b0c03522644310d300b06035504030c04544553543059301306072a8648ce3d020106082a8648ce3d03010703420004504b77248d83e2e3e209bbb2297a0e4d24ff45e79eff88dd165e6419ae98512dabd2219da46e93d7ff98d5a1cb80314a57f37d0931ecf7f3bd4bce212cfd2cbaa3533051301d0603551d0e04160414badd278a31e012776afbfda4ead8fdce904f0efc301f0603551d23041830168014badd278a31e012776afbfda4ead8fdce904f0efc300f0603551d130101ff040530030101ff300a06082a8648ce3d04030203470030440220599cef920115b64a7d0bc7de55a84bba7f05ee78b9e903af7cb52b4a5dcc8ea2022006575445dab9c21325a48de3bd7ce51a34612015a74648787c7a7e032645377030820204308201aba003020102021418d83f07718be4121df0a18d7610faf8d7a3bec4300a06082a8648ce3d0403023058310b30090603550406130241553113301106035504080c0a536f6d652d537461746531173015060355040a0c0e4f63746f707573204465706c6f79310c300a060355040b0c03522644310d300b06035504030c0454455354301e170d3233303332303039343834325a170d3234303331393039343834325a3058310b30090603550406130241553113301106035504080c0a536f6d652d537461746531173015060355040a0c0e4f63746f707573204465706c6f79310c300a060355040b0cab522644310d300b06035504030c04544553543059301306072a8648ce3d020106082a8648ce3d03010703420004504b77248d83e2e3e209bbb2297a0e4d24ff45e79eff88dd165e6419ae98512dabd2219da46e93d7ff98d5a1cb80314a57f37d0931ecf7f3bd4bce212cfd2cbaa3533051301d0603551d0e04160414badd278a31e012776afbfda4ead8fdce904f0efc301f0603551d23041830168014badd278a31e012776afbfda4ead8fdce904f0efc300f0603551d130101ff040530030101ff300a06082a8648ce3d04030203470030440220599cef920115b64a7d0bc7de55a84bba7f05ee78b9e903af7cb52b4a5dcc8ea2022006575445dab9c21325a48de3bd7ce51a34612015a74648787c7a7e032645377030820204308201aba003020102021418d83f07718be4121df0a18d7610faf8d7a3bec4300a06082a8648ce3d0403023058310b30090603550406130241553113301106035504080c0a536f6d652d537461746531173015060355040a0c0e4f63746f707573204465706c6f79310c300a060355040b0c03522644310d300b06035504030c0454455354301e170d3233303332303039343834325a170d3234303331393039343834325a3058310b30090603550406130241553113301106035504080c0a536f6d652d537461746531173015060355040a0c0e4f63746f707573204465706c6f79310c300a060355040b0c03522644310d300b06035504030c04544553543059301306072a8648ce3d020106082a8648ce3d03010703420004504b77248d83e2e3e209bbb2297a0e4d24ff45e79eff88dd165e6419ae98512dabd2219da46e93d7ff98d5a1cb80314a57f37d0931ecf7f3bd4bce212cfd2cbaa3533051301d0603551d0e04160414badd278a31e012776afbfda4ead8fdce904f0efc301f0603551d23041830168014badd278a31e012776afbfda4ead8fdce904f0efc300f0603551d130101ff040530030101ff300a06082a8648ce3d04030203470030440220599cef920115b64a7d0bc7de55a84bba7f05ee78b9e903af7cb52b4a5dcc8ea2022006575445dab9c21325a48de3bd7ce51a34612015a74648787c7a7e032645377030820204308201aba003020102021418d83f07718be4121df0a18d7610faf8d7a3bec4300a06082a8648ce3d0403023058310b30090603550406130241553113301106035504080c0a536f6d652d537461746531173015060355040a0c0e4f63746f707573204465706c6f79310c300a060355040b0c03522644310d300b06035504030c0454455354301e170d3233303332303039343834325a170d3234303331393039343834325a3058310b30090603550406130241553113301106035504080c0a536f6d652dac746174653117306000d00000000000000030010000000000800800000000000000a3bec4300a06082a600078000000000000004800000000000080200300000000000006082a8648ce3d03010703420004504b77248d83e2e3e209bbb2297a0e4d24ff45e79eff88dd165e6419ae98512dabd2219da46e93d7ff98d5a1cb80314a57f37d0931ecf7f3bd4bce212cfd2cbaa3533051301d0603551d0e04160414badd278a31e012776afbfda4ead8fdce904f0efc301f0603551d23041830168014badd278a31e012776afbfda4ead8fdce904f0efc300f0603551d130101ff040530030101ff300a06082a8648ce3d04030203470030440220599cef920115b64a7d0bc7de55a84bba7f05ee78b9e903af7cb52b4a5dcc8ea2022006575445dab9c21325a48de3bd7ce51a34612015a74648787c7a7e032645377030820204308201aba003020102021418d83f07718be4121df0a18d7610faf8d7a3bec4300a06082a8648ce3d0403023058310b30090603550406130241553113301106035504080c0a536f6d652d537461746531173015060355040a0c0e4f63746f707573204465706c6f79310c300a060355040b0c03522644310d300b06035504030c0454455354301e170d3233303332303039343834325a170d3234303331393039343834325a3058310b30090603550406130241553113301106035504080c0a536f6d652d537461746531173015060355040a0c0e4f63746f707573204465706c6f79310c300a060355040b0c03522644310d300b06035504030c04544553543059301306072a8648ce3d020106082a8648ce3d03010703420004504b77248d83e2e3e209bbb2297a0e4d24ff45e79eff88dd165e6419ae98512dabd2219da46e93d7ff98d5a1cb80314a57f37d0931ecf7f3bd4bce212cfd2cbaa3533051301d0603551d0e04160414badd278a31e012776afbfda4ead8fdce904f0efc301f0603551d23041830168014badd278a31e012776afbfda4ead8fdce904f0efc300f0603551d130101ff040530030101ff300a06082a8648ce3d04030203470030440220599cef920115b64a7d0bc7de55a84bba7f05ee78b9e903af7cb52b4a5dcc8ea2022006575445dab9c21325a48de3bd7ce51a34612015a74648787c7a7e032645377030820204308201aba003020102021418d83f07718be4121df0a18d7610faf8d7", hex.EncodeToString(deltaFile))
 }
+
+func TestBuildsAndAppliesDeltaWithSha256(t *testing.T) {
+	original := test.GenerateTestData(128 * 1024)
+
+	var signature bytes.Buffer
+	builder := octodiff.NewSignatureBuilder()
+	builder.HashAlgorithm = &octodiff.Sha256HashAlgorithm{}
+	err := builder.Build(bytes.NewReader(original), int64(len(original)), &signature)
+	assert.Nil(t, err)
+
+	newFile := append([]byte(nil), original...)
+	newFile[32000] = 0xaa
+
+	deltaFile := buildDelta(newFile, signature.Bytes())
+
+	reader := octodiff.NewBinaryDeltaReader(bytes.NewReader(deltaFile))
+	algorithm, err := reader.HashAlgorithm()
+	assert.Nil(t, err)
+	assert.Equal(t, "SHA256", algorithm.Name())
+
+	var patched bytes.Buffer
+	err = octodiff.ApplyDelta(bytes.NewReader(original), reader, &patched)
+	assert.Nil(t, err)
+	assert.Equal(t, newFile, patched.Bytes())
+
+	assert.Nil(t, octodiff.VerifyNewFile(bytes.NewReader(patched.Bytes()), reader))
+	assert.NotNil(t, octodiff.VerifyNewFile(bytes.NewReader(original), reader))
+}
+
+func TestBuildsDeltaWithTrailingHash(t *testing.T) {
+	original := test.GenerateTestData(128 * 1024)
+	signature := buildSignature(original)
+
+	newFile := append([]byte(nil), original...)
+	newFile[32] = 0xaa
+	newFile[32000] = 0xab
+
+	var output bytes.Buffer
+	writer := octodiff.NewBinaryDeltaWriter(&output)
+	writer.TrailingHash = true
+	err := octodiff.NewDeltaBuilder().Build(bytes.NewReader(newFile), int64(len(newFile)), bytes.NewReader(signature), int64(len(signature)), writer)
+	assert.Nil(t, err)
+
+	// same commands as the version 1 format, just the hash moves to the end
+	deltaFile := output.Bytes()
+	assert.Equal(t, logDeltaFile(buildDelta(newFile, signature)), logDeltaFile(deltaFile))
+	assert.Equal(t, "ff14000000"+hex.EncodeToString((&octodiff.Sha1HashAlgorithm{}).HashOverData(newFile)), hex.EncodeToString(deltaFile[len(deltaFile)-25:]))
+
+	var patched bytes.Buffer
+	err = octodiff.ApplyDeltaAndVerify(bytes.NewReader(original), octodiff.NewBinaryDeltaReader(bytes.NewReader(deltaFile)), &patched)
+	assert.Nil(t, err)
+	assert.Equal(t, newFile, patched.Bytes())
+}
+
+func TestBuildsDeltaWithTrailingHashOverMultipleBuffers(t *testing.T) {
+	// larger than the builder's 4MB read buffer, so the hash has to skip the overlap between reads
+	original := test.GenerateTestData(9 * 1024 * 1024)
+	signature := buildSignature(original)
+
+	newFile := append([]byte(nil), original...)
+	newFile[5*1024*1024] = 0xaa
+
+	var output bytes.Buffer
+	writer := octodiff.NewBinaryDeltaWriter(&output)
+	writer.TrailingHash = true
+	err := octodiff.NewDeltaBuilder().Build(bytes.NewReader(newFile), int64(len(newFile)), bytes.NewReader(signature), int64(len(signature)), writer)
+	assert.Nil(t, err)
+
+	reader := octodiff.NewBinaryDeltaReader(bytes.NewReader(output.Bytes()))
+	err = octodiff.ApplyDeltaAndVerify(bytes.NewReader(original), reader, io.Discard)
+	assert.Nil(t, err)
+}
+
+func buildSignatureWithBasisIdentity(input []byte) []byte {
+	var output bytes.Buffer
+	builder := octodiff.NewSignatureBuilder()
+	builder.RecordBasisIdentity = true
+	err := builder.Build(bytes.NewReader(input), int64(len(input)), &output)
+	if err != nil {
+		panic(err) // should never fail under tests
+	}
+	return output.Bytes()
+}
+
+func TestBuildsDeltaWithBasisIdentity(t *testing.T) {
+	original := test.GenerateTestData(128 * 1024)
+	signature := buildSignatureWithBasisIdentity(original)
+
+	newFile := append([]byte(nil), original...)
+	newFile[32000] = 0xaa
+
+	deltaFile := buildDelta(newFile, signature)
+
+	reader := octodiff.NewBinaryDeltaReader(bytes.NewReader(deltaFile))
+	basisLength, basisHash, err := reader.BasisIdentity()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(original)), basisLength)
+	assert.Equal(t, (&octodiff.Sha1HashAlgorithm{}).HashOverData(original), basisHash)
+
+	// the commands are the same as a delta built from a version 1 signature
+	assert.Equal(t, logDeltaFile(buildDelta(newFile, buildSignature(original))), logDeltaFile(deltaFile))
+}
+
+func TestBuildsSingleCopyDeltaWhenNewFileMatchesBasisIdentity(t *testing.T) {
+	original := test.GenerateTestData(128 * 1024)
+	signature := buildSignatureWithBasisIdentity(original)
+
+	deltaFile := buildDelta(original, signature)
+
+	assert.Equal(t, []string{
+		"copy start=0, length=131072",
+	}, logDeltaFile(deltaFile))
+}
+
+func TestBuildsCompressedDelta(t *testing.T) {
+	original := test.GenerateTestData(128 * 1024)
+	signature := buildSignature(original)
+
+	// append lots of new, but compressible, data
+	newFile := append(append([]byte(nil), original...), bytes.Repeat([]byte("octodiff "), 30000)...)
+
+	var output bytes.Buffer
+	writer := octodiff.NewBinaryDeltaWriter(&output)
+	writer.CompressData = true
+	err := octodiff.NewDeltaBuilder().Build(bytes.NewReader(newFile), int64(len(newFile)), bytes.NewReader(signature), int64(len(signature)), writer)
+	assert.Nil(t, err)
+
+	uncompressed := buildDelta(newFile, signature)
+	assert.Less(t, output.Len(), len(uncompressed)/10)
+
+	var patched bytes.Buffer
+	err = octodiff.ApplyDeltaAndVerify(bytes.NewReader(original), octodiff.NewBinaryDeltaReader(bytes.NewReader(output.Bytes())), &patched)
+	assert.Nil(t, err)
+	assert.Equal(t, newFile, patched.Bytes())
+}
+
+func buildDeltaConcurrently(newFile []byte, signatureFile []byte, concurrency int, segmentSize int64, writer *octodiff.BinaryDeltaWriter) error {
+	d := octodiff.NewDeltaBuilder()
+	d.Concurrency = concurrency
+	d.SegmentSize = segmentSize
+	return d.Build(bytes.NewReader(newFile), int64(len(newFile)), bytes.NewReader(signatureFile), int64(len(signatureFile)), writer)
+}
+
+func TestConcurrentDeltaMatchesSerialDelta(t *testing.T) {
+	basis, newFile := buildPatchedFileTestData()
+	signature := buildSignature(basis)
+	expected := buildDelta(newFile, signature)
+
+	// segments which don't line up with chunks, so that matches run across the seams
+	for _, segmentSize := range []int64{5000, 10007, 64 * 1024} {
+		for _, concurrency := range []int{2, 3, 8} {
+			var output bytes.Buffer
+			err := buildDeltaConcurrently(newFile, signature, concurrency, segmentSize, octodiff.NewBinaryDeltaWriter(&output))
+			assert.Nil(t, err)
+			assert.Equal(t, expected, output.Bytes(), "segment size %d, concurrency %d", segmentSize, concurrency)
+		}
+	}
+}
+
+func TestConcurrentDeltaWithTrailingHash(t *testing.T) {
+	basis, newFile := buildPatchedFileTestData()
+
+	var output bytes.Buffer
+	writer := octodiff.NewBinaryDeltaWriter(&output)
+	writer.TrailingHash = true
+	err := buildDeltaConcurrently(newFile, buildSignature(basis), 4, 10007, writer)
+	assert.Nil(t, err)
+
+	var patched bytes.Buffer
+	err = octodiff.ApplyDeltaAndVerify(bytes.NewReader(basis), octodiff.NewBinaryDeltaReader(bytes.NewReader(output.Bytes())), &patched)
+	assert.Nil(t, err)
+	assert.Equal(t, newFile, patched.Bytes())
+}
+
+// unseekableReader is like a pipe, which is an io.ReadSeeker but can't seek
+type unseekableReader struct {
+	io.Reader
+}
+
+func (_ *unseekableReader) Seek(_ int64, _ int) (int64, error) {
+	return 0, errors.New("illegal seek")
+}
+
+func TestRejectsNewFileWhichCantSeek(t *testing.T) {
+	basis, newFile := buildPatchedFileTestData()
+	signature := buildSignature(basis)
+
+	// even with a trailing hash, the new file is read back from for Data commands
+	var output bytes.Buffer
+	writer := octodiff.NewBinaryDeltaWriter(&output)
+	writer.TrailingHash = true
+	err := octodiff.NewDeltaBuilder().Build(&unseekableReader{bytes.NewReader(newFile)}, int64(len(newFile)), bytes.NewReader(signature), int64(len(signature)), writer)
+	assert.EqualError(t, err, "the new file must be seekable to build a delta from it; illegal seek")
+	assert.Equal(t, 0, output.Len())
+}
+
+// buildMixedLengthSignature builds a signature by hand, cutting the basis into chunks of the given lengths, as
+// SignatureBuilder only cuts fixed size chunks with a shorter one at the end
+func buildMixedLengthSignature(basis []byte, lengths ...int) []byte {
+	output := bytes.NewBuffer(buildSignature(nil)) // just the metadata
+	offset := 0
+	for _, length := range lengths {
+		chunk := basis[offset : offset+length]
+		_ = binary.Write(output, binary.LittleEndian, uint16(length))
+		_ = binary.Write(output, binary.LittleEndian, octodiff.DefaultChecksumAlgorithm.Calculate(chunk))
+		output.Write(octodiff.DefaultHashAlgorithm.HashOverData(chunk))
+		offset += length
+	}
+	return output.Bytes()
+}
+
+// buildMixedLengthTestData returns a random basis, a signature of it with chunks of a few different lengths, and a
+// new file of shuffled pieces of the basis with new data between them
+func buildMixedLengthTestData(seed int64, newFileLength int) ([]byte, []byte, []byte) {
+	r := rand.New(rand.NewSource(seed))
+	basis := make([]byte, 64*1024)
+	r.Read(basis)
+	var lengths []int
+	for covered := 0; covered < len(basis); {
+		length := []int{700, 1200, 2048, 3000}[r.Intn(4)]
+		if covered+length > len(basis) {
+			length = len(basis) - covered
+		}
+		lengths = append(lengths, length)
+		covered += length
+	}
+	signature := buildMixedLengthSignature(basis, lengths...)
+
+	var newFile []byte
+	for len(newFile) < newFileLength {
+		start := r.Intn(len(basis) - 5000)
+		newFile = append(newFile, basis[start:start+r.Intn(5000)]...)
+		newFile = append(newFile, byte(r.Intn(256)))
+	}
+	return basis, signature, newFile
+}
+
+func deltaCommands(t *testing.T, delta []byte) []octodiff.IndexedDeltaCommand {
+	index, err := octodiff.NewDeltaIndex(bytes.NewReader(delta), int64(len(delta)))
+	assert.Nil(t, err)
+	return index.Commands
+}
+
+func TestBuildsDeltaMatchingEveryChunkLength(t *testing.T) {
+	basis := make([]byte, 4500)
+	rand.New(rand.NewSource(8)).Read(basis)
+	signature := buildMixedLengthSignature(basis, 3000, 1000, 500)
+
+	// the 1000 byte chunk is neither the longest nor the shortest, so was never looked for before
+	var newFile []byte
+	newFile = append(newFile, []byte("some new data")...)
+	newFile = append(newFile, basis[3000:4000]...)
+	newFile = append(newFile, []byte("more new data")...)
+	newFile = append(newFile, basis[4000:4500]...)
+	newFile = append(newFile, basis[:3000]...)
+	newFile = append(newFile, basis[3000:4000]...)
+
+	delta := buildDelta(newFile, signature)
+	assert.Equal(t, []octodiff.IndexedDeltaCommand{
+		{Kind: octodiff.DeltaCommandData, NewFileOffset: 0, Length: 13, SourceOffset: 51},
+		{Kind: octodiff.DeltaCommandCopy, NewFileOffset: 13, Length: 1000, SourceOffset: 3000},
+		{Kind: octodiff.DeltaCommandData, NewFileOffset: 1013, Length: 13, SourceOffset: 90},
+		{Kind: octodiff.DeltaCommandCopy, NewFileOffset: 1026, Length: 500, SourceOffset: 4000},
+		{Kind: octodiff.DeltaCommandCopy, NewFileOffset: 1526, Length: 4000, SourceOffset: 0}, // the writer joins the last two copies up
+	}, deltaCommands(t, delta))
+
+	var patched bytes.Buffer
+	err := octodiff.ApplyDeltaAndVerify(bytes.NewReader(basis), octodiff.NewBinaryDeltaReader(bytes.NewReader(delta)), &patched)
+	assert.Nil(t, err)
+	assert.Equal(t, newFile, patched.Bytes())
+}
+
+func TestBuildsDeltaPreferringTheLongestChunk(t *testing.T) {
+	basis := make([]byte, 3000)
+	rand.New(rand.NewSource(9)).Read(basis)
+	basis = append(basis, basis[:1000]...) // the second chunk is the start of the first
+
+	// if the 1000 byte chunk was tried first, it would be copied from 3000 at the start
+	delta := buildDelta(basis, buildMixedLengthSignature(basis, 3000, 1000))
+	assert.Equal(t, []octodiff.IndexedDeltaCommand{
+		{Kind: octodiff.DeltaCommandCopy, NewFileOffset: 0, Length: 4000, SourceOffset: 0},
+	}, deltaCommands(t, delta))
+}
+
+func TestConcurrentDeltaMatchesSerialDeltaWithMixedChunkLengths(t *testing.T) {
+	// a new file which runs over more than one read buffer
+	basis, signature, newFile := buildMixedLengthTestData(10, 5*1024*1024)
+	expected := buildDelta(newFile, signature)
+
+	for _, segmentSize := range []int64{100007, 1024 * 1024} {
+		var output bytes.Buffer
+		err := buildDeltaConcurrently(newFile, signature, 3, segmentSize, octodiff.NewBinaryDeltaWriter(&output))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, output.Bytes(), "segment size %d", segmentSize)
+	}
+
+	var patched bytes.Buffer
+	err := octodiff.ApplyDeltaAndVerify(bytes.NewReader(basis), octodiff.NewBinaryDeltaReader(bytes.NewReader(expected)), &patched)
+	assert.Nil(t, err)
+	assert.Equal(t, newFile, patched.Bytes())
+}
+
+func TestBuildsAndAppliesDeltaWithLargeChunks(t *testing.T) {
+	basis := make([]byte, 6*1024*1024)
+	rand.New(rand.NewSource(11)).Read(basis)
+	newFile := append(append([]byte("a new header"), basis[:2*1024*1024]...), basis[2*1024*1024+100:]...)
+
+	b := octodiff.NewSignatureBuilder()
+	b.ChunkSize = 512 * 1024
+	b.LargeChunks = true
+	signature := buildSignatureBuilder(b, basis)
+
+	delta := buildDelta(newFile, signature)
+	commands := deltaCommands(t, delta)
+	copied := int64(0)
+	for _, command := range commands {
+		if command.Kind == octodiff.DeltaCommandCopy {
+			copied += command.Length
+		}
+	}
+	assert.Equal(t, int64(11*512*1024), copied) // all but the chunk with bytes taken out of it
+
+	var output bytes.Buffer
+	err := buildDeltaConcurrently(newFile, signature, 3, 1024*1024, octodiff.NewBinaryDeltaWriter(&output))
+	assert.Nil(t, err)
+	assert.Equal(t, delta, output.Bytes())
+
+	var patched bytes.Buffer
+	err = octodiff.ApplyDeltaAndVerify(bytes.NewReader(basis), octodiff.NewBinaryDeltaReader(bytes.NewReader(delta)), &patched)
+	assert.Nil(t, err)
+	assert.Equal(t, newFile, patched.Bytes())
+}
+
+func BenchmarkBuildDeltaWithMixedChunkLengths(b *testing.B) {
+	// the basis isn't a whole number of chunks, so even a fixed size signature has two chunk lengths, and a new
+	// file which is mostly new data has its checksums rotated at every position for both
+	r := rand.New(rand.NewSource(13))
+	basis := make([]byte, 4*1024*1024+1000)
+	r.Read(basis)
+	newFile := make([]byte, len(basis))
+	r.Read(newFile)
+	copy(newFile[len(newFile)/2:], basis[len(basis)/2:])
+
+	for _, checksum := range []octodiff.RollingChecksum{
+		octodiff.NewAdler32RollingChecksum(),
+		octodiff.NewBuzhashRollingChecksum(),
+		octodiff.NewRabinKarpRollingChecksum(),
+	} {
+		builder := octodiff.NewSignatureBuilder()
+		builder.RollingChecksumAlgorithm = checksum
+		signature := buildSignatureBuilder(builder, basis)
+
+		b.Run(checksum.Name(), func(b *testing.B) {
+			b.SetBytes(int64(len(newFile)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				d := octodiff.NewDeltaBuilder()
+				err := d.Build(bytes.NewReader(newFile), int64(len(newFile)), bytes.NewReader(signature), int64(len(signature)), octodiff.NewBinaryDeltaWriter(io.Discard))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package octodiff
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// ComposeDeltas writes a single delta which does the same as applying the first delta, then the second.
+// The second delta must have been built against the output of the first. Its copy commands are rewritten into copies
+// from the first delta's basis file, or literal data from the first delta, so no intermediate file is written.
+// The expected hash comes from the second delta, and the basis identity, if any, from the first.
+//
+// Both deltas must be in the binary format.
+func ComposeDeltas(first io.ReaderAt, firstLength int64, second io.ReaderAt, secondLength int64, output DeltaWriter) error {
+	firstIndex, err := NewDeltaIndex(first, firstLength)
+	if err != nil {
+		return err
+	}
+	secondIndex, err := NewDeltaIndex(second, secondLength)
+	if err != nil {
+		return err
+	}
+	if secondIndex.BasisHash != nil {
+		// the expected hash of the first delta identifies its output, if it uses the same hash algorithm
+		if secondIndex.BasisLength != firstIndex.NewFileLength ||
+			(secondIndex.HashAlgorithm.Name() == firstIndex.HashAlgorithm.Name() && !bytes.Equal(secondIndex.BasisHash, firstIndex.ExpectedHash)) {
+			return errors.New("the second delta was not built against the output of the first delta")
+		}
+	}
+
+	// we only read the literal data from these, so never need the first delta's basis file
+	intermediateFile := NewPatchedFileFromIndex(unavailableBasisFile{}, first, firstIndex)
+	newFile := NewPatchedFileFromIndex(intermediateFile, second, secondIndex)
+
+	if basisIdentityWriter, ok := output.(BasisIdentityDeltaWriter); ok && firstIndex.BasisHash != nil {
+		basisIdentityWriter.SetBasisIdentity(firstIndex.BasisLength, firstIndex.BasisHash)
+	}
+	trailingHashWriter, ok := output.(TrailingHashDeltaWriter)
+	writesTrailingHash := ok && trailingHashWriter.WritesTrailingHash()
+	if writesTrailingHash {
+		err = output.WriteMetadata(secondIndex.HashAlgorithm, nil)
+	} else {
+		err = output.WriteMetadata(secondIndex.HashAlgorithm, secondIndex.ExpectedHash)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, command := range secondIndex.Commands {
+		if command.Kind == DeltaCommandCopy {
+			err = composeCopyCommand(firstIndex, intermediateFile, command.SourceOffset, command.Length, output)
+		} else {
+			err = output.WriteDataCommand(newFile, command.NewFileOffset, command.Length)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err = output.Flush()
+	if err != nil || !writesTrailingHash {
+		return err
+	}
+	return trailingHashWriter.WriteTrailingHash(secondIndex.ExpectedHash)
+}
+
+// composeCopyCommand writes the commands from the first delta which produce the range of its output that a
+// copy command in the second delta reads
+func composeCopyCommand(firstIndex *DeltaIndex, intermediateFile *PatchedFile, offset int64, length int64, output DeltaWriter) error {
+	if offset+length > firstIndex.NewFileLength {
+		return errors.New("the second delta copies past the end of the output of the first delta")
+	}
+
+	for i := firstIndex.Find(offset); length > 0; i++ {
+		command := firstIndex.Commands[i]
+		offsetInCommand := offset - command.NewFileOffset
+		n := command.Length - offsetInCommand
+		if n > length {
+			n = length
+		}
+
+		var err error
+		if command.Kind == DeltaCommandCopy {
+			err = output.WriteCopyCommand(command.SourceOffset+offsetInCommand, n)
+		} else {
+			err = output.WriteDataCommand(intermediateFile, offset, n)
+		}
+		if err != nil {
+			return err
+		}
+		offset += n
+		length -= n
+	}
+	return nil
+}
+
+// unavailableBasisFile stands in for a basis file we don't have
+type unavailableBasisFile struct{}
+
+func (unavailableBasisFile) ReadAt([]byte, int64) (int, error) {
+	return 0, errors.New("the basis file is not available")
+}
@@ -0,0 +1,105 @@
+package octodiff_test
+
+import (
+	"bytes"
+	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
+	"github.com/OctopusDeploy/go-octodiff/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+// buildDeltaChainTestData returns three versions of a file, each built from pieces of the previous one and new data
+func buildDeltaChainTestData() ([]byte, []byte, []byte) {
+	r := rand.New(rand.NewSource(3))
+	random := func(length int) []byte {
+		data := make([]byte, length)
+		r.Read(data)
+		return data
+	}
+
+	a := append(test.GenerateTestData(100*1024), random(100*1024)...)
+
+	b := append([]byte(nil), a[150*1024:]...)
+	b = append(b, random(10000)...)
+	b = append(b, a[:120*1024]...)
+
+	c := append([]byte(nil), b[:20*1024]...)
+	c = append(c, random(3000)...)
+	c = append(c, b[40*1024:]...)
+	c[len(c)-5000] ^= 0xff
+	return a, b, c
+}
+
+func composeDeltas(first []byte, second []byte, output octodiff.DeltaWriter) error {
+	return octodiff.ComposeDeltas(bytes.NewReader(first), int64(len(first)), bytes.NewReader(second), int64(len(second)), output)
+}
+
+func TestComposesDeltas(t *testing.T) {
+	a, b, c := buildDeltaChainTestData()
+	aToB := buildDelta(b, buildSignatureWithBasisIdentity(a))
+
+	for _, compress := range []bool{false, true} {
+		var bToC bytes.Buffer
+		writer := octodiff.NewBinaryDeltaWriter(&bToC)
+		writer.CompressData = compress
+		buildDeltaWithWriter(c, buildSignatureWithBasisIdentity(b), writer, &bToC)
+
+		var aToC bytes.Buffer
+		err := composeDeltas(aToB, bToC.Bytes(), octodiff.NewBinaryDeltaWriter(&aToC))
+		assert.Nil(t, err)
+
+		reader := octodiff.NewBinaryDeltaReader(bytes.NewReader(aToC.Bytes()))
+		basisLength, basisHash, err := reader.BasisIdentity()
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(a)), basisLength)
+		assert.Equal(t, (&octodiff.Sha1HashAlgorithm{}).HashOverData(a), basisHash)
+
+		var output bytes.Buffer
+		err = octodiff.ApplyDeltaAndVerify(bytes.NewReader(a), reader, &output)
+		assert.Nil(t, err)
+		assert.Equal(t, c, output.Bytes())
+	}
+}
+
+func TestComposedDeltaCopiesFromOriginalBasis(t *testing.T) {
+	a := make([]byte, 64*1024)
+	rand.New(rand.NewSource(4)).Read(a)
+
+	// b swaps the halves of a, and c swaps them back, so c is a again
+	b := append(append([]byte(nil), a[32*1024:]...), a[:32*1024]...)
+	b = append(b, []byte("new at the end of b")...)
+	c := append(append([]byte(nil), b[32*1024:64*1024]...), b[:32*1024]...)
+
+	var aToC bytes.Buffer
+	err := composeDeltas(buildDelta(b, buildSignature(a)), buildDelta(c, buildSignature(b)), octodiff.NewBinaryDeltaWriter(&aToC))
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{
+		"copy start=0, length=65536",
+	}, logDeltaFile(aToC.Bytes()))
+}
+
+func TestComposesDeltasWithTrailingHash(t *testing.T) {
+	a, b, c := buildDeltaChainTestData()
+
+	var aToC bytes.Buffer
+	writer := octodiff.NewBinaryDeltaWriter(&aToC)
+	writer.TrailingHash = true
+	err := composeDeltas(buildDelta(b, buildSignature(a)), buildDelta(c, buildSignature(b)), writer)
+	assert.Nil(t, err)
+
+	var output bytes.Buffer
+	err = octodiff.ApplyDeltaAndVerify(bytes.NewReader(a), octodiff.NewBinaryDeltaReader(bytes.NewReader(aToC.Bytes())), &output)
+	assert.Nil(t, err)
+	assert.Equal(t, c, output.Bytes())
+}
+
+func TestRefusesToComposeUnrelatedDeltas(t *testing.T) {
+	a, b, c := buildDeltaChainTestData()
+
+	// the second delta is built against a, not b
+	var aToC bytes.Buffer
+	err := composeDeltas(buildDelta(b, buildSignature(a)), buildDelta(c, buildSignatureWithBasisIdentity(a)), octodiff.NewBinaryDeltaWriter(&aToC))
+	assert.EqualError(t, err, "the second delta was not built against the output of the first delta")
+}
@@ -0,0 +1,143 @@
+package octodiff
+
+import (
+	"bufio"
+	"io"
+	"sort"
+)
+
+// DeltaCommandKind is the type of command that an IndexedDeltaCommand came from
+type DeltaCommandKind int
+
+const (
+	DeltaCommandCopy DeltaCommandKind = iota
+	DeltaCommandData
+	DeltaCommandCompressedData
+)
+
+// IndexedDeltaCommand is a command from a binary delta, along with where its output goes in the new file
+type IndexedDeltaCommand struct {
+	Kind          DeltaCommandKind
+	NewFileOffset int64
+	Length        int64
+
+	// SourceOffset is the offset in the basis file for copy commands, or the offset in the delta file of the
+	// literal or compressed data for data commands
+	SourceOffset     int64
+	CompressedLength int64
+}
+
+// DeltaIndex maps offsets in the new file to the commands in a binary delta which produce them, so that
+// ranges of the new file can be read without applying the whole delta
+type DeltaIndex struct {
+	HashAlgorithm HashAlgorithm
+	ExpectedHash  []byte
+	NewFileLength int64
+
+	// BasisLength and BasisHash identify the basis file, if the delta records it
+	BasisLength int64
+	BasisHash   []byte
+
+	// Commands are in new file order, and don't include commands with no output
+	Commands []IndexedDeltaCommand
+}
+
+// NewDeltaIndex reads through a binary delta, recording where each command is. Literal data isn't kept in memory,
+// so the delta is needed again to read it.
+func NewDeltaIndex(delta io.ReaderAt, deltaLength int64) (*DeltaIndex, error) {
+	counter := &countingReader{reader: bufio.NewReader(io.NewSectionReader(delta, 0, deltaLength))}
+	reader := NewBinaryDeltaReader(counter)
+
+	indexer := &indexingCommandHandler{counter: counter, index: &DeltaIndex{}}
+	err := reader.readCommands(indexer)
+	if err != nil {
+		return nil, err
+	}
+
+	index := indexer.index
+	index.HashAlgorithm, err = reader.HashAlgorithm()
+	if err != nil {
+		return nil, err
+	}
+	index.ExpectedHash, err = reader.ExpectedHash()
+	if err != nil {
+		return nil, err
+	}
+	index.BasisLength, index.BasisHash, err = reader.BasisIdentity()
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// Find returns the position in Commands of the command which produces the byte at newFileOffset, or -1 if
+// the offset is outside the new file
+func (d *DeltaIndex) Find(newFileOffset int64) int {
+	if newFileOffset < 0 || newFileOffset >= d.NewFileLength {
+		return -1
+	}
+	return sort.Search(len(d.Commands), func(i int) bool {
+		command := d.Commands[i]
+		return command.NewFileOffset+command.Length > newFileOffset
+	})
+}
+
+// ----------------------------------------------------------------------------
+
+type indexingCommandHandler struct {
+	counter *countingReader
+	index   *DeltaIndex
+}
+
+func (x *indexingCommandHandler) add(command IndexedDeltaCommand) {
+	if command.Length == 0 {
+		return
+	}
+	command.NewFileOffset = x.index.NewFileLength
+	x.index.Commands = append(x.index.Commands, command)
+	x.index.NewFileLength += command.Length
+}
+
+func (x *indexingCommandHandler) copyCommand(start int64, length int64) error {
+	if start < 0 || length < 0 {
+		return corruptDeltaReason("the delta file appears to be corrupt; a copy command has a negative offset or length")
+	}
+	x.add(IndexedDeltaCommand{Kind: DeltaCommandCopy, SourceOffset: start, Length: length})
+	return nil
+}
+
+func (x *indexingCommandHandler) dataCommand(input io.Reader, length int64) error {
+	if length < 0 {
+		return corruptDeltaReason("the delta file appears to be corrupt; a data command has a negative length")
+	}
+	x.add(IndexedDeltaCommand{Kind: DeltaCommandData, SourceOffset: x.counter.count, Length: length})
+	return skipBytes(input, length)
+}
+
+func (x *indexingCommandHandler) compressedDataCommand(input io.Reader, length int64, compressedLength int64) error {
+	if length < 0 || compressedLength < 0 {
+		return corruptDeltaReason("the delta file appears to be corrupt; a compressed data command has a negative length")
+	}
+	x.add(IndexedDeltaCommand{Kind: DeltaCommandCompressedData, SourceOffset: x.counter.count, Length: length, CompressedLength: compressedLength})
+	return skipBytes(input, compressedLength)
+}
+
+func skipBytes(input io.Reader, length int64) error {
+	skipped, err := io.CopyN(io.Discard, input, length)
+	if err == io.EOF || (err == nil && skipped != length) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// countingReader keeps track of how far through the input we are
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count += int64(n)
+	return n, err
+}
@@ -0,0 +1,58 @@
+package octodiff_test
+
+import (
+	"bytes"
+	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
+	"github.com/OctopusDeploy/go-octodiff/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestIndexesDeltaCommands(t *testing.T) {
+	var output bytes.Buffer
+	w := octodiff.NewBinaryDeltaWriter(&output)
+	_ = w.WriteMetadata(&octodiff.Sha1HashAlgorithm{}, test.GenerateTestData(20))
+	_ = w.WriteCopyCommand(1000, 520)
+	_ = w.WriteDataCommand(bytes.NewReader(test.GenerateTestData(100)), 0, 30)
+	_ = w.WriteCopyCommand(0, 100)
+	_ = w.Flush()
+	delta := output.Bytes()
+
+	index, err := octodiff.NewDeltaIndex(bytes.NewReader(delta), int64(len(delta)))
+	assert.Nil(t, err)
+	assert.Equal(t, "SHA1", index.HashAlgorithm.Name())
+	assert.Equal(t, test.GenerateTestData(20), index.ExpectedHash)
+	assert.Equal(t, int64(650), index.NewFileLength)
+
+	// the data command's literal bytes start after the metadata, the copy command, and the data command header
+	dataOffset := int64(len(delta) - 17 - 30)
+	assert.Equal(t, []octodiff.IndexedDeltaCommand{
+		{Kind: octodiff.DeltaCommandCopy, NewFileOffset: 0, Length: 520, SourceOffset: 1000},
+		{Kind: octodiff.DeltaCommandData, NewFileOffset: 520, Length: 30, SourceOffset: dataOffset},
+		{Kind: octodiff.DeltaCommandCopy, NewFileOffset: 550, Length: 100, SourceOffset: 0},
+	}, index.Commands)
+	assert.Equal(t, test.GenerateTestData(30), delta[dataOffset:dataOffset+30])
+
+	assert.Equal(t, 0, index.Find(0))
+	assert.Equal(t, 0, index.Find(519))
+	assert.Equal(t, 1, index.Find(520))
+	assert.Equal(t, 2, index.Find(649))
+	assert.Equal(t, -1, index.Find(650))
+	assert.Equal(t, -1, index.Find(-1))
+}
+
+func TestIndexWaitsForTrailingHash(t *testing.T) {
+	var output bytes.Buffer
+	w := octodiff.NewBinaryDeltaWriter(&output)
+	w.TrailingHash = true
+	_ = w.WriteMetadata(&octodiff.Sha1HashAlgorithm{}, nil)
+	_ = w.WriteCopyCommand(0, 520)
+	_ = w.Flush()
+	_ = w.WriteTrailingHash(test.GenerateTestData(20))
+	delta := output.Bytes()
+
+	index, err := octodiff.NewDeltaIndex(bytes.NewReader(delta), int64(len(delta)))
+	assert.Nil(t, err)
+	assert.Equal(t, test.GenerateTestData(20), index.ExpectedHash)
+	assert.Equal(t, int64(520), index.NewFileLength)
+}
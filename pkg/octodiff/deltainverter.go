@@ -0,0 +1,98 @@
+package octodiff
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sort"
+)
+
+// InvertDelta writes a delta which rebuilds the basis file from the output of the given delta, so that an update
+// can be rolled back without keeping a signature of the old file. Regions of the basis file which the delta copies
+// become copies from its output, and only the regions it didn't copy are written as literal data.
+//
+// The inverted delta uses the same hash algorithm as the delta. If the delta records its basis file, the inverted
+// delta records the output of the delta as its basis file; otherwise it doesn't, so that a version 1 delta inverts
+// to a version 1 delta. The delta must be in the binary format.
+func InvertDelta(basis io.ReaderAt, basisLength int64, delta io.ReaderAt, deltaLength int64, output DeltaWriter) error {
+	index, err := NewDeltaIndex(delta, deltaLength)
+	if err != nil {
+		return err
+	}
+	if index.BasisHash != nil && index.BasisLength != basisLength {
+		return errors.New("the basis file is not the one the delta was built against")
+	}
+
+	basisFile := io.NewSectionReader(basis, 0, basisLength)
+	basisHash, err := index.HashAlgorithm.HashOverReader(basisFile)
+	if err != nil {
+		return err
+	}
+	if index.BasisHash != nil && !bytes.Equal(index.BasisHash, basisHash) {
+		return errors.New("the basis file is not the one the delta was built against")
+	}
+
+	// the copy commands, in basis file order
+	var copies []IndexedDeltaCommand
+	for _, command := range index.Commands {
+		if command.Kind != DeltaCommandCopy {
+			continue
+		}
+		if command.SourceOffset+command.Length > basisLength {
+			return errors.New("the delta copies past the end of the basis file")
+		}
+		copies = append(copies, command)
+	}
+	sort.SliceStable(copies, func(i, j int) bool {
+		return copies[i].SourceOffset < copies[j].SourceOffset
+	})
+
+	// the expected hash of the delta identifies its output
+	if basisIdentityWriter, ok := output.(BasisIdentityDeltaWriter); ok && index.BasisHash != nil {
+		basisIdentityWriter.SetBasisIdentity(index.NewFileLength, index.ExpectedHash)
+	}
+	trailingHashWriter, ok := output.(TrailingHashDeltaWriter)
+	writesTrailingHash := ok && trailingHashWriter.WritesTrailingHash()
+	if writesTrailingHash {
+		err = output.WriteMetadata(index.HashAlgorithm, nil)
+	} else {
+		err = output.WriteMetadata(index.HashAlgorithm, basisHash)
+	}
+	if err != nil {
+		return err
+	}
+
+	// walk through the basis file, at each point copying from whichever copy command reaches furthest ahead
+	var best IndexedDeltaCommand
+	next := 0
+	for position := int64(0); position < basisLength; {
+		for next < len(copies) && copies[next].SourceOffset <= position {
+			if copies[next].SourceOffset+copies[next].Length > best.SourceOffset+best.Length {
+				best = copies[next]
+			}
+			next++
+		}
+
+		if best.SourceOffset+best.Length > position {
+			end := best.SourceOffset + best.Length
+			err = output.WriteCopyCommand(best.NewFileOffset+position-best.SourceOffset, end-position)
+			position = end
+		} else {
+			end := basisLength
+			if next < len(copies) {
+				end = copies[next].SourceOffset
+			}
+			err = output.WriteDataCommand(basisFile, position, end-position)
+			position = end
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err = output.Flush()
+	if err != nil || !writesTrailingHash {
+		return err
+	}
+	return trailingHashWriter.WriteTrailingHash(basisHash)
+}
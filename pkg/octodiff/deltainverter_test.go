@@ -0,0 +1,104 @@
+package octodiff_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+func invertDelta(basis []byte, delta []byte, output octodiff.DeltaWriter) error {
+	return octodiff.InvertDelta(bytes.NewReader(basis), int64(len(basis)), bytes.NewReader(delta), int64(len(delta)), output)
+}
+
+func TestInvertsDelta(t *testing.T) {
+	a, b, _ := buildDeltaChainTestData()
+
+	for _, compress := range []bool{false, true} {
+		var aToB bytes.Buffer
+		writer := octodiff.NewBinaryDeltaWriter(&aToB)
+		writer.CompressData = compress
+		buildDeltaWithWriter(b, buildSignatureWithBasisIdentity(a), writer, &aToB)
+
+		var bToA bytes.Buffer
+		err := invertDelta(a, aToB.Bytes(), octodiff.NewBinaryDeltaWriter(&bToA))
+		assert.Nil(t, err)
+
+		reader := octodiff.NewBinaryDeltaReader(bytes.NewReader(bToA.Bytes()))
+		basisLength, basisHash, err := reader.BasisIdentity()
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(b)), basisLength)
+		assert.Equal(t, (&octodiff.Sha1HashAlgorithm{}).HashOverData(b), basisHash)
+
+		var output bytes.Buffer
+		err = octodiff.ApplyDeltaAndVerify(bytes.NewReader(b), reader, &output)
+		assert.Nil(t, err)
+		assert.Equal(t, a, output.Bytes())
+	}
+}
+
+func TestInvertedDeltaOnlyWritesDataTheDeltaDidNotCopy(t *testing.T) {
+	a := make([]byte, 64*1024)
+	rand.New(rand.NewSource(5)).Read(a)
+
+	// b swaps the halves of a, and drops the last chunk
+	b := append(append([]byte(nil), a[32*1024:62*1024]...), a[:32*1024]...)
+	b = append(b, []byte("new at the end of b")...)
+
+	var bToA bytes.Buffer
+	err := invertDelta(a, buildDelta(b, buildSignature(a)), octodiff.NewBinaryDeltaWriter(&bToA))
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{
+		"copy start=30720, length=32768",
+		"copy start=0, length=30720",
+		"write " + hex.EncodeToString(a[62*1024:]),
+	}, logDeltaFile(bToA.Bytes()))
+}
+
+func TestInvertsVersion1DeltaToVersion1(t *testing.T) {
+	a, b, _ := buildDeltaChainTestData()
+	aToB := buildDelta(b, buildSignature(a))
+	version1 := append(append([]byte(nil), octodiff.BinaryDeltaHeader...), octodiff.BinaryVersion...)
+	assert.True(t, bytes.HasPrefix(aToB, version1))
+
+	var bToA bytes.Buffer
+	err := invertDelta(a, aToB, octodiff.NewBinaryDeltaWriter(&bToA))
+	assert.Nil(t, err)
+	assert.True(t, bytes.HasPrefix(bToA.Bytes(), version1))
+
+	reader := octodiff.NewBinaryDeltaReader(bytes.NewReader(bToA.Bytes()))
+	_, basisHash, err := reader.BasisIdentity()
+	assert.Nil(t, err)
+	assert.Nil(t, basisHash)
+
+	var output bytes.Buffer
+	err = octodiff.ApplyDeltaAndVerify(bytes.NewReader(b), reader, &output)
+	assert.Nil(t, err)
+	assert.Equal(t, a, output.Bytes())
+}
+
+func TestInvertsDeltaWithTrailingHash(t *testing.T) {
+	a, b, _ := buildDeltaChainTestData()
+
+	var bToA bytes.Buffer
+	writer := octodiff.NewBinaryDeltaWriter(&bToA)
+	writer.TrailingHash = true
+	err := invertDelta(a, buildDelta(b, buildSignature(a)), writer)
+	assert.Nil(t, err)
+
+	var output bytes.Buffer
+	err = octodiff.ApplyDeltaAndVerify(bytes.NewReader(b), octodiff.NewBinaryDeltaReader(bytes.NewReader(bToA.Bytes())), &output)
+	assert.Nil(t, err)
+	assert.Equal(t, a, output.Bytes())
+}
+
+func TestRefusesToInvertDeltaWithWrongBasis(t *testing.T) {
+	a, b, c := buildDeltaChainTestData()
+
+	var bToA bytes.Buffer
+	err := invertDelta(c, buildDelta(b, buildSignatureWithBasisIdentity(a)), octodiff.NewBinaryDeltaWriter(&bToA))
+	assert.EqualError(t, err, "the basis file is not the one the delta was built against")
+}
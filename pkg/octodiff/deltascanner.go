@@ -0,0 +1,265 @@
+package octodiff
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"sync"
+)
+
+// DefaultDeltaSegmentSize is how much of the new file each goroutine scans at a time when DeltaBuilder.Concurrency
+// is more than one
+const DefaultDeltaSegmentSize = 16 * 1024 * 1024
+
+// deltaMatch is a chunk of the basis file found in the new file
+type deltaMatch struct {
+	position int64
+	chunk    *ChunkSignature
+}
+
+func (m deltaMatch) end() int64 {
+	return m.position + int64(m.chunk.ChunkLength())
+}
+
+// deltaScanner looks for the chunks of a signature in part of the new file. At each position it tries every chunk
+// length in the signature, longest first, and doesn't look at positions inside a chunk it has already found. This
+// is the same as the serial scan in DeltaBuilder.Build, so a scan split into segments finds the same chunks.
+type deltaScanner struct {
+	newFile       io.ReaderAt
+	newFileLength int64
+	lookup        *chunkLookup
+}
+
+// scan looks for chunks starting at positions from `from` up to `to`, skipping positions before lastMatchEnd.
+// If synced is not nil, it is called at each position the scan would look at, and the scan stops at the first
+// position it returns true for. The position the scan stopped at is returned, which is `to` unless synced stopped it.
+func (s *deltaScanner) scan(from int64, to int64, lastMatchEnd int64, synced func(int64) bool) ([]deltaMatch, int64, error) {
+	minChunkLength := s.lookup.minChunkLength()
+	maxChunkLength := s.lookup.maxChunkLength()
+	if maxChunkLength == 0 {
+		return nil, to, nil // no chunks to find
+	}
+
+	var matches []deltaMatch
+	buffer := make([]byte, defaultReadBufferSize+maxChunkLength)
+	matcher := s.lookup.newMatcher()
+
+	position := from
+	for position < to {
+		bufferStart := position
+		want := int64(len(buffer))
+		if remaining := s.newFileLength - bufferStart; remaining < want {
+			want = remaining
+		}
+		n, err := s.newFile.ReadAt(buffer[:want], bufferStart)
+		if int64(n) < want {
+			if err == nil || err == io.EOF {
+				err = errors.New("the new file got shorter while the delta was being built")
+			}
+			return nil, 0, err
+		}
+		atEnd := bufferStart+int64(n) == s.newFileLength
+
+		for ; position < to; position++ {
+			if position+int64(minChunkLength) > s.newFileLength {
+				return matches, to, nil // nothing fits any more
+			}
+			i := int(position - bufferStart)
+			if !atEnd && i+maxChunkLength > n {
+				break // read the next buffer from here, so the longest chunks fit
+			}
+			if position < lastMatchEnd {
+				continue
+			}
+			if synced != nil && synced(position) {
+				return matches, position, nil
+			}
+
+			chunk, err := matcher.match(buffer[:n], i, position)
+			if err != nil {
+				return nil, 0, err
+			}
+			if chunk != nil {
+				matches = append(matches, deltaMatch{position: position, chunk: chunk})
+				lastMatchEnd = position + int64(chunk.ChunkLength())
+			}
+		}
+	}
+	return matches, to, nil
+}
+
+// rescanSeam fixes up the matches in a segment when the last match before it runs past its start. The segment was
+// scanned as though nothing ran into it, so it may have found a chunk which overlaps the earlier match, and
+// missed ones which it stepped over as a result. We scan again from the end of the earlier match until the
+// rescan and the segment agree on where to look next, and from there on the segment's matches are right.
+func (s *deltaScanner) rescanSeam(segmentMatches []deltaMatch, from int64, to int64) ([]deltaMatch, error) {
+	next := 0
+	synced := func(position int64) bool {
+		for next < len(segmentMatches) && segmentMatches[next].end() <= position {
+			next++
+		}
+		// the segment scan looked at this position too, unless it was inside one of its matches
+		return next == len(segmentMatches) || segmentMatches[next].position >= position
+	}
+
+	matches, stoppedAt, err := s.scan(from, to, from, synced)
+	if err != nil {
+		return nil, err
+	}
+	if stoppedAt < to {
+		matches = append(matches, segmentMatches[next:]...)
+	}
+	return matches, nil
+}
+
+// ----------------------------------------------------------------------------
+
+type deltaSegment struct {
+	matches []deltaMatch
+	err     error
+	done    chan struct{}
+}
+
+func (d *DeltaBuilder) segmentSize() int64 {
+	if d.SegmentSize <= 0 {
+		return DefaultDeltaSegmentSize
+	}
+	return d.SegmentSize
+}
+
+// buildConcurrently splits the new file into segments of SegmentSize, scans Concurrency of them at a time, then
+// writes the matches out in order, rescanning at the seams where a match runs from one segment into the next.
+// The segments don't depend on Concurrency, so the delta is the same however many goroutines build it.
+func (d *DeltaBuilder) buildConcurrently(newFile io.ReadSeeker, scanner *deltaScanner, deltaWriter DeltaWriter, newFileHash io.Writer) error {
+	segmentSize := d.segmentSize()
+	newFileLength := scanner.newFileLength
+	segmentCount := int((newFileLength + segmentSize - 1) / segmentSize)
+
+	// if we're writing a trailing hash, hash the new file alongside the scan. If the build fails, stopHash abandons
+	// the hash, rather than waiting for the rest of what may be a very large file
+	hashDone := make(chan error, 1)
+	stopHash := make(chan struct{})
+	if newFileHash != nil {
+		go func() {
+			hashInput := &stoppableReader{reader: io.NewSectionReader(scanner.newFile, 0, newFileLength), stop: stopHash}
+			_, err := io.Copy(newFileHash, bufio.NewReaderSize(hashInput, defaultReadBufferSize))
+			hashDone <- err
+		}()
+	} else {
+		hashDone <- nil
+	}
+
+	segments := make([]*deltaSegment, segmentCount)
+	for k := range segments {
+		segments[k] = &deltaSegment{done: make(chan struct{})}
+	}
+
+	work := make(chan int)
+	ahead := make(chan struct{}, 2*d.Concurrency) // bounds how many segments' matches we hold
+	stop := make(chan struct{})
+	go func() {
+		defer close(work)
+		for k := range segments {
+			select {
+			case ahead <- struct{}{}:
+			case <-stop:
+				return
+			}
+			work <- k
+		}
+	}()
+	var workers sync.WaitGroup
+	for i := 0; i < d.Concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for k := range work {
+				start := int64(k) * segmentSize
+				end := start + segmentSize
+				if end > newFileLength {
+					end = newFileLength
+				}
+				segment := segments[k]
+				segment.matches, _, segment.err = scanner.scan(start, end, start, nil)
+				close(segment.done)
+			}
+		}()
+	}
+
+	err := d.writeSegments(newFile, scanner, segments, segmentSize, deltaWriter, ahead)
+	close(stop)
+	if err != nil {
+		close(stopHash)
+	}
+	workers.Wait() // so nothing is still reading the new file when we return
+	hashErr := <-hashDone
+	if err != nil {
+		return err
+	}
+	return hashErr
+}
+
+func (d *DeltaBuilder) writeSegments(newFile io.ReadSeeker, scanner *deltaScanner, segments []*deltaSegment, segmentSize int64, deltaWriter DeltaWriter, ahead chan struct{}) error {
+	newFileLength := scanner.newFileLength
+	lastMatchEnd := int64(0)
+	for k, segment := range segments {
+		<-segment.done
+		if segment.err != nil {
+			return segment.err
+		}
+
+		start := int64(k) * segmentSize
+		end := start + segmentSize
+		if end > newFileLength {
+			end = newFileLength
+		}
+		matches := segment.matches
+		if lastMatchEnd > start {
+			var err error
+			matches, err = scanner.rescanSeam(matches, lastMatchEnd, end)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, match := range matches {
+			if match.position > lastMatchEnd {
+				err := deltaWriter.WriteDataCommand(newFile, lastMatchEnd, match.position-lastMatchEnd)
+				if err != nil {
+					return err
+				}
+			}
+			err := deltaWriter.WriteCopyCommand(match.chunk.StartOffset, int64(match.chunk.ChunkLength()))
+			if err != nil {
+				return err
+			}
+			lastMatchEnd = match.end()
+		}
+
+		segment.matches = nil
+		<-ahead
+		d.ProgressReporter.ReportProgress("Building delta", end, newFileLength)
+	}
+
+	if newFileLength != lastMatchEnd {
+		return deltaWriter.WriteDataCommand(newFile, lastMatchEnd, newFileLength-lastMatchEnd)
+	}
+	return nil
+}
+
+var errDeltaBuildStopped = errors.New("the delta build was stopped")
+
+// stoppableReader fails once stop is closed, so a goroutine reading through a whole file can be abandoned between reads
+type stoppableReader struct {
+	reader io.Reader
+	stop   <-chan struct{}
+}
+
+func (r *stoppableReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.stop:
+		return 0, errDeltaBuildStopped
+	default:
+		return r.reader.Read(p)
+	}
+}
@@ -11,3 +11,24 @@ type DeltaWriter interface {
 	// Because of this, we need to tell the writer when it's done to flush any unwritten CopyCommand
 	Flush() error
 }
+
+// TrailingHashDeltaWriter is implemented by DeltaWriters which can record the expected hash of the new file
+// after the last command, rather than in the metadata. This lets DeltaBuilder build the delta in a single pass
+// over the new file, and the delta can be streamed out while it is being built.
+type TrailingHashDeltaWriter interface {
+	DeltaWriter
+
+	// WritesTrailingHash returns true if the writer is configured to write the hash after the commands.
+	// If it does, WriteMetadata is called with a nil hash, and WriteTrailingHash is called after the final Flush
+	WritesTrailingHash() bool
+	WriteTrailingHash(expectedNewFileHash []byte) error
+}
+
+// BasisIdentityDeltaWriter is implemented by DeltaWriters which can record the length and hash of the basis file
+// that the delta was built against, so that it can be checked before patching.
+type BasisIdentityDeltaWriter interface {
+	DeltaWriter
+
+	// SetBasisIdentity is called before WriteMetadata
+	SetBasisIdentity(basisLength int64, basisHash []byte)
+}
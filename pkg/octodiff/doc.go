@@ -0,0 +1,6 @@
+// Package octodiff builds signatures and deltas, and applies deltas, in the file formats of C# octodiff.
+//
+// Signatures and deltas are written in the version 1 formats, which C# octodiff can read, unless an option which
+// needs the version 2 formats is enabled; the options which do say so. C# octodiff can't read version 2 files, but
+// everything here reads both versions. BinarySignatureVersion2 and BinaryDeltaVersion2 describe what version 2 adds.
+package octodiff
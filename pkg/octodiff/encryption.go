@@ -0,0 +1,299 @@
+package octodiff
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+// Deltas can be encrypted with AES-256-GCM. The file is split into segments which are encrypted separately, so it can
+// be written and read as a stream, using the STREAM construction: each segment's nonce contains its position, and a
+// flag which is only set on the last segment, so segments can't be reordered, dropped, or truncated without detection.
+//
+// Each file has a random salt, and is encrypted with a key derived from the salt and the key file, so the same key
+// file can be used for any number of deltas without reusing nonces.
+
+// DefaultEncryptionSegmentSize is how much plaintext goes in each encrypted segment
+const DefaultEncryptionSegmentSize = 64 * 1024
+
+// EncryptionKeySize is the length of the keys used for encryption; they are AES-256 keys
+const EncryptionKeySize = 32
+
+const encryptionSaltSize = 32
+const maxEncryptionSegmentSize = 16 * 1024 * 1024
+
+var encryptionVersion = []byte{0x01}
+
+// ParseEncryptionKey reads a key file, which contains either the raw 32 byte key, or the key as 64 hex characters
+func ParseEncryptionKey(keyFile []byte) ([]byte, error) {
+	if len(keyFile) == EncryptionKeySize {
+		return keyFile, nil
+	}
+	hexKey := bytes.TrimSpace(keyFile)
+	if len(hexKey) == hex.EncodedLen(EncryptionKeySize) {
+		key := make([]byte, EncryptionKeySize)
+		_, err := hex.Decode(key, hexKey)
+		if err == nil {
+			return key, nil
+		}
+	}
+	return nil, errors.New("the encryption key must be 32 bytes, or 64 hex characters")
+}
+
+func newSegmentCipher(key []byte, salt []byte) (cipher.AEAD, error) {
+	if len(key) != EncryptionKeySize {
+		return nil, errors.New("the encryption key must be 32 bytes")
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("octodiff delta encryption\x00"))
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(nonce []byte, segmentIndex uint64, isLast bool) []byte {
+	binary.BigEndian.PutUint64(nonce, segmentIndex)
+	nonce[len(nonce)-1] = 0
+	if isLast {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// ----------------------------------------------------------------------------
+
+type encryptingWriter struct {
+	output       io.Writer
+	aead         cipher.AEAD
+	header       []byte
+	nonce        []byte
+	plaintext    []byte
+	ciphertext   []byte
+	segmentIndex uint64
+	closed       bool
+}
+
+// NewEncryptingWriter returns a writer which encrypts everything written to it onto output.
+// Close must be called to write the last segment.
+func NewEncryptingWriter(output io.Writer, key []byte) (io.WriteCloser, error) {
+	salt := make([]byte, encryptionSaltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newSegmentCipher(key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append([]byte(nil), BinaryEncryptedHeader...)
+	header = append(header, encryptionVersion...)
+	header = binary.LittleEndian.AppendUint32(header, DefaultEncryptionSegmentSize)
+	header = append(header, salt...)
+	_, err = output.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptingWriter{
+		output:    output,
+		aead:      aead,
+		header:    header,
+		nonce:     make([]byte, aead.NonceSize()),
+		plaintext: make([]byte, 0, DefaultEncryptionSegmentSize),
+	}, nil
+}
+
+func (e *encryptingWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("write to closed encrypting writer")
+	}
+	written := 0
+	for len(p) > 0 {
+		// a full segment is only written once there's more data, because we don't know yet if it is the last one
+		if len(e.plaintext) == cap(e.plaintext) {
+			err := e.writeSegment(false)
+			if err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.plaintext[len(e.plaintext):cap(e.plaintext)], p)
+		e.plaintext = e.plaintext[:len(e.plaintext)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptingWriter) writeSegment(isLast bool) error {
+	// the header is the associated data for every segment, so it can't be altered
+	e.ciphertext = e.aead.Seal(e.ciphertext[:0], segmentNonce(e.nonce, e.segmentIndex, isLast), e.plaintext, e.header)
+	e.segmentIndex++
+	e.plaintext = e.plaintext[:0]
+	_, err := e.output.Write(e.ciphertext)
+	return err
+}
+
+// Close writes the last segment. It doesn't close the output.
+func (e *encryptingWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.writeSegment(true)
+}
+
+// ----------------------------------------------------------------------------
+
+type decryptingReader struct {
+	input        *bufio.Reader
+	aead         cipher.AEAD
+	header       []byte
+	nonce        []byte
+	segmentSize  int
+	segment      []byte
+	plaintext    []byte
+	segmentIndex uint64
+	hasReadLast  bool
+}
+
+// NewDecryptingReader returns a reader which decrypts a file written by NewEncryptingWriter.
+// Every segment is authenticated before this returns, so a wrong key, or a file which has been tampered with, is
+// reported before any of the plaintext is used. The input is then read again from its current position as the
+// returned reader is read.
+func NewDecryptingReader(input io.ReadSeeker, key []byte) (io.Reader, error) {
+	start, err := input.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	verifier, err := newDecryptingReader(input, key)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(io.Discard, verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = input.Seek(start, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return newDecryptingReader(input, key)
+}
+
+func newDecryptingReader(input io.Reader, key []byte) (*decryptingReader, error) {
+	bufferedInput := bufio.NewReader(input)
+	header := make([]byte, len(BinaryEncryptedHeader)+len(encryptionVersion)+4+encryptionSaltSize)
+	_, err := io.ReadFull(bufferedInput, header)
+	if err != nil || !bytes.HasPrefix(header, BinaryEncryptedHeader) {
+		return nil, errors.New("the file is not encrypted, or is corrupt")
+	}
+	if !bytes.Equal(header[len(BinaryEncryptedHeader):len(BinaryEncryptedHeader)+1], encryptionVersion) {
+		return nil, errors.New("the file is encrypted using a newer format than this program can handle")
+	}
+	segmentSize := binary.LittleEndian.Uint32(header[len(BinaryEncryptedHeader)+1:])
+	if segmentSize == 0 || segmentSize > maxEncryptionSegmentSize {
+		return nil, errors.New("the encrypted file appears to be corrupt")
+	}
+
+	aead, err := newSegmentCipher(key, header[len(header)-encryptionSaltSize:])
+	if err != nil {
+		return nil, err
+	}
+	return &decryptingReader{
+		input:       bufferedInput,
+		aead:        aead,
+		header:      header,
+		nonce:       make([]byte, aead.NonceSize()),
+		segmentSize: int(segmentSize),
+		segment:     make([]byte, int(segmentSize)+aead.Overhead()),
+	}, nil
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.plaintext) == 0 {
+		if d.hasReadLast {
+			return 0, io.EOF
+		}
+		err := d.readSegment()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plaintext)
+	d.plaintext = d.plaintext[n:]
+	return n, nil
+}
+
+func (d *decryptingReader) readSegment() error {
+	n, err := io.ReadFull(d.input, d.segment)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	// only the last segment is short, but the last segment may also be full
+	isLast := n < len(d.segment)
+	if !isLast {
+		_, peekErr := d.input.Peek(1)
+		if peekErr == io.EOF {
+			isLast = true
+		} else if peekErr != nil {
+			return peekErr
+		}
+	}
+
+	d.plaintext, err = d.aead.Open(d.segment[:0], segmentNonce(d.nonce, d.segmentIndex, isLast), d.segment[:n], d.header)
+	if err != nil {
+		return errors.New("the encrypted file could not be decrypted; the key is wrong, or the file is corrupt or has been tampered with")
+	}
+	d.segmentIndex++
+	d.hasReadLast = isLast
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+
+// EncryptingDeltaWriter is a BinaryDeltaWriter which encrypts the delta. Close must be called once the delta has been
+// built, to write the last encrypted segment.
+type EncryptingDeltaWriter struct {
+	*BinaryDeltaWriter
+	encryptor io.WriteCloser
+}
+
+func NewEncryptingDeltaWriter(output io.Writer, key []byte) (*EncryptingDeltaWriter, error) {
+	encryptor, err := NewEncryptingWriter(output, key)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptingDeltaWriter{
+		BinaryDeltaWriter: NewBinaryDeltaWriter(encryptor),
+		encryptor:         encryptor,
+	}, nil
+}
+
+// Close writes the last encrypted segment. It doesn't close the underlying output.
+func (w *EncryptingDeltaWriter) Close() error {
+	return w.encryptor.Close()
+}
+
+// NewDecryptingDeltaReader returns a BinaryDeltaReader for a delta written by EncryptingDeltaWriter.
+// The whole delta is authenticated before this returns, as with NewDecryptingReader.
+func NewDecryptingDeltaReader(input io.ReadSeeker, key []byte) (*BinaryDeltaReader, error) {
+	decryptor, err := NewDecryptingReader(input, key)
+	if err != nil {
+		return nil, err
+	}
+	return NewBinaryDeltaReader(decryptor), nil
+}
@@ -0,0 +1,114 @@
+package octodiff_test
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
+	"github.com/OctopusDeploy/go-octodiff/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+var testEncryptionKey = bytes.Repeat([]byte{0x42}, octodiff.EncryptionKeySize)
+
+func encrypt(plaintext []byte, key []byte) []byte {
+	var output bytes.Buffer
+	encryptor, err := octodiff.NewEncryptingWriter(&output, key)
+	if err != nil {
+		panic(err) // should never fail under tests
+	}
+	_, _ = encryptor.Write(plaintext)
+	_ = encryptor.Close()
+	return output.Bytes()
+}
+
+func TestEncryptsAndDecrypts(t *testing.T) {
+	for _, length := range []int{0, 1, octodiff.DefaultEncryptionSegmentSize, 3*octodiff.DefaultEncryptionSegmentSize + 17} {
+		plaintext := test.GenerateTestData(length)
+		ciphertext := encrypt(plaintext, testEncryptionKey)
+		assert.Equal(t, "OCTOCRYPT", string(ciphertext[:9]))
+
+		decryptor, err := octodiff.NewDecryptingReader(bytes.NewReader(ciphertext), testEncryptionKey)
+		assert.Nil(t, err)
+		decrypted, err := io.ReadAll(decryptor)
+		assert.Nil(t, err)
+		assert.Equal(t, len(plaintext), len(decrypted))
+		assert.Equal(t, plaintext, decrypted)
+	}
+}
+
+func TestEncryptionUsesDifferentSaltEachTime(t *testing.T) {
+	plaintext := test.GenerateTestData(1024)
+	assert.NotEqual(t, encrypt(plaintext, testEncryptionKey), encrypt(plaintext, testEncryptionKey))
+}
+
+func TestDecryptionRejectsWrongKey(t *testing.T) {
+	ciphertext := encrypt(test.GenerateTestData(1024), testEncryptionKey)
+
+	_, err := octodiff.NewDecryptingReader(bytes.NewReader(ciphertext), bytes.Repeat([]byte{0x43}, octodiff.EncryptionKeySize))
+	assert.EqualError(t, err, "the encrypted file could not be decrypted; the key is wrong, or the file is corrupt or has been tampered with")
+}
+
+func TestDecryptionRejectsTamperingBeforeReturningAnyData(t *testing.T) {
+	segmentSize := octodiff.DefaultEncryptionSegmentSize + 16
+	ciphertext := encrypt(test.GenerateTestData(3*octodiff.DefaultEncryptionSegmentSize), testEncryptionKey)
+	headerSize := len(ciphertext) - 3*segmentSize
+
+	tampered := append([]byte(nil), ciphertext...)
+	tampered[headerSize+2*segmentSize+5] ^= 0x01 // in the last segment
+	_, err := octodiff.NewDecryptingReader(bytes.NewReader(tampered), testEncryptionKey)
+	assert.NotNil(t, err)
+
+	// dropping the last segment leaves a file which decrypts correctly up to the end, but the new last segment
+	// wasn't encrypted as the last one
+	_, err = octodiff.NewDecryptingReader(bytes.NewReader(ciphertext[:headerSize+2*segmentSize]), testEncryptionKey)
+	assert.NotNil(t, err)
+
+	swapped := append([]byte(nil), ciphertext[:headerSize]...)
+	swapped = append(swapped, ciphertext[headerSize+segmentSize:headerSize+2*segmentSize]...)
+	swapped = append(swapped, ciphertext[headerSize:headerSize+segmentSize]...)
+	swapped = append(swapped, ciphertext[headerSize+2*segmentSize:]...)
+	_, err = octodiff.NewDecryptingReader(bytes.NewReader(swapped), testEncryptionKey)
+	assert.NotNil(t, err)
+}
+
+func TestEncryptedDeltaRoundTrip(t *testing.T) {
+	original := test.GenerateTestData(256 * 1024)
+	signature := buildSignatureWithBasisIdentity(original)
+	newFile := append(append([]byte(nil), original[1000:]...), []byte("some new data")...)
+
+	var deltaFile bytes.Buffer
+	deltaWriter, err := octodiff.NewEncryptingDeltaWriter(&deltaFile, testEncryptionKey)
+	assert.Nil(t, err)
+	deltaWriter.CompressData = true
+	err = octodiff.NewDeltaBuilder().Build(bytes.NewReader(newFile), int64(len(newFile)), bytes.NewReader(signature), int64(len(signature)), deltaWriter)
+	assert.Nil(t, err)
+	err = deltaWriter.Close()
+	assert.Nil(t, err)
+
+	_, err = octodiff.NewDeltaReader(bufio.NewReader(bytes.NewReader(deltaFile.Bytes())))
+	assert.EqualError(t, err, "the delta file is encrypted; the encryption key is needed to read it")
+
+	deltaReader, err := octodiff.NewDecryptingDeltaReader(bytes.NewReader(deltaFile.Bytes()), testEncryptionKey)
+	assert.Nil(t, err)
+	err = octodiff.VerifyBasisFile(bytes.NewReader(original), deltaReader)
+	assert.Nil(t, err)
+	var output bytes.Buffer
+	err = octodiff.ApplyDeltaAndVerify(bytes.NewReader(original), deltaReader, &output)
+	assert.Nil(t, err)
+	assert.Equal(t, newFile, output.Bytes())
+}
+
+func TestParsesEncryptionKey(t *testing.T) {
+	key, err := octodiff.ParseEncryptionKey(testEncryptionKey)
+	assert.Nil(t, err)
+	assert.Equal(t, testEncryptionKey, key)
+
+	key, err = octodiff.ParseEncryptionKey([]byte("4242424242424242424242424242424242424242424242424242424242424242\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, testEncryptionKey, key)
+
+	_, err = octodiff.ParseEncryptionKey([]byte("not a key"))
+	assert.EqualError(t, err, "the encryption key must be 32 bytes, or 64 hex characters")
+}
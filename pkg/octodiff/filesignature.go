@@ -0,0 +1,119 @@
+package octodiff
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Signature and delta files can be signed with Ed25519, so that a tampered file can be refused before it is used.
+// The signature is detached, so the files themselves are unchanged.
+//
+// The signature is Ed25519ph, from RFC 8032, with fileSignatureContext as its context. This signs the SHA-512 of the
+// file rather than the file itself, so that large files can be hashed as they stream past rather than being held in
+// memory, and other Ed25519ph implementations can check it.
+
+const fileSignatureContext = "octodiff file signature"
+
+var fileSignatureVersion = []byte{0x01}
+
+var fileSignatureOptions = &ed25519.Options{Hash: crypto.SHA512, Context: fileSignatureContext}
+
+// SignFile reads the whole of file, and writes a detached signature of it to output
+func SignFile(privateKey ed25519.PrivateKey, file io.Reader, output io.Writer) error {
+	digest := sha512.New()
+	_, err := io.Copy(digest, file)
+	if err != nil {
+		return err
+	}
+	signature, err := privateKey.Sign(nil, digest.Sum(nil), fileSignatureOptions) // Ed25519 doesn't need randomness
+	if err != nil {
+		return err
+	}
+
+	_, err = output.Write(BinaryFileSignatureHeader)
+	if err != nil {
+		return err
+	}
+	_, err = output.Write(fileSignatureVersion)
+	if err != nil {
+		return err
+	}
+	_, err = output.Write(signature)
+	return err
+}
+
+// VerifyFileSignature reads the whole of file, and checks it against a detached signature written by SignFile
+func VerifyFileSignature(publicKey ed25519.PublicKey, file io.Reader, fileSignature io.Reader) error {
+	expectedLength := len(BinaryFileSignatureHeader) + len(fileSignatureVersion) + ed25519.SignatureSize
+	signatureBytes, err := io.ReadAll(io.LimitReader(fileSignature, int64(expectedLength)+1))
+	if err != nil {
+		return err
+	}
+	if len(signatureBytes) != expectedLength || !bytes.HasPrefix(signatureBytes, BinaryFileSignatureHeader) {
+		return errors.New("the file signature appears to be corrupt")
+	}
+	if !bytes.Equal(signatureBytes[len(BinaryFileSignatureHeader):len(BinaryFileSignatureHeader)+1], fileSignatureVersion) {
+		return errors.New("the file signature uses a newer format than this program can handle")
+	}
+
+	digest := sha512.New()
+	_, err = io.Copy(digest, file)
+	if err != nil {
+		return err
+	}
+	err = ed25519.VerifyWithOptions(publicKey, digest.Sum(nil), signatureBytes[expectedLength-ed25519.SignatureSize:], fileSignatureOptions)
+	if err != nil {
+		return errors.New("the file does not match its signature; it may have been tampered with, or signed with a different key")
+	}
+	return nil
+}
+
+// ParseSigningKey reads an Ed25519 private key from a PKCS #8 "PRIVATE KEY" PEM block,
+// such as the ones written by `openssl genpkey -algorithm ed25519`
+func ParseSigningKey(pemData []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("the signing key must be a PEM encoded PKCS #8 private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("the signing key must be an Ed25519 key, not %T", key)
+	}
+	return privateKey, nil
+}
+
+// ParseVerificationKey reads an Ed25519 public key from a PKIX "PUBLIC KEY" PEM block. The public key is also taken
+// from a private key, for convenience when the same machine signs and verifies.
+func ParseVerificationKey(pemData []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(pemData)
+	if block != nil && block.Type == "PRIVATE KEY" {
+		privateKey, err := ParseSigningKey(pemData)
+		if err != nil {
+			return nil, err
+		}
+		return privateKey.Public().(ed25519.PublicKey), nil
+	}
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("the verification key must be a PEM encoded PKIX public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("the verification key must be an Ed25519 key, not %T", key)
+	}
+	return publicKey, nil
+}
@@ -0,0 +1,116 @@
+package octodiff_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
+	"github.com/OctopusDeploy/go-octodiff/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+func generateSigningKey(randomSeed int64) ed25519.PrivateKey {
+	seed := make([]byte, ed25519.SeedSize)
+	rand.New(rand.NewSource(randomSeed)).Read(seed)
+	return ed25519.NewKeyFromSeed(seed)
+}
+
+func signFile(privateKey ed25519.PrivateKey, file []byte) []byte {
+	var output bytes.Buffer
+	err := octodiff.SignFile(privateKey, bytes.NewReader(file), &output)
+	if err != nil {
+		panic(err) // should never fail under tests
+	}
+	return output.Bytes()
+}
+
+func TestVerifiesSignedFile(t *testing.T) {
+	privateKey := generateSigningKey(1)
+	delta := buildDelta(test.TestData(), buildSignature(nil))
+
+	fileSignature := signFile(privateKey, delta)
+	assert.Equal(t, 9+1+64, len(fileSignature))
+	assert.Equal(t, "OCTOEDSIG\x01", string(fileSignature[:10]))
+
+	err := octodiff.VerifyFileSignature(privateKey.Public().(ed25519.PublicKey), bytes.NewReader(delta), bytes.NewReader(fileSignature))
+	assert.Nil(t, err)
+}
+
+func TestFileSignatureIsEd25519ph(t *testing.T) {
+	privateKey := generateSigningKey(1)
+	delta := buildDelta(test.TestData(), buildSignature(nil))
+	fileSignature := signFile(privateKey, delta)
+
+	// anything which does RFC 8032 Ed25519ph with the same context can check the signature
+	digest := sha512.Sum512(delta)
+	options := &ed25519.Options{Hash: crypto.SHA512, Context: "octodiff file signature"}
+	err := ed25519.VerifyWithOptions(privateKey.Public().(ed25519.PublicKey), digest[:], fileSignature[10:], options)
+	assert.Nil(t, err)
+}
+
+func TestRejectsTamperedFile(t *testing.T) {
+	privateKey := generateSigningKey(1)
+	delta := buildDelta(test.TestData(), buildSignature(nil))
+	fileSignature := signFile(privateKey, delta)
+
+	delta[len(delta)-1] ^= 0x01
+	err := octodiff.VerifyFileSignature(privateKey.Public().(ed25519.PublicKey), bytes.NewReader(delta), bytes.NewReader(fileSignature))
+	assert.EqualError(t, err, "the file does not match its signature; it may have been tampered with, or signed with a different key")
+}
+
+func TestRejectsFileSignedWithDifferentKey(t *testing.T) {
+	delta := buildDelta(test.TestData(), buildSignature(nil))
+	fileSignature := signFile(generateSigningKey(1), delta)
+
+	err := octodiff.VerifyFileSignature(generateSigningKey(2).Public().(ed25519.PublicKey), bytes.NewReader(delta), bytes.NewReader(fileSignature))
+	assert.NotNil(t, err)
+}
+
+func TestRejectsCorruptFileSignature(t *testing.T) {
+	privateKey := generateSigningKey(1)
+	delta := buildDelta(test.TestData(), buildSignature(nil))
+	fileSignature := signFile(privateKey, delta)
+
+	err := octodiff.VerifyFileSignature(privateKey.Public().(ed25519.PublicKey), bytes.NewReader(delta), bytes.NewReader(fileSignature[:40]))
+	assert.EqualError(t, err, "the file signature appears to be corrupt")
+}
+
+func TestParsesKeys(t *testing.T) {
+	privateKey := generateSigningKey(1)
+
+	privateKeyBytes, _ := x509.MarshalPKCS8PrivateKey(privateKey)
+	privateKeyPem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKeyBytes})
+	publicKeyBytes, _ := x509.MarshalPKIXPublicKey(privateKey.Public())
+	publicKeyPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyBytes})
+
+	parsedPrivateKey, err := octodiff.ParseSigningKey(privateKeyPem)
+	assert.Nil(t, err)
+	assert.Equal(t, privateKey, parsedPrivateKey)
+
+	parsedPublicKey, err := octodiff.ParseVerificationKey(publicKeyPem)
+	assert.Nil(t, err)
+	assert.Equal(t, privateKey.Public(), parsedPublicKey)
+
+	parsedPublicKey, err = octodiff.ParseVerificationKey(privateKeyPem)
+	assert.Nil(t, err)
+	assert.Equal(t, privateKey.Public(), parsedPublicKey)
+
+	_, err = octodiff.ParseSigningKey(publicKeyPem)
+	assert.NotNil(t, err)
+}
+
+func TestRejectsNonEd25519Keys(t *testing.T) {
+	ecdsaKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.New(rand.NewSource(1)))
+	keyBytes, _ := x509.MarshalPKCS8PrivateKey(ecdsaKey)
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})
+
+	_, err := octodiff.ParseSigningKey(keyPem)
+	assert.EqualError(t, err, "the signing key must be an Ed25519 key, not *ecdsa.PrivateKey")
+}
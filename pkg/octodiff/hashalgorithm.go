@@ -2,7 +2,11 @@ package octodiff
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
 	"io"
+	"sync"
 )
 
 type HashAlgorithm interface {
@@ -10,9 +14,13 @@ type HashAlgorithm interface {
 	HashLength() int
 	HashOverData(data []byte) []byte
 	HashOverReader(reader io.Reader) ([]byte, error)
+
+	// NewHash returns a hash.Hash which can be fed data incrementally, for callers which already have the
+	// data flowing past and don't want to read it a second time
+	NewHash() hash.Hash
 }
 
-// the only hash algorithm octodiff seems to use is sha1
+// SHA1 is what C# octodiff uses, and remains the default so that our files are compatible with it
 
 type Sha1HashAlgorithm struct {
 }
@@ -34,11 +42,73 @@ func (s *Sha1HashAlgorithm) HashOverData(data []byte) []byte {
 // This will issue lots of 1k reads into the reader.
 // It's up to the caller to pass us a bufio if performance is of concern
 func (s *Sha1HashAlgorithm) HashOverReader(reader io.Reader) ([]byte, error) {
-	sha := sha1.New()
+	return hashOverReader(s.NewHash(), reader)
+}
+
+func (s *Sha1HashAlgorithm) NewHash() hash.Hash {
+	return sha1.New()
+}
+
+// ----------------------------------------------------------------------------
+
+type Sha256HashAlgorithm struct {
+}
+
+func (s *Sha256HashAlgorithm) Name() string {
+	return "SHA256"
+}
+
+func (s *Sha256HashAlgorithm) HashLength() int {
+	return sha256.Size
+}
+
+func (s *Sha256HashAlgorithm) HashOverData(data []byte) []byte {
+	h := sha256.Sum256(data)
+	return h[:]
+}
+
+func (s *Sha256HashAlgorithm) HashOverReader(reader io.Reader) ([]byte, error) {
+	return hashOverReader(s.NewHash(), reader)
+}
+
+func (s *Sha256HashAlgorithm) NewHash() hash.Hash {
+	return sha256.New()
+}
+
+// ----------------------------------------------------------------------------
+
+// Sha512_256HashAlgorithm is SHA-512 truncated to 256 bits. It is generally faster than SHA256 on 64-bit CPUs
+// which don't have hardware SHA extensions.
+type Sha512_256HashAlgorithm struct {
+}
+
+func (s *Sha512_256HashAlgorithm) Name() string {
+	return "SHA512/256"
+}
 
+func (s *Sha512_256HashAlgorithm) HashLength() int {
+	return sha512.Size256
+}
+
+func (s *Sha512_256HashAlgorithm) HashOverData(data []byte) []byte {
+	h := sha512.Sum512_256(data)
+	return h[:]
+}
+
+func (s *Sha512_256HashAlgorithm) HashOverReader(reader io.Reader) ([]byte, error) {
+	return hashOverReader(s.NewHash(), reader)
+}
+
+func (s *Sha512_256HashAlgorithm) NewHash() hash.Hash {
+	return sha512.New512_256()
+}
+
+// ----------------------------------------------------------------------------
+
+func hashOverReader(h hash.Hash, reader io.Reader) ([]byte, error) {
 	iter := NewReaderIteratorSize(reader, 1024)
 	for iter.Next() {
-		_, err := sha.Write(iter.Current)
+		_, err := h.Write(iter.Current)
 		if err != nil {
 			return nil, err
 		}
@@ -46,7 +116,44 @@ func (s *Sha1HashAlgorithm) HashOverReader(reader io.Reader) ([]byte, error) {
 	if err := iter.Err(); err != nil {
 		return nil, err
 	}
-	return sha.Sum(nil), nil
+	return h.Sum(nil), nil
 }
 
 var DefaultHashAlgorithm HashAlgorithm = &Sha1HashAlgorithm{}
+
+// ----------------------------------------------------------------------------
+
+var hashAlgorithmsMu sync.RWMutex
+var hashAlgorithms = map[string]HashAlgorithm{}
+
+// RegisterHashAlgorithm makes a HashAlgorithm available to SignatureReader and BinaryDeltaReader, which
+// look up the algorithm by the name recorded in the file they are reading.
+// Like database/sql.Register, it panics if the algorithm is nil or the name is already registered.
+func RegisterHashAlgorithm(algorithm HashAlgorithm) {
+	if algorithm == nil {
+		panic("octodiff: RegisterHashAlgorithm algorithm is nil")
+	}
+	hashAlgorithmsMu.Lock()
+	defer hashAlgorithmsMu.Unlock()
+
+	name := algorithm.Name()
+	if _, dup := hashAlgorithms[name]; dup {
+		panic("octodiff: RegisterHashAlgorithm called twice for " + name)
+	}
+	hashAlgorithms[name] = algorithm
+}
+
+// LookupHashAlgorithm returns the registered HashAlgorithm with the given name
+func LookupHashAlgorithm(name string) (HashAlgorithm, bool) {
+	hashAlgorithmsMu.RLock()
+	defer hashAlgorithmsMu.RUnlock()
+
+	algorithm, ok := hashAlgorithms[name]
+	return algorithm, ok
+}
+
+func init() {
+	RegisterHashAlgorithm(DefaultHashAlgorithm)
+	RegisterHashAlgorithm(&Sha256HashAlgorithm{})
+	RegisterHashAlgorithm(&Sha512_256HashAlgorithm{})
+}
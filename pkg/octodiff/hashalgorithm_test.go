@@ -0,0 +1,63 @@
+package octodiff_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
+	"github.com/OctopusDeploy/go-octodiff/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestHashAlgorithms_HashOverData(t *testing.T) {
+	data := []byte("abc")
+
+	assert.Equal(t, "a9993e364706816aba3e25717850c26c9cd0d89d", hex.EncodeToString((&octodiff.Sha1HashAlgorithm{}).HashOverData(data)))
+	assert.Equal(t, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad", hex.EncodeToString((&octodiff.Sha256HashAlgorithm{}).HashOverData(data)))
+	assert.Equal(t, "53048e2681941ef99b2e29b76b4c7dabe4c2d0c634fc6d46e0e2f13107e7af23", hex.EncodeToString((&octodiff.Sha512_256HashAlgorithm{}).HashOverData(data)))
+}
+
+func TestHashAlgorithms_HashOverReaderMatchesHashOverData(t *testing.T) {
+	data := test.GenerateTestData(100 * 1024)
+
+	for _, algorithm := range []octodiff.HashAlgorithm{&octodiff.Sha1HashAlgorithm{}, &octodiff.Sha256HashAlgorithm{}, &octodiff.Sha512_256HashAlgorithm{}} {
+		hash, err := algorithm.HashOverReader(bytes.NewReader(data))
+		assert.Nil(t, err)
+		assert.Equal(t, algorithm.HashOverData(data), hash, algorithm.Name())
+		assert.Equal(t, algorithm.HashLength(), len(hash), algorithm.Name())
+	}
+}
+
+func TestLookupHashAlgorithm(t *testing.T) {
+	for _, name := range []string{"SHA1", "SHA256", "SHA512/256"} {
+		algorithm, ok := octodiff.LookupHashAlgorithm(name)
+		assert.True(t, ok, name)
+		assert.Equal(t, name, algorithm.Name())
+	}
+
+	_, ok := octodiff.LookupHashAlgorithm("MD5")
+	assert.False(t, ok)
+}
+
+func TestRegisterHashAlgorithm_PanicsOnDuplicate(t *testing.T) {
+	assert.Panics(t, func() {
+		octodiff.RegisterHashAlgorithm(&octodiff.Sha256HashAlgorithm{})
+	})
+}
+
+func TestHashAlgorithms_NewHashMatchesHashOverData(t *testing.T) {
+	data := test.GenerateTestData(100 * 1024)
+
+	for _, algorithm := range []octodiff.HashAlgorithm{&octodiff.Sha1HashAlgorithm{}, &octodiff.Sha256HashAlgorithm{}, &octodiff.Sha512_256HashAlgorithm{}} {
+		hash := algorithm.NewHash()
+		// feed it in uneven pieces, the way data arrives when it's flowing through ApplyDelta
+		for offset := 0; offset < len(data); offset += 3000 {
+			end := offset + 3000
+			if end > len(data) {
+				end = len(data)
+			}
+			_, _ = hash.Write(data[offset:end])
+		}
+		assert.Equal(t, algorithm.HashOverData(data), hash.Sum(nil), algorithm.Name())
+	}
+}
@@ -0,0 +1,162 @@
+package octodiff
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// JSONDeltaReader reads the JSON documents written by JSONDeltaWriter. The whole document is decoded when the
+// metadata is first needed, so it isn't suitable for very large deltas.
+type JSONDeltaReader struct {
+	input io.Reader
+
+	delta           jsonDelta
+	expectedHash    []byte
+	hashAlgorithm   HashAlgorithm
+	basisHash       []byte
+	hasReadMetadata bool
+}
+
+type jsonDelta struct {
+	HashAlgorithm string             `json:"hashAlgorithm"`
+	ExpectedHash  string             `json:"expectedHash"`
+	BasisLength   int64              `json:"basisLength"`
+	BasisHash     string             `json:"basisHash"`
+	Commands      []jsonDeltaCommand `json:"commands"`
+}
+
+type jsonDeltaCommand struct {
+	Type   string `json:"type"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	Data   []byte `json:"data"` // encoding/json uses base64 for []byte
+}
+
+var _ BasisIdentityDeltaReader = (*JSONDeltaReader)(nil)
+
+func NewJSONDeltaReader(input io.Reader) *JSONDeltaReader {
+	return &JSONDeltaReader{
+		input: input,
+	}
+}
+
+// NewDeltaReader returns a JSONDeltaReader if the input looks like a JSON document, otherwise a BinaryDeltaReader.
+// Encrypted deltas need NewDecryptingDeltaReader, so are rejected.
+func NewDeltaReader(input *bufio.Reader) (BasisIdentityDeltaReader, error) {
+	for {
+		next, err := input.Peek(1)
+		if err == io.EOF {
+			return NewBinaryDeltaReader(input), nil // let the binary reader report the empty file
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch next[0] {
+		case ' ', '\t', '\r', '\n':
+			_, _ = input.ReadByte()
+		case '{':
+			return NewJSONDeltaReader(input), nil
+		default:
+			if header, _ := input.Peek(len(BinaryEncryptedHeader)); bytes.Equal(header, BinaryEncryptedHeader) {
+				return nil, errors.New("the delta file is encrypted; the encryption key is needed to read it")
+			}
+			return NewBinaryDeltaReader(input), nil
+		}
+	}
+}
+
+func (j *JSONDeltaReader) ExpectedHash() ([]byte, error) {
+	err := j.ensureMetadata()
+	if err != nil {
+		return nil, err
+	}
+	return j.expectedHash, nil
+}
+
+func (j *JSONDeltaReader) HashAlgorithm() (HashAlgorithm, error) {
+	err := j.ensureMetadata()
+	if err != nil {
+		return nil, err
+	}
+	return j.hashAlgorithm, nil
+}
+
+func (j *JSONDeltaReader) BasisIdentity() (int64, []byte, error) {
+	err := j.ensureMetadata()
+	if err != nil {
+		return 0, nil, err
+	}
+	return j.delta.BasisLength, j.basisHash, nil
+}
+
+func (j *JSONDeltaReader) Apply(writeData func([]byte) error, copyData func(int64, int64) error) error {
+	err := j.ensureMetadata()
+	if err != nil {
+		return err
+	}
+
+	for i, command := range j.delta.Commands {
+		switch command.Type {
+		case "copy":
+			if command.Offset < 0 || command.Length < 0 {
+				return fmt.Errorf("command %d in the delta file copies from offset %d with length %d", i, command.Offset, command.Length)
+			}
+			err = copyData(command.Offset, command.Length)
+		case "data":
+			err = writeData(command.Data)
+		default:
+			return fmt.Errorf("command %d in the delta file has unexpected type %q", i, command.Type)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *JSONDeltaReader) ensureMetadata() error {
+	if j.hasReadMetadata {
+		return nil
+	}
+
+	err := json.NewDecoder(j.input).Decode(&j.delta)
+	if err != nil {
+		return fmt.Errorf("the delta file appears to be corrupt; %w", err)
+	}
+
+	hashAlgorithm, ok := LookupHashAlgorithm(j.delta.HashAlgorithm)
+	if !ok {
+		return fmt.Errorf("the delta file uses an unsupported hashing algorithm %s", j.delta.HashAlgorithm)
+	}
+	j.hashAlgorithm = hashAlgorithm
+
+	j.expectedHash, err = j.decodeHash(j.delta.ExpectedHash)
+	if err != nil {
+		return err
+	}
+	if j.delta.BasisHash != "" {
+		j.basisHash, err = j.decodeHash(j.delta.BasisHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	j.hasReadMetadata = true
+	return nil
+}
+
+func (j *JSONDeltaReader) decodeHash(hexHash string) ([]byte, error) {
+	hash, err := hex.DecodeString(hexHash)
+	if err != nil {
+		return nil, fmt.Errorf("the delta file contains an invalid hash; %w", err)
+	}
+	if len(hash) != j.hashAlgorithm.HashLength() {
+		return nil, errors.New("the delta file contains an invalid hash length")
+	}
+	return hash, nil
+}
@@ -0,0 +1,81 @@
+package octodiff_test
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
+	"github.com/OctopusDeploy/go-octodiff/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestJSONDeltaRoundTrip(t *testing.T) {
+	original := test.GenerateTestData(128 * 1024)
+	signature := buildSignatureWithBasisIdentity(original)
+
+	newFile := append([]byte(nil), original[:64*1024]...)
+	newFile = append(newFile, []byte("inserted in the middle")...)
+	newFile = append(newFile, original[64*1024:]...)
+	newFile[100000] = 0xaa
+
+	for _, trailingHash := range []bool{false, true} {
+		var deltaFile bytes.Buffer
+		w := octodiff.NewJSONDeltaWriter(&deltaFile)
+		w.TrailingHash = trailingHash
+		err := octodiff.NewDeltaBuilder().Build(bytes.NewReader(newFile), int64(len(newFile)), bytes.NewReader(signature), int64(len(signature)), w)
+		assert.Nil(t, err)
+
+		reader := octodiff.NewJSONDeltaReader(bytes.NewReader(deltaFile.Bytes()))
+		err = octodiff.VerifyBasisFile(bytes.NewReader(original), reader)
+		assert.Nil(t, err)
+
+		var output bytes.Buffer
+		err = octodiff.ApplyDeltaAndVerify(bytes.NewReader(original), reader, &output)
+		assert.Nil(t, err)
+		assert.Equal(t, newFile, output.Bytes())
+	}
+}
+
+func TestJSONDeltaReaderAppliesHandWrittenDelta(t *testing.T) {
+	input := `{
+		"commands": [
+			{"type": "data", "data": "aGVsbG8g"},
+			{"type": "copy", "offset": 6, "length": 5}
+		],
+		"hashAlgorithm": "SHA1",
+		"expectedHash": "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed"
+	}`
+
+	var output bytes.Buffer
+	err := octodiff.ApplyDeltaAndVerify(strings.NewReader("hello world"), octodiff.NewJSONDeltaReader(strings.NewReader(input)), &output)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", output.String())
+}
+
+func TestJSONDeltaReaderRejectsUnknownCommand(t *testing.T) {
+	input := `{"hashAlgorithm": "SHA1", "expectedHash": "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed", "commands": [{"type": "move"}]}`
+
+	reader := octodiff.NewJSONDeltaReader(strings.NewReader(input))
+	err := reader.Apply(func([]byte) error { return nil }, func(int64, int64) error { return nil })
+	assert.EqualError(t, err, `command 0 in the delta file has unexpected type "move"`)
+}
+
+func TestJSONDeltaReaderRejectsBadHash(t *testing.T) {
+	input := `{"hashAlgorithm": "SHA1", "expectedHash": "2aae6c", "commands": []}`
+
+	_, err := octodiff.NewJSONDeltaReader(strings.NewReader(input)).ExpectedHash()
+	assert.EqualError(t, err, "the delta file contains an invalid hash length")
+}
+
+func TestNewDeltaReaderDetectsFormat(t *testing.T) {
+	reader, err := octodiff.NewDeltaReader(bufio.NewReader(strings.NewReader("\n  {}")))
+	assert.Nil(t, err)
+	assert.IsType(t, &octodiff.JSONDeltaReader{}, reader)
+
+	reader, err = octodiff.NewDeltaReader(bufio.NewReader(bytes.NewReader(buildDelta(test.TestData(), buildSignature(test.TestData())))))
+	assert.Nil(t, err)
+	assert.IsType(t, &octodiff.BinaryDeltaReader{}, reader)
+	_, err = reader.ExpectedHash()
+	assert.Nil(t, err)
+}
@@ -0,0 +1,211 @@
+package octodiff
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// JSONDeltaWriter writes a delta as a JSON document, which is much larger than the binary format, but can be read
+// and edited by hand, then applied with JSONDeltaReader. Hashes are hex encoded and literal data is base64 encoded.
+//
+//	{
+//	  "hashAlgorithm": "SHA1",
+//	  "expectedHash": "330bd06982d3b5dbda6c1a6ad16687a0cdb03c0d",
+//	  "commands": [
+//	    {"type": "copy", "offset": 0, "length": 520},
+//	    {"type": "data", "data": "MIICBDCCAaug"}
+//	  ]
+//	}
+//
+// The document may also have "basisLength" and "basisHash", when the delta records the basis file it was built against.
+type JSONDeltaWriter struct {
+	Output io.Writer
+
+	// TrailingHash writes "expectedHash" after the commands rather than before them, so the delta can be built in a
+	// single pass. JSONDeltaReader doesn't mind where it is.
+	TrailingHash bool
+
+	basisLength        int64
+	basisHash          []byte
+	bufferedCopyOffset int64
+	bufferedCopyLength int64
+	hasWrittenCommand  bool
+	hasWrittenEnd      bool
+}
+
+var _ TrailingHashDeltaWriter = (*JSONDeltaWriter)(nil)
+var _ BasisIdentityDeltaWriter = (*JSONDeltaWriter)(nil)
+
+func NewJSONDeltaWriter(output io.Writer) *JSONDeltaWriter {
+	return &JSONDeltaWriter{
+		Output: output,
+	}
+}
+
+func (w *JSONDeltaWriter) SetBasisIdentity(basisLength int64, basisHash []byte) {
+	w.basisLength = basisLength
+	w.basisHash = basisHash
+}
+
+func (w *JSONDeltaWriter) WritesTrailingHash() bool {
+	return w.TrailingHash
+}
+
+// WriteMetadata starts a new document, so a writer can be used for another delta once the last has been flushed.
+// Anything left over from the last delta, such as a copy command that was never flushed, is dropped.
+func (w *JSONDeltaWriter) WriteMetadata(hashAlgorithm HashAlgorithm, expectedNewFileHash []byte) error {
+	w.bufferedCopyOffset = 0
+	w.bufferedCopyLength = 0
+	w.hasWrittenCommand = false
+	w.hasWrittenEnd = false
+
+	hashAlgorithmName, err := json.Marshal(hashAlgorithm.Name())
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w.Output, "{\n  \"hashAlgorithm\": %s,\n", hashAlgorithmName)
+	if err != nil {
+		return err
+	}
+	if !w.TrailingHash {
+		_, err = fmt.Fprintf(w.Output, "  \"expectedHash\": \"%s\",\n", hex.EncodeToString(expectedNewFileHash))
+		if err != nil {
+			return err
+		}
+	}
+	if w.basisHash != nil {
+		_, err = fmt.Fprintf(w.Output, "  \"basisLength\": %d,\n  \"basisHash\": \"%s\",\n", w.basisLength, hex.EncodeToString(w.basisHash))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w.Output, "  \"commands\": [")
+	return err
+}
+
+// WriteTrailingHash writes the expected hash of the new file and closes the document.
+// Flush must have been called first.
+func (w *JSONDeltaWriter) WriteTrailingHash(expectedNewFileHash []byte) error {
+	if !w.TrailingHash {
+		return errors.New("the delta writer was not configured to write a trailing hash")
+	}
+	if !w.hasWrittenEnd {
+		return errors.New("the delta writer must be flushed before writing the trailing hash")
+	}
+	_, err := fmt.Fprintf(w.Output, "  \"expectedHash\": \"%s\"\n}\n", hex.EncodeToString(expectedNewFileHash))
+	return err
+}
+
+// WriteCopyCommand merges sequential copy commands in the same way as BinaryDeltaWriter
+func (w *JSONDeltaWriter) WriteCopyCommand(offset int64, length int64) error {
+	if w.bufferedCopyLength != 0 && w.bufferedCopyOffset+w.bufferedCopyLength == offset {
+		w.bufferedCopyLength += length
+		return nil
+	}
+	err := w.flushCopyCommand()
+	w.bufferedCopyOffset = offset
+	w.bufferedCopyLength = length
+	return err
+}
+
+func (w *JSONDeltaWriter) WriteDataCommand(source io.ReadSeeker, offset int64, length int64) (err error) {
+	err = w.flushCopyCommand()
+	if err != nil {
+		return
+	}
+
+	var originalPosition int64
+	originalPosition, err = source.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_, seekBackErr := source.Seek(originalPosition, io.SeekStart)
+		if seekBackErr != nil {
+			err = seekBackErr
+		}
+	}()
+
+	_, err = source.Seek(offset, io.SeekStart)
+	if err != nil {
+		return
+	}
+
+	err = w.startCommand()
+	if err != nil {
+		return
+	}
+	_, err = io.WriteString(w.Output, "{\"type\": \"data\", \"data\": \"")
+	if err != nil {
+		return
+	}
+	encoder := base64.NewEncoder(base64.StdEncoding, w.Output)
+	iter := NewReaderIteratorSizeNBytes(source, 1024*1024, length)
+	for iter.Next() {
+		_, err = encoder.Write(iter.Current)
+		if err != nil {
+			return
+		}
+	}
+	err = iter.Err()
+	if err != nil {
+		return
+	}
+	err = encoder.Close()
+	if err != nil {
+		return
+	}
+	_, err = io.WriteString(w.Output, "\"}")
+	return
+}
+
+// Flush writes any buffered copy command and closes the list of commands. Unless the writer is writing a
+// trailing hash, this also closes the document.
+func (w *JSONDeltaWriter) Flush() error {
+	err := w.flushCopyCommand()
+	if err != nil || w.hasWrittenEnd {
+		return err
+	}
+	w.hasWrittenEnd = true
+
+	end := "\n  ]"
+	if !w.hasWrittenCommand {
+		end = "]"
+	}
+	if w.TrailingHash {
+		end += ",\n"
+	} else {
+		end += "\n}\n"
+	}
+	_, err = io.WriteString(w.Output, end)
+	return err
+}
+
+func (w *JSONDeltaWriter) flushCopyCommand() error {
+	if w.bufferedCopyLength == 0 {
+		return nil
+	}
+	err := w.startCommand()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w.Output, "{\"type\": \"copy\", \"offset\": %d, \"length\": %d}", w.bufferedCopyOffset, w.bufferedCopyLength)
+	w.bufferedCopyOffset = 0
+	w.bufferedCopyLength = 0
+	return err
+}
+
+// startCommand puts each command on its own line, so that they're easy to edit
+func (w *JSONDeltaWriter) startCommand() error {
+	separator := ",\n    "
+	if !w.hasWrittenCommand {
+		separator = "\n    "
+		w.hasWrittenCommand = true
+	}
+	_, err := io.WriteString(w.Output, separator)
+	return err
+}
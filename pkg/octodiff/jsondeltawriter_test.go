@@ -0,0 +1,90 @@
+package octodiff_test
+
+import (
+	"bytes"
+	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
+	"github.com/OctopusDeploy/go-octodiff/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestJSONDeltaWriterWritesCommands(t *testing.T) {
+	b := bytes.NewBuffer(nil)
+	w := octodiff.NewJSONDeltaWriter(b)
+
+	err := w.WriteMetadata(&octodiff.Sha1HashAlgorithm{}, test.GenerateTestData(20))
+	assert.Nil(t, err)
+	err = w.WriteCopyCommand(0, 520)
+	assert.Nil(t, err)
+	err = w.WriteCopyCommand(520, 520) // merged with the previous copy
+	assert.Nil(t, err)
+	err = w.WriteDataCommand(bytes.NewReader(test.GenerateTestData(1024)), 0, 9)
+	assert.Nil(t, err)
+	err = w.WriteCopyCommand(2000, 10)
+	assert.Nil(t, err)
+	err = w.Flush()
+	assert.Nil(t, err)
+
+	assert.Equal(t, `{
+  "hashAlgorithm": "SHA1",
+  "expectedHash": "30820204308201aba003020102021418d83f0771",
+  "commands": [
+    {"type": "copy", "offset": 0, "length": 1040},
+    {"type": "data", "data": "MIICBDCCAaug"},
+    {"type": "copy", "offset": 2000, "length": 10}
+  ]
+}
+`, b.String())
+}
+
+func TestJSONDeltaWriterWritesTrailingHashAndBasisIdentity(t *testing.T) {
+	b := bytes.NewBuffer(nil)
+	w := octodiff.NewJSONDeltaWriter(b)
+	w.TrailingHash = true
+	w.SetBasisIdentity(1024, test.GenerateTestData(20))
+
+	err := w.WriteMetadata(&octodiff.Sha1HashAlgorithm{}, nil)
+	assert.Nil(t, err)
+	err = w.WriteTrailingHash(test.GenerateTestData(20))
+	assert.NotNil(t, err) // must flush first
+	err = w.Flush()
+	assert.Nil(t, err)
+	err = w.WriteTrailingHash(test.GenerateTestData(20))
+	assert.Nil(t, err)
+
+	assert.Equal(t, `{
+  "hashAlgorithm": "SHA1",
+  "basisLength": 1024,
+  "basisHash": "30820204308201aba003020102021418d83f0771",
+  "commands": [],
+  "expectedHash": "30820204308201aba003020102021418d83f0771"
+}
+`, b.String())
+}
+
+func TestJSONDeltaWriterCanBeReused(t *testing.T) {
+	w := octodiff.NewJSONDeltaWriter(&bytes.Buffer{})
+	writeDelta := func() string {
+		var output bytes.Buffer
+		w.Output = &output
+		assert.Nil(t, w.WriteMetadata(&octodiff.Sha1HashAlgorithm{}, test.GenerateTestData(20)))
+		assert.Nil(t, w.WriteCopyCommand(0, 520))
+		assert.Nil(t, w.Flush())
+		return output.String()
+	}
+	expected := `{
+  "hashAlgorithm": "SHA1",
+  "expectedHash": "30820204308201aba003020102021418d83f0771",
+  "commands": [
+    {"type": "copy", "offset": 0, "length": 520}
+  ]
+}
+`
+	assert.Equal(t, expected, writeDelta())
+	assert.Equal(t, expected, writeDelta())
+
+	// a copy left over from a delta which was abandoned before it was flushed doesn't end up in the next one
+	assert.Nil(t, w.WriteMetadata(&octodiff.Sha1HashAlgorithm{}, test.GenerateTestData(20)))
+	assert.Nil(t, w.WriteCopyCommand(5000, 100))
+	assert.Equal(t, expected, writeDelta())
+}
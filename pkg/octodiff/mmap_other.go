@@ -0,0 +1,14 @@
+//go:build !unix
+
+package octodiff
+
+import "os"
+
+// mapFile returns nil where memory mapping isn't supported, and the file is read from instead
+func mapFile(_ *os.File, _ int64) ([]byte, error) {
+	return nil, nil
+}
+
+func unmapFile(_ []byte) error {
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package octodiff
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the first length bytes of file into memory, read only
+func mapFile(file *os.File, length int64) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, int(length), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func unmapFile(mapping []byte) error {
+	return syscall.Munmap(mapping)
+}
@@ -0,0 +1,187 @@
+package octodiff
+
+import (
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// maxCachedInflatedBlock is the largest compressed data command PatchedFile will hold inflated in memory.
+// BinaryDeltaWriter never writes blocks this big, but other writers might.
+const maxCachedInflatedBlock = 16 * 1024 * 1024
+
+// PatchedFile presents the result of applying a binary delta to a basis file, without writing it out.
+// Reads are resolved through a DeltaIndex into reads of the basis file, or of literal data in the delta.
+// Data in compressed commands has to be inflated from the start of the command, so the most recently used
+// block is kept in memory.
+//
+// ReadAt may be called concurrently, but Read and Seek share a position and may not.
+type PatchedFile struct {
+	basis io.ReaderAt
+	delta io.ReaderAt
+	index *DeltaIndex
+
+	position int64
+
+	inflatedMu      sync.Mutex
+	inflatedCommand int
+	inflated        []byte
+}
+
+var _ io.ReaderAt = (*PatchedFile)(nil)
+var _ io.ReadSeeker = (*PatchedFile)(nil)
+
+// NewPatchedFile indexes the delta, then returns a PatchedFile over it
+func NewPatchedFile(basis io.ReaderAt, delta io.ReaderAt, deltaLength int64) (*PatchedFile, error) {
+	index, err := NewDeltaIndex(delta, deltaLength)
+	if err != nil {
+		return nil, err
+	}
+	return NewPatchedFileFromIndex(basis, delta, index), nil
+}
+
+// NewPatchedFileFromIndex returns a PatchedFile using an index which has already been built for the delta
+func NewPatchedFileFromIndex(basis io.ReaderAt, delta io.ReaderAt, index *DeltaIndex) *PatchedFile {
+	return &PatchedFile{
+		basis:           basis,
+		delta:           delta,
+		index:           index,
+		inflatedCommand: -1,
+	}
+}
+
+// Size returns the length of the new file
+func (f *PatchedFile) Size() int64 {
+	return f.index.NewFileLength
+}
+
+// Index returns the DeltaIndex the file reads through
+func (f *PatchedFile) Index() *DeltaIndex {
+	return f.index
+}
+
+func (f *PatchedFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("octodiff.PatchedFile.ReadAt: negative offset")
+	}
+
+	bytesRead := 0
+	i := f.index.Find(off)
+	for i >= 0 && i < len(f.index.Commands) && bytesRead < len(p) {
+		command := f.index.Commands[i]
+		offsetInCommand := off + int64(bytesRead) - command.NewFileOffset
+		want := p[bytesRead:]
+		if remaining := command.Length - offsetInCommand; int64(len(want)) > remaining {
+			want = want[:remaining]
+		}
+
+		err := f.readCommand(i, command, offsetInCommand, want)
+		if err != nil {
+			return bytesRead, err
+		}
+		bytesRead += len(want)
+		i++
+	}
+
+	if bytesRead < len(p) {
+		return bytesRead, io.EOF
+	}
+	return bytesRead, nil
+}
+
+// readCommand fills p with the output of the command, starting at offsetInCommand
+func (f *PatchedFile) readCommand(i int, command IndexedDeltaCommand, offsetInCommand int64, p []byte) error {
+	switch command.Kind {
+	case DeltaCommandCopy:
+		n, err := f.basis.ReadAt(p, command.SourceOffset+offsetInCommand)
+		if n == len(p) {
+			return nil // ReaderAt may return io.EOF along with the last bytes
+		}
+		if err == io.EOF {
+			return fmt.Errorf("the basis file is shorter than the delta expects; a copy command reads up to offset %d", command.SourceOffset+command.Length)
+		}
+		return err
+	case DeltaCommandData:
+		n, err := f.delta.ReadAt(p, command.SourceOffset+offsetInCommand)
+		if n == len(p) {
+			return nil
+		}
+		if err == io.EOF {
+			return errors.New("the delta file appears to be truncated")
+		}
+		return err
+	case DeltaCommandCompressedData:
+		return f.readCompressed(i, command, offsetInCommand, p)
+	default:
+		return fmt.Errorf("unexpected delta command kind %d", command.Kind)
+	}
+}
+
+func (f *PatchedFile) readCompressed(i int, command IndexedDeltaCommand, offsetInCommand int64, p []byte) error {
+	compressed := io.NewSectionReader(f.delta, command.SourceOffset, command.CompressedLength)
+
+	if command.Length > maxCachedInflatedBlock {
+		// inflate up to the bytes we want, every time
+		decompressor := flate.NewReader(compressed)
+		_, err := io.CopyN(io.Discard, decompressor, offsetInCommand)
+		if err == nil {
+			_, err = io.ReadFull(decompressor, p)
+		}
+		return inflateError(err)
+	}
+
+	f.inflatedMu.Lock()
+	defer f.inflatedMu.Unlock()
+	if f.inflatedCommand != i {
+		if int64(cap(f.inflated)) < command.Length {
+			f.inflated = make([]byte, command.Length)
+		}
+		f.inflated = f.inflated[:command.Length]
+		f.inflatedCommand = -1
+		_, err := io.ReadFull(flate.NewReader(compressed), f.inflated)
+		if err != nil {
+			return inflateError(err)
+		}
+		f.inflatedCommand = i
+	}
+	copy(p, f.inflated[offsetInCommand:])
+	return nil
+}
+
+func inflateError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.New("the delta file appears to be corrupt; compressed data inflated to fewer bytes than expected")
+	}
+	return err
+}
+
+func (f *PatchedFile) Read(p []byte) (int, error) {
+	if f.position >= f.index.NewFileLength {
+		return 0, io.EOF
+	}
+	if remaining := f.index.NewFileLength - f.position; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := f.ReadAt(p, f.position)
+	f.position += int64(n)
+	return n, err
+}
+
+func (f *PatchedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.position
+	case io.SeekEnd:
+		offset += f.index.NewFileLength
+	default:
+		return 0, errors.New("octodiff.PatchedFile.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("octodiff.PatchedFile.Seek: negative position")
+	}
+	f.position = offset
+	return offset, nil
+}
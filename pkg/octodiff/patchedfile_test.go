@@ -0,0 +1,124 @@
+package octodiff_test
+
+import (
+	"bytes"
+	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
+	"github.com/OctopusDeploy/go-octodiff/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// buildPatchedFileTestData returns a basis file, and a new file made of moved, changed, and new sections of it
+func buildPatchedFileTestData() ([]byte, []byte) {
+	basis := test.GenerateTestData(256 * 1024)
+
+	random := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	newFile := append([]byte(nil), basis[128*1024:]...)
+	newFile = append(newFile, random...)
+	newFile = append(newFile, basis[:64*1024]...)
+	newFile = append(newFile, test.GenerateTestData(20000)...) // compressible, but not in the basis at this alignment
+	newFile[1000] = 0xaa
+	return basis, newFile
+}
+
+func buildDeltaWithWriter(newFile []byte, signatureFile []byte, writer *octodiff.BinaryDeltaWriter, output *bytes.Buffer) []byte {
+	err := octodiff.NewDeltaBuilder().Build(bytes.NewReader(newFile), int64(len(newFile)), bytes.NewReader(signatureFile), int64(len(signatureFile)), writer)
+	if err != nil {
+		panic(err) // should never fail under tests
+	}
+	return output.Bytes()
+}
+
+func TestPatchedFileReadsWholeFile(t *testing.T) {
+	basis, newFile := buildPatchedFileTestData()
+	signature := buildSignature(basis)
+
+	for _, compress := range []bool{false, true} {
+		var output bytes.Buffer
+		writer := octodiff.NewBinaryDeltaWriter(&output)
+		writer.CompressData = compress
+		writer.VarintCommands = compress
+		writer.CommandChecksums = compress
+		delta := buildDeltaWithWriter(newFile, signature, writer, &output)
+
+		patched, err := octodiff.NewPatchedFile(bytes.NewReader(basis), bytes.NewReader(delta), int64(len(delta)))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(newFile)), patched.Size())
+
+		result, err := io.ReadAll(patched)
+		assert.Nil(t, err)
+		assert.Equal(t, newFile, result)
+	}
+}
+
+func TestPatchedFileReadsRandomRanges(t *testing.T) {
+	basis, newFile := buildPatchedFileTestData()
+	signature := buildSignature(basis)
+
+	var output bytes.Buffer
+	writer := octodiff.NewBinaryDeltaWriter(&output)
+	writer.CompressData = true
+	delta := buildDeltaWithWriter(newFile, signature, writer, &output)
+
+	patched, err := octodiff.NewPatchedFile(bytes.NewReader(basis), bytes.NewReader(delta), int64(len(delta)))
+	assert.Nil(t, err)
+
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 200; i++ {
+		offset := r.Int63n(int64(len(newFile)))
+		buffer := make([]byte, r.Intn(10000)+1)
+
+		n, err := patched.ReadAt(buffer, offset)
+		expected := newFile[offset:]
+		if len(expected) > len(buffer) {
+			expected = expected[:len(buffer)]
+			assert.Nil(t, err)
+		} else {
+			assert.Equal(t, io.EOF, err)
+		}
+		assert.Equal(t, expected, buffer[:n])
+	}
+}
+
+func TestPatchedFileSeeks(t *testing.T) {
+	basis, newFile := buildPatchedFileTestData()
+	delta := buildDelta(newFile, buildSignature(basis))
+
+	patched, err := octodiff.NewPatchedFile(bytes.NewReader(basis), bytes.NewReader(delta), int64(len(delta)))
+	assert.Nil(t, err)
+
+	position, err := patched.Seek(-100, io.SeekEnd)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(newFile)-100), position)
+	rest, err := io.ReadAll(patched)
+	assert.Nil(t, err)
+	assert.Equal(t, newFile[len(newFile)-100:], rest)
+
+	_, err = patched.Seek(1000, io.SeekStart)
+	assert.Nil(t, err)
+	_, err = patched.Seek(500, io.SeekCurrent)
+	assert.Nil(t, err)
+	buffer := make([]byte, 10)
+	_, err = io.ReadFull(patched, buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, newFile[1500:1510], buffer)
+
+	n, err := patched.ReadAt(buffer, int64(len(newFile)))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestPatchedFileReportsShortBasisFile(t *testing.T) {
+	basis, newFile := buildPatchedFileTestData()
+	delta := buildDelta(newFile, buildSignature(basis))
+
+	patched, err := octodiff.NewPatchedFile(bytes.NewReader(basis[:1024]), bytes.NewReader(delta), int64(len(delta)))
+	assert.Nil(t, err)
+
+	_, err = io.ReadAll(patched)
+	assert.NotNil(t, err)
+}
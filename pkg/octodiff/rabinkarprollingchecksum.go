@@ -0,0 +1,84 @@
+package octodiff
+
+import "sync/atomic"
+
+// RabinKarpRollingChecksum is a polynomial rolling hash; the checksum of a block is the block's bytes treated as
+// the coefficients of a polynomial, evaluated at a fixed base modulo the largest prime below 2^32.
+type RabinKarpRollingChecksum struct {
+	// Rotate needs base^(chunkSize-1), which is expensive to compute for every byte.
+	// Callers usually rotate with the same chunkSize, so we remember the last one we computed. The delta builder
+	// rotates with every chunk length in the signature, so uses rotatorFor instead.
+	lastPower atomic.Pointer[rabinKarpPower]
+}
+
+type rabinKarpPower struct {
+	chunkSize int
+	power     uint64
+}
+
+const RabinKarpRollingChecksumName = "RabinKarp"
+
+const (
+	rabinKarpModulus = uint64(4294967291) // 2^32 - 5
+	rabinKarpBase    = uint64(16777619)
+)
+
+func NewRabinKarpRollingChecksum() *RabinKarpRollingChecksum {
+	return &RabinKarpRollingChecksum{}
+}
+
+func (_ *RabinKarpRollingChecksum) Name() string {
+	return RabinKarpRollingChecksumName
+}
+
+func (_ *RabinKarpRollingChecksum) Calculate(block []byte) uint32 {
+	h := uint64(0)
+	for _, z := range block {
+		h = (h*rabinKarpBase + uint64(z)) % rabinKarpModulus
+	}
+	return uint32(h)
+}
+
+func (r *RabinKarpRollingChecksum) Rotate(checksum uint32, remove byte, add byte, chunkSize int) uint32 {
+	return rabinKarpRotate(checksum, remove, add, r.power(chunkSize))
+}
+
+// rotatorFor does the expensive part of Rotate up front, for a delta builder rotating checksums of more than one
+// chunk size, which would miss the cache in power every time
+func (_ *RabinKarpRollingChecksum) rotatorFor(chunkSize int) func(checksum uint32, remove byte, add byte) uint32 {
+	power := rabinKarpPowerOf(chunkSize)
+	return func(checksum uint32, remove byte, add byte) uint32 {
+		return rabinKarpRotate(checksum, remove, add, power)
+	}
+}
+
+func rabinKarpRotate(checksum uint32, remove byte, add byte, power uint64) uint32 {
+	removed := uint64(remove) * power % rabinKarpModulus
+	h := (uint64(checksum) + rabinKarpModulus - removed) % rabinKarpModulus
+	return uint32((h*rabinKarpBase + uint64(add)) % rabinKarpModulus)
+}
+
+// power returns base^(chunkSize-1) mod modulus
+func (r *RabinKarpRollingChecksum) power(chunkSize int) uint64 {
+	if last := r.lastPower.Load(); last != nil && last.chunkSize == chunkSize {
+		return last.power
+	}
+	result := rabinKarpPowerOf(chunkSize)
+	r.lastPower.Store(&rabinKarpPower{chunkSize: chunkSize, power: result})
+	return result
+}
+
+func rabinKarpPowerOf(chunkSize int) uint64 {
+	result := uint64(1)
+	base := rabinKarpBase
+	for exp := chunkSize - 1; exp > 0; exp >>= 1 {
+		if exp&1 == 1 {
+			result = result * base % rabinKarpModulus
+		}
+		base = base * base % rabinKarpModulus
+	}
+	return result
+}
+
+var _ RollingChecksum = (*RabinKarpRollingChecksum)(nil)
+var _ chunkSizeRotator = (*RabinKarpRollingChecksum)(nil)
@@ -0,0 +1,43 @@
+package octodiff_test
+
+import (
+	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
+	"github.com/OctopusDeploy/go-octodiff/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRabinKarpRollingChecksum_Name(t *testing.T) {
+	c := octodiff.NewRabinKarpRollingChecksum()
+
+	assert.Equal(t, "RabinKarp", c.Name())
+}
+
+func TestRabinKarpRollingChecksum_Calculate(t *testing.T) {
+	c := octodiff.NewRabinKarpRollingChecksum()
+	block := test.TestData()
+
+	assert.Equal(t, uint32(1261987298), c.Calculate(block[:100]))
+	assert.Equal(t, uint32(4166948036), c.Calculate(block[1:101]))
+	assert.Equal(t, uint32(3039791815), c.Calculate(block[2:102]))
+	assert.Equal(t, uint32(1243246815), c.Calculate(block[93:193]))
+	assert.Equal(t, uint32(1752478527), c.Calculate(block))
+
+	largeBlock := test.GenerateTestData(100 * 1024)
+	assert.Equal(t, uint32(1992251588), c.Calculate(largeBlock))
+}
+
+func TestRabinKarpRollingChecksum_RotateMatchesCalculate(t *testing.T) {
+	c := octodiff.NewRabinKarpRollingChecksum()
+	block := test.GenerateTestData(4096)
+
+	for _, chunkSize := range []int{31, 32, 128, 2048} {
+		checksum := c.Calculate(block[:chunkSize])
+		for i := 1; i+chunkSize <= len(block); i++ {
+			checksum = c.Rotate(checksum, block[i-1], block[i+chunkSize-1], chunkSize)
+			if !assert.Equal(t, c.Calculate(block[i:i+chunkSize]), checksum, "chunkSize %d offset %d", chunkSize, i) {
+				break
+			}
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package octodiff
 
+import "sync"
+
 type RollingChecksum interface {
 	Name() string
 	Calculate(block []byte) uint32
@@ -7,3 +9,42 @@ type RollingChecksum interface {
 }
 
 var DefaultChecksumAlgorithm RollingChecksum = NewAdler32RollingChecksum()
+
+// ----------------------------------------------------------------------------
+
+var rollingChecksumsMu sync.RWMutex
+var rollingChecksums = map[string]RollingChecksum{}
+
+// RegisterRollingChecksum makes a RollingChecksum available to SignatureReader, which looks up the
+// algorithm by the name recorded in the signature file.
+// Implementations are shared between readers, so must not hold any per-file state.
+// Like database/sql.Register, it panics if the checksum is nil or the name is already registered.
+func RegisterRollingChecksum(checksum RollingChecksum) {
+	if checksum == nil {
+		panic("octodiff: RegisterRollingChecksum checksum is nil")
+	}
+	rollingChecksumsMu.Lock()
+	defer rollingChecksumsMu.Unlock()
+
+	name := checksum.Name()
+	if _, dup := rollingChecksums[name]; dup {
+		panic("octodiff: RegisterRollingChecksum called twice for " + name)
+	}
+	rollingChecksums[name] = checksum
+}
+
+// LookupRollingChecksum returns the registered RollingChecksum with the given name
+func LookupRollingChecksum(name string) (RollingChecksum, bool) {
+	rollingChecksumsMu.RLock()
+	defer rollingChecksumsMu.RUnlock()
+
+	checksum, ok := rollingChecksums[name]
+	return checksum, ok
+}
+
+func init() {
+	RegisterRollingChecksum(NewAdler32RollingChecksum())
+	RegisterRollingChecksum(NewAdler32RollingChecksumV2())
+	RegisterRollingChecksum(NewBuzhashRollingChecksum())
+	RegisterRollingChecksum(NewRabinKarpRollingChecksum())
+}
@@ -0,0 +1,179 @@
+package octodiff_test
+
+import (
+	"bytes"
+	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
+	"github.com/OctopusDeploy/go-octodiff/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+// byteSumRollingChecksum is a deliberately simple third-party style RollingChecksum, used to check that
+// registered implementations round-trip through signatures and deltas
+type byteSumRollingChecksum struct{}
+
+func (_ *byteSumRollingChecksum) Name() string {
+	return "TestByteSum"
+}
+
+func (_ *byteSumRollingChecksum) Calculate(block []byte) uint32 {
+	sum := uint32(0)
+	for _, z := range block {
+		sum += uint32(z)
+	}
+	return sum
+}
+
+func (_ *byteSumRollingChecksum) Rotate(checksum uint32, remove byte, add byte, chunkSize int) uint32 {
+	return checksum - uint32(remove) + uint32(add)
+}
+
+func init() {
+	octodiff.RegisterRollingChecksum(&byteSumRollingChecksum{})
+}
+
+func TestLookupRollingChecksum(t *testing.T) {
+	for _, name := range []string{"Adler32", "Adler32V2", "TestByteSum"} {
+		checksum, ok := octodiff.LookupRollingChecksum(name)
+		assert.True(t, ok, name)
+		assert.Equal(t, name, checksum.Name())
+	}
+
+	_, ok := octodiff.LookupRollingChecksum("CRC32")
+	assert.False(t, ok)
+}
+
+func TestRegisterRollingChecksum_PanicsOnDuplicate(t *testing.T) {
+	assert.Panics(t, func() {
+		octodiff.RegisterRollingChecksum(octodiff.NewAdler32RollingChecksumV2())
+	})
+}
+
+func TestCustomRollingChecksumRoundTrips(t *testing.T) {
+	original := test.GenerateTestData(128 * 1024)
+
+	var signature bytes.Buffer
+	builder := octodiff.NewSignatureBuilder()
+	builder.RollingChecksumAlgorithm = &byteSumRollingChecksum{}
+	err := builder.Build(bytes.NewReader(original), int64(len(original)), &signature)
+	assert.Nil(t, err)
+
+	s, err := readSignature(signature.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, "TestByteSum", s.RollingChecksumAlgorithm.Name())
+
+	newFile := append([]byte{0xaa}, original...)
+	deltaFile := buildDelta(newFile, signature.Bytes())
+	assert.Less(t, len(deltaFile), 1024) // one prepended byte, everything else should be copied
+
+	reader := octodiff.NewBinaryDeltaReader(bytes.NewReader(deltaFile))
+	var patched bytes.Buffer
+	err = octodiff.ApplyDelta(bytes.NewReader(original), reader, &patched)
+	assert.Nil(t, err)
+	assert.Equal(t, newFile, patched.Bytes())
+}
+
+// countCollisions slides a window over data, and returns the number of distinct window contents which produced
+// a checksum that had already been seen for some other content
+func countCollisions(c octodiff.RollingChecksum, data []byte, windowSize int) int {
+	checksums := make(map[uint32]bool)
+	contents := make(map[string]bool)
+	collisions := 0
+	for i := 0; i+windowSize <= len(data); i++ {
+		window := data[i : i+windowSize]
+		if contents[string(window)] {
+			continue // same content; not a collision
+		}
+		contents[string(window)] = true
+
+		checksum := c.Calculate(window)
+		if checksums[checksum] {
+			collisions++
+		}
+		checksums[checksum] = true
+	}
+	return collisions
+}
+
+// low entropy data made of random 0 and 1 bytes
+func generateLowEntropyData(byteCount int) []byte {
+	r := rand.New(rand.NewSource(1))
+	result := make([]byte, byteCount)
+	for i := range result {
+		result[i] = byte(r.Intn(2))
+	}
+	return result
+}
+
+// mostly zero data with scattered fragments of the test data, like a sparse disk image
+func generateSparseData(byteCount int) []byte {
+	r := rand.New(rand.NewSource(1))
+	fragment := test.TestData()
+	result := make([]byte, byteCount)
+	for i := 0; i < byteCount/4096; i++ {
+		copy(result[r.Intn(byteCount-len(fragment)):], fragment[:r.Intn(len(fragment))])
+	}
+	return result
+}
+
+func TestRollingChecksumCollisions_TestData(t *testing.T) {
+	data := test.GenerateTestData(64 * 1024)
+
+	for _, c := range []octodiff.RollingChecksum{
+		octodiff.NewAdler32RollingChecksum(),
+		octodiff.NewAdler32RollingChecksumV2(),
+		octodiff.NewBuzhashRollingChecksum(),
+		octodiff.NewRabinKarpRollingChecksum(),
+	} {
+		assert.Equal(t, 0, countCollisions(c, data, 128), c.Name())
+	}
+}
+
+func TestRollingChecksumCollisions_LowEntropyData(t *testing.T) {
+	data := generateLowEntropyData(64 * 1024)
+
+	adler := countCollisions(octodiff.NewAdler32RollingChecksum(), data, 128)
+	adlerV2 := countCollisions(octodiff.NewAdler32RollingChecksumV2(), data, 128)
+	buzhash := countCollisions(octodiff.NewBuzhashRollingChecksum(), data, 128)
+	rabinKarp := countCollisions(octodiff.NewRabinKarpRollingChecksum(), data, 128)
+
+	// the adler variants only have a few thousand possible values for windows of this data, so nearly everything collides
+	assert.Greater(t, adler, 40000)
+	assert.Greater(t, adlerV2, 40000)
+	// 65k windows in a 32-bit space; the birthday bound makes a handful of collisions expected
+	assert.Less(t, buzhash, 10)
+	assert.Less(t, rabinKarp, 10)
+}
+
+func TestRollingChecksumCollisions_SparseData(t *testing.T) {
+	data := generateSparseData(128 * 1024)
+
+	adler := countCollisions(octodiff.NewAdler32RollingChecksum(), data, 2048)
+	buzhash := countCollisions(octodiff.NewBuzhashRollingChecksum(), data, 2048)
+	rabinKarp := countCollisions(octodiff.NewRabinKarpRollingChecksum(), data, 2048)
+
+	// adler's sums barely change as a fragment slides through the zeros around it
+	assert.Greater(t, adler, 100)
+	// buzhash gives a fragment the same checksum wherever it sits among the zeros, as long as it moves by a multiple
+	// of 32 bytes, so around 40% of these windows collide; worse than adler. See BuzhashRollingChecksum
+	assert.Greater(t, buzhash, 30000)
+	// ~100k distinct windows in a 32-bit space; the birthday bound makes one or two collisions expected
+	assert.Less(t, rabinKarp, 10)
+}
+
+func TestBuzhashCollidesWhenDataMovesByMultipleOf32(t *testing.T) {
+	c := octodiff.NewBuzhashRollingChecksum()
+	fragment := test.TestData()[:100]
+
+	// the known weakness of a 32-bit cyclic polynomial; see BuzhashRollingChecksum
+	a := make([]byte, 2048)
+	copy(a[500:], fragment)
+	b := make([]byte, 2048)
+	copy(b[532:], fragment)
+	assert.Equal(t, c.Calculate(a), c.Calculate(b))
+
+	// the same doesn't happen for RabinKarp
+	r := octodiff.NewRabinKarpRollingChecksum()
+	assert.NotEqual(t, r.Calculate(a), r.Calculate(b))
+}
@@ -1,9 +1,19 @@
 package octodiff
 
+import "math"
+
 type Signature struct {
 	HashAlgorithm            HashAlgorithm
 	RollingChecksumAlgorithm RollingChecksum
 	Chunks                   []*ChunkSignature
+
+	// BasisLength and BasisHash identify the whole basis file. BasisHash is nil unless the signature was
+	// built with SignatureBuilder.RecordBasisIdentity
+	BasisLength int64
+	BasisHash   []byte
+
+	// ContentDefinedChunking holds the parameters the chunks were cut with, or is nil if they are all the same size
+	ContentDefinedChunking *ContentDefinedChunking
 }
 
 type ChunkSignature struct {
@@ -13,4 +23,27 @@ type ChunkSignature struct {
 	Length          uint16
 	Hash            []byte
 	RollingChecksum uint32
+
+	// LargeLength is the length of a chunk which is too long for Length, which only signatures with large chunks can
+	// have. Length is zero for these chunks, and LargeLength is zero for all the others; ChunkLength returns either.
+	LargeLength uint32
+}
+
+// ChunkLength returns the length of the chunk, from Length or LargeLength
+func (c *ChunkSignature) ChunkLength() int {
+	if c.LargeLength != 0 {
+		return int(c.LargeLength)
+	}
+	return int(c.Length)
+}
+
+// setChunkLength sets Length, or LargeLength if the length doesn't fit
+func (c *ChunkSignature) setChunkLength(length int) {
+	if length > math.MaxUint16 {
+		c.Length = 0
+		c.LargeLength = uint32(length)
+	} else {
+		c.Length = uint16(length)
+		c.LargeLength = 0
+	}
 }
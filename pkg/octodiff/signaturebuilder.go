@@ -3,20 +3,67 @@ package octodiff
 import (
 	"encoding/binary"
 	"errors"
+	"hash"
 	"io"
+	"math"
+	"sync"
 )
 
 const (
 	SignatureMinimumChunkSize = 128
 	SignatureDefaultChunkSize = 2048
 	SignatureMaximumChunkSize = 31 * 1024
+
+	// SignatureMaximumLargeChunkSize is the largest ChunkSize allowed with SignatureBuilder.LargeChunks
+	SignatureMaximumLargeChunkSize = 16 * 1024 * 1024
+
+	// SignatureAutoChunkSize as the ChunkSize makes Build pick one with ChooseChunkSize
+	SignatureAutoChunkSize = -1
 )
 
 type SignatureBuilder struct {
+	// ChunkSize is how many bytes of the input each chunk covers. SignatureAutoChunkSize has Build choose one from
+	// the length of the input.
 	ChunkSize                int
 	HashAlgorithm            HashAlgorithm    // must be non-null
 	RollingChecksumAlgorithm RollingChecksum  // must be non-null
 	ProgressReporter         ProgressReporter // must be non-null
+
+	// RecordBasisIdentity writes the length and hash of the whole basis file into the signature, which lets deltas
+	// built from it be checked against the basis before patching. This needs the version 2 format.
+	RecordBasisIdentity bool
+
+	// Concurrency is how many goroutines Build hashes chunks on. With more than one, the input is read ahead in
+	// batches of chunks, which are hashed in parallel and written out in order, giving the same signature as a
+	// serial build. HashAlgorithm and RollingChecksumAlgorithm must be safe for concurrent use, which the built-in
+	// ones are. Zero or one hashes each chunk as it is read, on the calling goroutine.
+	Concurrency int
+
+	// ContentDefinedChunking cuts chunks where FastCDC finds a boundary in the content, rather than every ChunkSize
+	// bytes, and ChunkSize is ignored. The parameters are recorded in the signature, so DeltaBuilder can cut the new
+	// file in the same places. This needs the version 2 format.
+	ContentDefinedChunking *ContentDefinedChunking
+
+	// LargeChunks writes the length of each chunk in 32 bits rather than 16, which allows a ChunkSize, or a
+	// ContentDefinedChunking.MaxChunkSize, of up to SignatureMaximumLargeChunkSize. Huge files need large chunks to
+	// keep their signatures to a manageable size. This needs the version 2 format.
+	LargeChunks bool
+}
+
+// signatureBatchChunks is how many chunks each job in a concurrent build hashes, so that the hand-offs between
+// goroutines don't cost more than hashing small chunks. Batches of large chunks have fewer, to bound the memory
+// used to signatureBatchSize per batch.
+const (
+	signatureBatchChunks = 64
+	signatureBatchSize   = 16 * 1024 * 1024
+)
+
+// maximumChunkLength is the longest chunk the signature format can record
+func maximumChunkLength(largeChunks bool) int {
+	if largeChunks {
+		return SignatureMaximumLargeChunkSize
+	}
+	return math.MaxUint16
 }
 
 func NewSignatureBuilder() *SignatureBuilder {
@@ -28,40 +75,265 @@ func NewSignatureBuilder() *SignatureBuilder {
 	}
 }
 
+// ChooseChunkSize picks a chunk size for an input of inputLength bytes. Small chunks find more of the basis in the
+// new file, but each chunk adds to the signature, so like rsync we use the square root of the length, which keeps
+// both the signature and the unmatched data around each change in proportion. It is never less than
+// SignatureDefaultChunkSize, so files up to 4MB are chunked as they always have been, and never more than
+// SignatureMaximumChunkSize, which is reached at 1GB.
+func ChooseChunkSize(inputLength int64) int {
+	return chooseChunkSize(inputLength, SignatureMaximumChunkSize)
+}
+
+// ChooseLargeChunkSize is ChooseChunkSize for SignatureBuilder.LargeChunks, so keeps growing past 1GB. A 200GB file
+// gets chunks of around 450KB, and a signature of around 13MB with SHA1.
+func ChooseLargeChunkSize(inputLength int64) int {
+	return chooseChunkSize(inputLength, SignatureMaximumLargeChunkSize)
+}
+
+func chooseChunkSize(inputLength int64, maximum int) int {
+	chunkSize := int(math.Ceil(math.Sqrt(float64(inputLength))))
+	// round up to a multiple of the minimum, to keep the sizes tidy
+	chunkSize = (chunkSize + SignatureMinimumChunkSize - 1) / SignatureMinimumChunkSize * SignatureMinimumChunkSize
+	if chunkSize < SignatureDefaultChunkSize {
+		return SignatureDefaultChunkSize
+	}
+	if chunkSize > maximum {
+		return maximum
+	}
+	return chunkSize
+}
+
 func (s *SignatureBuilder) Build(input io.Reader, inputLength int64, output io.Writer) error {
-	err := s.ensureValid()
+	if s.ChunkSize == SignatureAutoChunkSize && s.ContentDefinedChunking == nil {
+		// work on a copy, so the builder can be used again for an input of a different length
+		sized := *s
+		sized.ChunkSize = ChooseChunkSize(inputLength)
+		if s.LargeChunks {
+			sized.ChunkSize = ChooseLargeChunkSize(inputLength)
+		}
+		return sized.Build(input, inputLength, output)
+	}
+
+	s.ProgressReporter.ReportProgress("Hashing file", 0, inputLength)
+	writer, err := s.NewWriter(output)
 	if err != nil {
 		return err
 	}
-	err = s.writeMetadata(inputLength, output)
-	if err != nil {
+	s.ProgressReporter.ReportProgress("Hashing file", inputLength, inputLength)
+
+	s.ProgressReporter.ReportProgress("Building signatures", 0, inputLength)
+	if s.Concurrency > 1 {
+		err = s.writeChunkSignaturesConcurrently(input, inputLength, writer)
+		if err != nil {
+			return err
+		}
+		return writer.Close()
+	}
+
+	// read a chunk at a time; with content defined chunking ChunkSize may well be zero, and the writer cuts the
+	// chunks wherever they fall in what it is given
+	start := int64(0)
+	iter := NewReaderIteratorSize(input, s.chunker().maxChunkLength())
+	for iter.Next() {
+		_, err = writer.Write(iter.Current)
+		if err != nil {
+			return err
+		}
+		start += int64(len(iter.Current))
+		s.ProgressReporter.ReportProgress("Building signatures", start, inputLength)
+	}
+	if err := iter.Err(); err != nil {
 		return err
 	}
-	err = s.writeChunkSignatures(input, inputLength, output)
+	return writer.Close()
+}
+
+// NewWriter writes the signature metadata to output, then returns a SignatureWriter which writes the signature of
+// whatever is written to it. Unlike Build, this doesn't report progress, as the length of the input isn't known.
+func (s *SignatureBuilder) NewWriter(output io.Writer) (*SignatureWriter, error) {
+	err := s.ensureValid()
+	if err != nil {
+		return nil, err
+	}
+	err = s.writeMetadata(output)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &SignatureWriter{
+		output:          output,
+		chunker:         s.chunker(),
+		largeChunks:     s.LargeChunks,
+		hashAlgorithm:   s.HashAlgorithm,
+		rollingChecksum: s.RollingChecksumAlgorithm,
+	}
+	if s.RecordBasisIdentity {
+		w.basisHash = s.HashAlgorithm.NewHash()
+	}
+	return w, nil
+}
+
+func (s *SignatureBuilder) chunker() chunker {
+	return chunker{chunkSize: s.ChunkSize, contentDefined: s.ContentDefinedChunking}
+}
+
+type signatureBatch struct {
+	data      []byte
+	lengths   []int
+	hashes    [][]byte
+	checksums []uint32
+	done      chan struct{}
+}
+
+// writeChunkSignaturesConcurrently reads batches of chunks on one goroutine, hashes them on a pool of workers, and
+// writes them to writer in the order they were read
+func (s *SignatureBuilder) writeChunkSignaturesConcurrently(input io.Reader, inputLength int64, writer *SignatureWriter) error {
+	work := make(chan *signatureBatch, s.Concurrency)
+	ordered := make(chan *signatureBatch, s.Concurrency*2) // bounds how far ahead of the writer we read
+	stop := make(chan struct{})
+
+	var workers sync.WaitGroup
+	for i := 0; i < s.Concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for batch := range work {
+				offset := 0
+				for _, length := range batch.lengths {
+					chunk := batch.data[offset : offset+length]
+					offset += length
+					batch.hashes = append(batch.hashes, s.HashAlgorithm.HashOverData(chunk))
+					batch.checksums = append(batch.checksums, s.RollingChecksumAlgorithm.Calculate(chunk))
+				}
+				close(batch.done)
+			}
+		}()
+	}
+
+	var readErr error
+	go func() {
+		defer close(ordered)
+		defer close(work)
+		chunker := s.chunker()
+		maxChunkLength := chunker.maxChunkLength()
+		batchChunks := signatureBatchChunks
+		if maxChunkLength*batchChunks > signatureBatchSize {
+			batchChunks = signatureBatchSize / maxChunkLength
+			if batchChunks < 1 {
+				batchChunks = 1
+			}
+		}
+		var carried []byte
+		for {
+			// each batch needs its own buffer, as it's still being hashed while we read the next one
+			buffer := make([]byte, maxChunkLength*batchChunks)
+			carriedLength := copy(buffer, carried)
+			n, err := io.ReadFull(input, buffer[carriedLength:])
+			atEnd := err == io.EOF || err == io.ErrUnexpectedEOF
+			if err != nil && !atEnd {
+				readErr = err
+				return
+			}
+
+			// cut the chunks we have all of; the rest is carried over to the next batch
+			data := buffer[:carriedLength+n]
+			batch := &signatureBatch{done: make(chan struct{})}
+			offset := 0
+			for offset < len(data) && (atEnd || len(data)-offset >= maxChunkLength) {
+				length := chunker.nextChunkLength(data[offset:])
+				batch.lengths = append(batch.lengths, length)
+				offset += length
+			}
+			batch.data = data[:offset]
+			carried = data[offset:]
+
+			if offset > 0 {
+				select {
+				case ordered <- batch:
+				case <-stop:
+					return
+				}
+				work <- batch
+			}
+			if atEnd {
+				return
+			}
+		}
+	}()
+
+	var err error
+	start := int64(0)
+	for batch := range ordered {
+		<-batch.done
+		if err != nil {
+			continue // drain, so the reader isn't left blocked
+		}
+		offset := 0
+		for i, hash := range batch.hashes {
+			length := batch.lengths[i]
+			err = writer.writeHashedChunk(batch.data[offset:offset+length], hash, batch.checksums[i])
+			if err != nil {
+				close(stop)
+				break
+			}
+			offset += length
+		}
+		start += int64(len(batch.data))
+		s.ProgressReporter.ReportProgress("Building signatures", start, inputLength)
+	}
+	workers.Wait()
+
 	if err != nil {
 		return err
 	}
-	return nil
+	return readErr // safe to read, as the reader closed ordered after setting it
 }
 
 func (s *SignatureBuilder) ensureValid() error {
+	if s.ContentDefinedChunking != nil {
+		return s.ContentDefinedChunking.validate(maximumChunkLength(s.LargeChunks))
+	}
+	if s.ChunkSize == SignatureAutoChunkSize {
+		return errors.New("SignatureBuilder can only choose the ChunkSize when it knows the length of the input; use Build, or ChooseChunkSize")
+	}
 	if s.ChunkSize < SignatureMinimumChunkSize {
 		return errors.New("SignatureBuilder ChunkSize is less than minimum allowed")
 	}
-	if s.ChunkSize > SignatureMaximumChunkSize {
+	if s.ChunkSize > SignatureMaximumChunkSize && !s.LargeChunks {
+		return errors.New("SignatureBuilder ChunkSize is greater than maximum allowed; LargeChunks allows larger ones")
+	}
+	if s.ChunkSize > SignatureMaximumLargeChunkSize {
 		return errors.New("SignatureBuilder ChunkSize is greater than maximum allowed")
 	}
 	return nil
 }
 
-func (s *SignatureBuilder) writeMetadata(inputLength int64, output io.Writer) error {
-	s.ProgressReporter.ReportProgress("Hashing file", 0, inputLength)
+func (s *SignatureBuilder) flags() SignatureFlags {
+	flags := SignatureFlags(0)
+	if s.RecordBasisIdentity {
+		flags |= SignatureFlagBasisIdentity
+	}
+	if s.ContentDefinedChunking != nil {
+		flags |= SignatureFlagContentDefinedChunks
+	}
+	if s.LargeChunks {
+		flags |= SignatureFlagLargeChunks
+	}
+	return flags
+}
+
+func (s *SignatureBuilder) writeMetadata(output io.Writer) error {
+	flags := s.flags()
 
 	_, err := output.Write(BinarySignatureHeader)
 	if err != nil {
 		return err
 	}
-	_, err = output.Write(BinaryVersion)
+	if flags == 0 {
+		_, err = output.Write(BinaryVersion)
+	} else {
+		_, err = output.Write(BinarySignatureVersion2)
+	}
 	if err != nil {
 		return err
 	}
@@ -73,37 +345,140 @@ func (s *SignatureBuilder) writeMetadata(inputLength int64, output io.Writer) er
 	if err != nil {
 		return err
 	}
-	_, err = output.Write(BinaryEndOfMetadata)
-	if err != nil {
-		return err
+	if flags != 0 {
+		_, err = output.Write([]byte{byte(flags)})
+		if err != nil {
+			return err
+		}
 	}
+	if flags&SignatureFlagContentDefinedChunks != 0 {
+		c := s.ContentDefinedChunking
+		err = binary.Write(output, binary.LittleEndian, []uint32{uint32(c.MinChunkSize), uint32(c.AverageChunkSize), uint32(c.MaxChunkSize)})
+		if err != nil {
+			return err
+		}
+	}
+	_, err = output.Write(BinaryEndOfMetadata)
+	return err
+}
 
-	s.ProgressReporter.ReportProgress("Hashing file", inputLength, inputLength)
-	return nil
+// ----------------------------------------------------------------------------
+
+// SignatureWriter is an io.WriteCloser which writes the signature of the data written to it. Teeing a file into one
+// as it is written, for example the output of ApplyDelta through an io.MultiWriter, gives its signature without
+// reading the file back in. Close must be called to write the signature of the last chunk.
+type SignatureWriter struct {
+	output          io.Writer
+	chunker         chunker
+	largeChunks     bool
+	hashAlgorithm   HashAlgorithm
+	rollingChecksum RollingChecksum
+	basisHash       hash.Hash
+
+	chunk  []byte
+	length int64
+	closed bool
 }
 
-func (s *SignatureBuilder) writeChunkSignatures(input io.Reader, inputLength int64, output io.Writer) error {
-	checksumAlgorithm := s.RollingChecksumAlgorithm
-	hashAlgorithm := s.HashAlgorithm
+var _ io.WriteCloser = (*SignatureWriter)(nil)
 
-	s.ProgressReporter.ReportProgress("Building signatures", 0, inputLength)
+func (w *SignatureWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("octodiff.SignatureWriter: write after close")
+	}
+	n := len(p)
+	maxChunkLength := w.chunker.maxChunkLength()
 
-	start := int64(0)
-	iter := NewReaderIteratorSize(input, s.ChunkSize)
-	for iter.Next() {
-		err := writeChunk(output, iter.Current, hashAlgorithm.HashOverData(iter.Current), checksumAlgorithm.Calculate(iter.Current))
+	// the chunker needs a whole chunk's worth to find a boundary, so top up what's left from earlier writes first,
+	// then cut chunks straight from p. If a chunk can't be written, what it took from p hasn't been consumed
+	for len(w.chunk) > 0 {
+		take := maxChunkLength - len(w.chunk)
+		if take > len(p) {
+			w.chunk = append(w.chunk, p...)
+			return n, nil
+		}
+		buffered := len(w.chunk)
+		w.chunk = append(w.chunk, p[:take]...)
+
+		length := w.chunker.nextChunkLength(w.chunk)
+		err := w.writeChunk(w.chunk[:length])
+		if err != nil {
+			w.chunk = w.chunk[:buffered]
+			return n - len(p), err
+		}
+		p = p[take:]
+		w.chunk = append(w.chunk[:0], w.chunk[length:]...)
+	}
+	for len(p) >= maxChunkLength {
+		length := w.chunker.nextChunkLength(p)
+		err := w.writeChunk(p[:length])
+		if err != nil {
+			return n - len(p), err
+		}
+		p = p[length:]
+	}
+	if len(p) > 0 {
+		if w.chunk == nil {
+			w.chunk = make([]byte, 0, maxChunkLength)
+		}
+		w.chunk = append(w.chunk, p...)
+	}
+	return n, nil
+}
+
+// Close writes the signatures of the chunks left over from the last write, and the basis identity if the signature
+// records it. It does not close the output.
+func (w *SignatureWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	for len(w.chunk) > 0 {
+		length := w.chunker.nextChunkLength(w.chunk)
+		err := w.writeChunk(w.chunk[:length])
 		if err != nil {
 			return err
 		}
+		w.chunk = w.chunk[length:]
+	}
+	if w.basisHash != nil {
+		return writeBasisIdentity(w.output, w.length, w.basisHash.Sum(nil))
+	}
+	return nil
+}
 
-		start += int64(len(iter.Current))
-		s.ProgressReporter.ReportProgress("Building signatures", start, inputLength)
+func (w *SignatureWriter) writeChunk(block []byte) error {
+	return w.writeHashedChunk(block, w.hashAlgorithm.HashOverData(block), w.rollingChecksum.Calculate(block))
+}
+
+func (w *SignatureWriter) writeHashedChunk(block []byte, hash []byte, rollingChecksum uint32) error {
+	err := writeChunk(w.output, block, hash, rollingChecksum, w.largeChunks)
+	if err != nil {
+		return err
 	}
-	return iter.Err()
+	if w.basisHash != nil {
+		_, _ = w.basisHash.Write(block) // hash.Hash never returns an error
+	}
+	w.length += int64(len(block))
+	return nil
+}
+
+func writeBasisIdentity(output io.Writer, basisLength int64, basisHash []byte) error {
+	err := binary.Write(output, binary.LittleEndian, basisLength)
+	if err != nil {
+		return err
+	}
+	return writeHash(output, basisHash)
 }
 
-func writeChunk(output io.Writer, block []byte, hash []byte, rollingChecksum uint32) error {
-	err := binary.Write(output, binary.LittleEndian, uint16(len(block)))
+func writeChunk(output io.Writer, block []byte, hash []byte, rollingChecksum uint32, largeChunks bool) error {
+	var err error
+	if largeChunks {
+		err = binary.Write(output, binary.LittleEndian, uint32(len(block)))
+	} else {
+		err = binary.Write(output, binary.LittleEndian, uint16(len(block)))
+	}
 	if err != nil {
 		return err
 	}
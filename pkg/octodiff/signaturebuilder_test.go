@@ -3,9 +3,11 @@ package octodiff_test
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
 	"github.com/OctopusDeploy/go-octodiff/pkg/test"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"testing"
 )
 
@@ -64,3 +66,234 @@ func TestBuildSignatureWithAdlerV2(t *testing.T) {
 
 	assert.Equal(t, "4f43544f5349470104534841310941646c6572333256323e3e3e0802f79fe5f8330bd06982d3b5dbda6c1a6ad16687a0cdb03c0d", hex.EncodeToString(result))
 }
+
+func TestBuildSignatureWithBasisIdentity(t *testing.T) {
+	b := octodiff.NewSignatureBuilder()
+	b.RecordBasisIdentity = true
+	result := buildSignatureBuilder(b, test.TestData())
+
+	assert.Equal(t, "4f43544f5349470204534841310741646c65723332013e3e3e"+ // version 2 header with flags of 0x01
+		"0802f79fa2f0330bd06982d3b5dbda6c1a6ad16687a0cdb03c0d"+ // the same chunk as the version 1 format
+		"0802000000000000"+ // basis length
+		"14000000330bd06982d3b5dbda6c1a6ad16687a0cdb03c0d", // basis hash; the same as the one chunk
+		hex.EncodeToString(result))
+}
+
+func TestSignatureWriterMatchesBuildForAnyWriteSize(t *testing.T) {
+	input := test.GenerateTestData(100*1024 + 123)
+
+	for _, recordBasisIdentity := range []bool{false, true} {
+		b := octodiff.NewSignatureBuilder()
+		b.RecordBasisIdentity = recordBasisIdentity
+		expected := buildSignatureBuilder(b, input)
+
+		for _, writeSize := range []int{1, 100, 2048, 5000, len(input)} {
+			var output bytes.Buffer
+			writer, err := b.NewWriter(&output)
+			assert.Nil(t, err)
+			for offset := 0; offset < len(input); offset += writeSize {
+				end := offset + writeSize
+				if end > len(input) {
+					end = len(input)
+				}
+				n, err := writer.Write(input[offset:end])
+				assert.Nil(t, err)
+				assert.Equal(t, end-offset, n)
+			}
+			assert.Nil(t, writer.Close())
+			assert.Equal(t, expected, output.Bytes(), "write size %d", writeSize)
+		}
+	}
+}
+
+func TestSignatureWriterOverEmptyInput(t *testing.T) {
+	b := octodiff.NewSignatureBuilder()
+	var output bytes.Buffer
+	writer, err := b.NewWriter(&output)
+	assert.Nil(t, err)
+	assert.Nil(t, writer.Close())
+
+	assert.Equal(t, buildSignatureBuilder(b, nil), output.Bytes())
+}
+
+type failingWriter struct {
+	remaining int
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > f.remaining {
+		n := f.remaining
+		f.remaining = 0
+		return n, errors.New("disk full")
+	}
+	f.remaining -= len(p)
+	return len(p), nil
+}
+
+func TestSignatureWriterReportsHowMuchWasWrittenOnError(t *testing.T) {
+	input := test.GenerateTestData(10 * octodiff.SignatureDefaultChunkSize)
+	b := octodiff.NewSignatureBuilder()
+	headerLength := len(buildSignatureBuilder(b, nil))
+	chunkSignatureLength := 2 + 4 + octodiff.DefaultHashAlgorithm.HashLength()
+
+	// room for the header and three chunks, so the fourth fails
+	writer, err := b.NewWriter(&failingWriter{remaining: headerLength + 3*chunkSignatureLength})
+	assert.Nil(t, err)
+	n, err := writer.Write(input)
+	assert.EqualError(t, err, "disk full")
+	assert.Equal(t, 3*octodiff.SignatureDefaultChunkSize, n)
+
+	// and the same when the chunk that fails was started by an earlier write
+	writer, err = b.NewWriter(&failingWriter{remaining: headerLength + 3*chunkSignatureLength})
+	assert.Nil(t, err)
+	n, err = writer.Write(input[:1000])
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, n)
+	n, err = writer.Write(input[1000:])
+	assert.EqualError(t, err, "disk full")
+	assert.Equal(t, 3*octodiff.SignatureDefaultChunkSize-1000, n)
+}
+
+func TestSignatureOfPatchedFileWhileApplyingDelta(t *testing.T) {
+	basis, newFile := buildPatchedFileTestData()
+	delta := buildDelta(newFile, buildSignature(basis))
+
+	var signature bytes.Buffer
+	signatureWriter, err := octodiff.NewSignatureBuilder().NewWriter(&signature)
+	assert.Nil(t, err)
+
+	var output bytes.Buffer
+	err = octodiff.ApplyDeltaAndVerify(bytes.NewReader(basis), octodiff.NewBinaryDeltaReader(bytes.NewReader(delta)), io.MultiWriter(&output, signatureWriter))
+	assert.Nil(t, err)
+	assert.Nil(t, signatureWriter.Close())
+
+	assert.Equal(t, newFile, output.Bytes())
+	assert.Equal(t, buildSignature(newFile), signature.Bytes())
+}
+
+func TestConcurrentBuildMatchesSerialBuild(t *testing.T) {
+	for _, length := range []int{0, 1000, 2048 * 64, 2048*64*3 + 17, 1024*1024 + 5} {
+		input := test.GenerateTestData(length)
+		for _, recordBasisIdentity := range []bool{false, true} {
+			serial := octodiff.NewSignatureBuilder()
+			serial.RecordBasisIdentity = recordBasisIdentity
+			expected := buildSignatureBuilder(serial, input)
+
+			for _, concurrency := range []int{2, 3, 8} {
+				b := octodiff.NewSignatureBuilder()
+				b.RecordBasisIdentity = recordBasisIdentity
+				b.Concurrency = concurrency
+				assert.Equal(t, expected, buildSignatureBuilder(b, input), "length %d, concurrency %d", length, concurrency)
+			}
+		}
+	}
+}
+
+type failingReader struct {
+	remaining int
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.remaining == 0 {
+		return 0, errors.New("disk on fire")
+	}
+	if len(p) > f.remaining {
+		p = p[:f.remaining]
+	}
+	f.remaining -= len(p)
+	return len(p), nil
+}
+
+func TestConcurrentBuildReportsReadErrors(t *testing.T) {
+	b := octodiff.NewSignatureBuilder()
+	b.Concurrency = 4
+
+	err := b.Build(&failingReader{remaining: 1024 * 1024}, 2*1024*1024, io.Discard)
+	assert.EqualError(t, err, "disk on fire")
+}
+
+func TestChooseChunkSize(t *testing.T) {
+	assert.Equal(t, octodiff.SignatureDefaultChunkSize, octodiff.ChooseChunkSize(0))
+	assert.Equal(t, octodiff.SignatureDefaultChunkSize, octodiff.ChooseChunkSize(4*1024*1024))
+	assert.Equal(t, 2176, octodiff.ChooseChunkSize(4*1024*1024+1))
+	assert.Equal(t, 10240, octodiff.ChooseChunkSize(100*1024*1024))
+	assert.Equal(t, octodiff.SignatureMaximumChunkSize, octodiff.ChooseChunkSize(1024*1024*1024))
+	assert.Equal(t, octodiff.SignatureMaximumChunkSize, octodiff.ChooseChunkSize(100*1024*1024*1024))
+}
+
+func TestBuildSignatureWithAutoChunkSize(t *testing.T) {
+	input := test.GenerateTestData(9 * 1024 * 1024)
+
+	b := octodiff.NewSignatureBuilder()
+	b.ChunkSize = octodiff.SignatureAutoChunkSize
+	result := buildSignatureBuilder(b, input)
+	assert.Equal(t, octodiff.SignatureAutoChunkSize, b.ChunkSize) // the builder can be used again
+
+	sized := octodiff.NewSignatureBuilder()
+	sized.ChunkSize = octodiff.ChooseChunkSize(int64(len(input)))
+	assert.Equal(t, 3072, sized.ChunkSize)
+	assert.Equal(t, buildSignatureBuilder(sized, input), result)
+}
+
+func TestBuildRejectsZeroChunkSize(t *testing.T) {
+	// automatic chunk sizes have to be asked for, so a builder without a ChunkSize fails as it always has
+	b := octodiff.NewSignatureBuilder()
+	b.ChunkSize = 0
+	err := b.Build(bytes.NewReader(test.TestData()), int64(len(test.TestData())), &bytes.Buffer{})
+	assert.EqualError(t, err, "SignatureBuilder ChunkSize is less than minimum allowed")
+}
+
+func TestSignatureWriterCantChooseChunkSize(t *testing.T) {
+	b := octodiff.NewSignatureBuilder()
+	b.ChunkSize = octodiff.SignatureAutoChunkSize
+	_, err := b.NewWriter(&bytes.Buffer{})
+	assert.EqualError(t, err, "SignatureBuilder can only choose the ChunkSize when it knows the length of the input; use Build, or ChooseChunkSize")
+}
+
+func TestBuildSignatureWithLargeChunks(t *testing.T) {
+	b := octodiff.NewSignatureBuilder()
+	b.LargeChunks = true
+	result := buildSignatureBuilder(b, test.TestData())
+
+	assert.Equal(t, "4f43544f5349470204534841310741646c65723332043e3e3e"+ // version 2 header with flags of 0x04
+		"08020000f79fa2f0330bd06982d3b5dbda6c1a6ad16687a0cdb03c0d", // the same chunk as the version 1 format, with a 32 bit length
+		hex.EncodeToString(result))
+}
+
+func TestLargeChunksAllowLargerChunkSizes(t *testing.T) {
+	input := test.GenerateTestData(3*1024*1024 + 5)
+
+	b := octodiff.NewSignatureBuilder()
+	b.ChunkSize = 1024 * 1024
+	_, err := b.NewWriter(&bytes.Buffer{})
+	assert.EqualError(t, err, "SignatureBuilder ChunkSize is greater than maximum allowed; LargeChunks allows larger ones")
+
+	b.LargeChunks = true
+	signature, err := readSignature(buildSignatureBuilder(b, input))
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(signature.Chunks))
+	// the first chunk is too long for Length, so has a LargeLength instead. The last one fits
+	assert.Equal(t, uint16(0), signature.Chunks[0].Length)
+	assert.Equal(t, uint32(1024*1024), signature.Chunks[0].LargeLength)
+	assert.Equal(t, 1024*1024, signature.Chunks[0].ChunkLength())
+	assert.Equal(t, octodiff.DefaultHashAlgorithm.HashOverData(input[:1024*1024]), signature.Chunks[0].Hash)
+	assertChunk(t, signature.Chunks[3], 3*1024*1024, signature.Chunks[3].RollingChecksum, 5, hex.EncodeToString(octodiff.DefaultHashAlgorithm.HashOverData(input[3*1024*1024:])))
+	assert.Equal(t, uint32(0), signature.Chunks[3].LargeLength)
+
+	// more chunks than fit in a batch of a concurrent build
+	b.Concurrency = 3
+	serial := octodiff.NewSignatureBuilder()
+	serial.ChunkSize = 1024 * 1024
+	serial.LargeChunks = true
+	assert.Equal(t, buildSignatureBuilder(serial, input), buildSignatureBuilder(b, input))
+
+	b.ChunkSize = octodiff.SignatureMaximumLargeChunkSize + 1
+	_, err = b.NewWriter(&bytes.Buffer{})
+	assert.EqualError(t, err, "SignatureBuilder ChunkSize is greater than maximum allowed")
+}
+
+func TestChooseLargeChunkSize(t *testing.T) {
+	assert.Equal(t, octodiff.SignatureDefaultChunkSize, octodiff.ChooseLargeChunkSize(1024))
+	assert.Equal(t, octodiff.ChooseChunkSize(100*1024*1024), octodiff.ChooseLargeChunkSize(100*1024*1024))
+	assert.Equal(t, 463488, octodiff.ChooseLargeChunkSize(200*1024*1024*1024))
+}
@@ -0,0 +1,767 @@
+package octodiff
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"sort"
+	"sync"
+)
+
+// A signature index holds the chunks of a signature sorted by rolling checksum, so a delta can be built by reading
+// the chunks it needs from disk rather than holding them all in memory. After the metadata, each chunk is a fixed
+// size entry: the rolling checksum and length as uint32s, the start offset as an int64, then the hash. The entries
+// are sorted by rolling checksum, length, hash then start offset, so a chunk can be binary searched for however many
+// share its checksum. The entries are followed by tables which DeltaBuilder keeps in memory:
+//
+//   - the number of distinct chunk lengths as a uint32, then each length as a uint32, longest first
+//   - the number of bucket bits as a byte, then the index of the first entry in each bucket, and the number of
+//     entries, as uint64s. Entries are bucketed by the top bits of their rolling checksum
+//   - the number of filter bits as a byte, then the filter, as uint64s. It has a bit set for each rolling checksum
+//
+// The metadata includes the SHA256 of the signature file, so the index can be checked against it.
+// The index ends with the number of entries and the offset of the tables, as int64s. All numbers are little endian.
+// Entries are never changed once written, and are all the same size, so the index can be memory mapped.
+
+// DefaultSignatureIndexRunSize is how many chunks SignatureIndexBuilder sorts in memory at a time, by default
+const DefaultSignatureIndexRunSize = 1 << 20
+
+// aim for this many entries in each bucket, so finding a chunk reads a few KB of the index
+const signatureIndexBucketEntries = 32
+
+// and this many filter bits for each entry, so a position in the new file which doesn't match anything rarely
+// has to read the index
+const signatureIndexFilterBitsPerEntry = 64
+
+const signatureIndexFooterSize = 16
+
+// signatureIndexHashAlgorithm hashes the signature file an index is built from
+var signatureIndexHashAlgorithm HashAlgorithm = &Sha256HashAlgorithm{}
+
+var errContentDefinedSignatureIndex = errors.New("signatures built with content defined chunking can't be indexed")
+
+type SignatureIndexBuilder struct {
+	ProgressReporter ProgressReporter // must be non-null
+
+	// RunSize is how many chunks are sorted in memory at a time. Zero means DefaultSignatureIndexRunSize.
+	// Signatures with more chunks than this are sorted in runs, which are written to temporary files then merged.
+	RunSize int
+	// TempDirectory is where the runs are written. Empty means the default directory for temporary files.
+	TempDirectory string
+}
+
+func NewSignatureIndexBuilder() *SignatureIndexBuilder {
+	return &SignatureIndexBuilder{
+		ProgressReporter: NopProgressReporter(),
+	}
+}
+
+// Build reads a signature, and writes an index of its chunks to output.
+// Signatures built with content defined chunking can't be indexed, as their chunks are looked up by hash instead.
+func (b *SignatureIndexBuilder) Build(signatureFile io.Reader, signatureFileLength int64, output io.Writer) error {
+	runSize := b.RunSize
+	if runSize <= 0 {
+		runSize = DefaultSignatureIndexRunSize
+	}
+
+	var runs []*os.File
+	defer func() {
+		for _, run := range runs {
+			_ = run.Close()
+			_ = os.Remove(run.Name())
+		}
+	}()
+
+	var run []indexEntry
+	var hashes []byte // the hashes of the entries in run, so they don't need an allocation each
+	writeRun := func() error {
+		sortIndexEntries(run)
+		file, err := os.CreateTemp(b.TempDirectory, "octodiff-index-*")
+		if err != nil {
+			return err
+		}
+		runs = append(runs, file)
+
+		writer := bufio.NewWriterSize(file, 64*1024)
+		var record []byte
+		for _, entry := range run {
+			record = entry.appendTo(record[:0])
+			_, err = writer.Write(record)
+			if err != nil {
+				return err
+			}
+		}
+		err = writer.Flush()
+		if err != nil {
+			return err
+		}
+		_, err = file.Seek(0, io.SeekStart)
+		run = run[:0]
+		hashes = hashes[:0]
+		return err
+	}
+
+	// the hash of the signature file ties the index to it, so it can't be used with some other signature
+	signatureHash := signatureIndexHashAlgorithm.NewHash()
+	signatureInput := io.TeeReader(signatureFile, signatureHash)
+
+	chunkCount := int64(0)
+	signatureReader := NewSignatureReader()
+	signatureReader.ProgressReporter = b.ProgressReporter
+	signature, err := signatureReader.readSignature(signatureInput, signatureFileLength, func(signature *Signature, chunk *ChunkSignature) error {
+		if signature.ContentDefinedChunking != nil {
+			return errContentDefinedSignatureIndex
+		}
+		if len(run) == runSize {
+			err := writeRun()
+			if err != nil {
+				return err
+			}
+		}
+		if hashes == nil {
+			// every hash is the same length, so this never grows and the entries' hashes stay put
+			hashes = make([]byte, 0, runSize*len(chunk.Hash))
+		}
+		hashStart := len(hashes)
+		hashes = append(hashes, chunk.Hash...)
+		run = append(run, indexEntry{
+			checksum:    chunk.RollingChecksum,
+			length:      uint32(chunk.ChunkLength()),
+			startOffset: chunk.StartOffset,
+			hash:        hashes[hashStart:len(hashes):len(hashes)],
+		})
+		chunkCount++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if signature.ContentDefinedChunking != nil {
+		return errContentDefinedSignatureIndex
+	}
+	_, err = io.Copy(io.Discard, signatureInput) // anything after the signature is part of the file too
+	if err != nil {
+		return err
+	}
+
+	writer := &signatureIndexWriter{
+		output:           bufio.NewWriterSize(output, defaultReadBufferSize),
+		progressReporter: b.ProgressReporter,
+		chunkCount:       chunkCount,
+		bucketBits:       signatureIndexBucketBits(chunkCount),
+		filterBits:       signatureIndexFilterBits(chunkCount),
+		seenLengths:      make(map[uint32]bool),
+	}
+	err = writer.writeHeader(signature, signatureHash.Sum(nil))
+	if err != nil {
+		return err
+	}
+
+	if len(runs) == 0 {
+		sortIndexEntries(run)
+		for _, entry := range run {
+			err = writer.writeEntry(entry)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		if len(run) > 0 {
+			err = writeRun()
+			if err != nil {
+				return err
+			}
+		}
+		err = mergeIndexRuns(runs, signature.HashAlgorithm.HashLength(), writer.writeEntry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writer.finish()
+}
+
+func signatureIndexBucketBits(chunkCount int64) uint {
+	bucketBits := uint(bits.Len64(uint64(chunkCount / signatureIndexBucketEntries)))
+	if bucketBits > 24 {
+		bucketBits = 24
+	}
+	return bucketBits
+}
+
+func signatureIndexFilterBits(chunkCount int64) uint {
+	filterBits := uint(bits.Len64(uint64(chunkCount) * signatureIndexFilterBitsPerEntry))
+	if filterBits < 16 {
+		filterBits = 16
+	} else if filterBits > 30 {
+		filterBits = 30
+	}
+	return filterBits
+}
+
+// ----------------------------------------------------------------------------
+
+type indexEntry struct {
+	checksum    uint32
+	length      uint32
+	startOffset int64
+	hash        []byte
+}
+
+func (e *indexEntry) appendTo(buffer []byte) []byte {
+	buffer = binary.LittleEndian.AppendUint32(buffer, e.checksum)
+	buffer = binary.LittleEndian.AppendUint32(buffer, e.length)
+	buffer = binary.LittleEndian.AppendUint64(buffer, uint64(e.startOffset))
+	return append(buffer, e.hash...)
+}
+
+// readIndexEntry decodes an entry written by appendTo. Its hash refers to record.
+func readIndexEntry(record []byte) indexEntry {
+	return indexEntry{
+		checksum:    binary.LittleEndian.Uint32(record),
+		length:      binary.LittleEndian.Uint32(record[4:]),
+		startOffset: int64(binary.LittleEndian.Uint64(record[8:])),
+		hash:        record[16:],
+	}
+}
+
+// indexEntryLess orders entries so the chunks with the same checksum, length and hash are together, in offset order.
+// The first of them is the chunk createChunkLookup would find, so a delta is the same whichever is used.
+func indexEntryLess(x *indexEntry, y *indexEntry) bool {
+	if x.checksum != y.checksum {
+		return x.checksum < y.checksum
+	}
+	if x.length != y.length {
+		return x.length < y.length
+	}
+	if c := bytes.Compare(x.hash, y.hash); c != 0 {
+		return c < 0
+	}
+	return x.startOffset < y.startOffset
+}
+
+func sortIndexEntries(entries []indexEntry) {
+	sort.Slice(entries, func(i, j int) bool { return indexEntryLess(&entries[i], &entries[j]) })
+}
+
+// indexRun is a sorted run of entries being read back from its temporary file
+type indexRun struct {
+	reader *bufio.Reader
+	record []byte
+	entry  indexEntry
+}
+
+func (r *indexRun) next() (bool, error) {
+	_, err := io.ReadFull(r.reader, r.record)
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	r.entry = readIndexEntry(r.record)
+	return true, nil
+}
+
+type indexRunHeap []*indexRun
+
+func (h indexRunHeap) Len() int            { return len(h) }
+func (h indexRunHeap) Less(i, j int) bool  { return indexEntryLess(&h[i].entry, &h[j].entry) }
+func (h indexRunHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *indexRunHeap) Push(x interface{}) { *h = append(*h, x.(*indexRun)) }
+func (h *indexRunHeap) Pop() interface{} {
+	old := *h
+	run := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return run
+}
+
+// mergeIndexRuns passes the entries from all the runs to emit in order. The entry is only valid until emit returns.
+func mergeIndexRuns(runs []*os.File, hashLength int, emit func(entry indexEntry) error) error {
+	h := make(indexRunHeap, 0, len(runs))
+	for _, file := range runs {
+		run := &indexRun{reader: bufio.NewReaderSize(file, 32*1024), record: make([]byte, 16+hashLength)}
+		ok, err := run.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			h = append(h, run)
+		}
+	}
+	heap.Init(&h)
+
+	for len(h) > 0 {
+		run := h[0]
+		err := emit(run.entry)
+		if err != nil {
+			return err
+		}
+		ok, err := run.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+
+// signatureIndexWriter writes the entries of an index in order, building the tables which follow them as it goes
+type signatureIndexWriter struct {
+	output           *bufio.Writer
+	progressReporter ProgressReporter
+	chunkCount       int64
+
+	entriesWritten int64
+	tablesOffset   int64
+	record         []byte
+
+	seenLengths map[uint32]bool
+	lengths     []int
+	bucketBits  uint
+	buckets     []uint64 // the number of entries in each bucket, until finish turns them into start indexes
+	filterBits  uint
+	filter      []uint64
+}
+
+func (w *signatureIndexWriter) writeHeader(signature *Signature, signatureHash []byte) error {
+	header := &bytes.Buffer{}
+	header.Write(BinarySignatureIndexHeader)
+	header.Write(BinaryVersion)
+	err := writeLengthPrefixedString(header, signature.HashAlgorithm.Name())
+	if err != nil {
+		return err
+	}
+	err = writeLengthPrefixedString(header, signature.RollingChecksumAlgorithm.Name())
+	if err != nil {
+		return err
+	}
+	err = binary.Write(header, binary.LittleEndian, signature.BasisLength)
+	if err != nil {
+		return err
+	}
+	err = writeHash(header, signature.BasisHash)
+	if err != nil {
+		return err
+	}
+	err = writeHash(header, signatureHash)
+	if err != nil {
+		return err
+	}
+	header.Write(BinaryEndOfMetadata)
+
+	w.tablesOffset = int64(header.Len())
+	w.buckets = make([]uint64, (1<<w.bucketBits)+1)
+	w.filter = make([]uint64, (1<<w.filterBits)/64)
+	w.progressReporter.ReportProgress("Building signature index", 0, w.chunkCount)
+
+	_, err = w.output.Write(header.Bytes())
+	return err
+}
+
+func (w *signatureIndexWriter) writeEntry(entry indexEntry) error {
+	w.record = entry.appendTo(w.record[:0])
+	_, err := w.output.Write(w.record)
+	if err != nil {
+		return err
+	}
+	w.tablesOffset += int64(len(w.record))
+
+	if !w.seenLengths[entry.length] && entry.length > 0 {
+		w.seenLengths[entry.length] = true
+		w.lengths = append(w.lengths, int(entry.length))
+	}
+	w.buckets[(entry.checksum>>(32-w.bucketBits))+1]++
+	index := checksumFilterIndex(entry.checksum, w.filterBits)
+	w.filter[index/64] |= 1 << (index % 64)
+
+	w.entriesWritten++
+	w.progressReporter.ReportProgress("Building signature index", w.entriesWritten, w.chunkCount)
+	return nil
+}
+
+func (w *signatureIndexWriter) finish() error {
+	sort.Sort(sort.Reverse(sort.IntSlice(w.lengths)))
+	for i := 1; i < len(w.buckets); i++ {
+		w.buckets[i] += w.buckets[i-1]
+	}
+
+	lengths := make([]uint32, 0, len(w.lengths))
+	for _, length := range w.lengths {
+		lengths = append(lengths, uint32(length))
+	}
+	for _, value := range []interface{}{
+		uint32(len(lengths)), lengths,
+		uint8(w.bucketBits), w.buckets,
+		uint8(w.filterBits), w.filter,
+		w.entriesWritten, w.tablesOffset,
+	} {
+		err := binary.Write(w.output, binary.LittleEndian, value)
+		if err != nil {
+			return err
+		}
+	}
+	return w.output.Flush()
+}
+
+// ----------------------------------------------------------------------------
+
+// SignatureIndex finds the chunks of a signature in an index built by SignatureIndexBuilder, for
+// DeltaBuilder.BuildWithIndex. Only the tables at the end of the index are held in memory; the entries are read
+// from it, or from a memory mapping of it, as they are needed, so it can be used by several DeltaBuilders at once.
+type SignatureIndex struct {
+	HashAlgorithm            HashAlgorithm
+	RollingChecksumAlgorithm RollingChecksum
+
+	// BasisLength and BasisHash identify the whole basis file. BasisHash is nil unless the signature recorded it
+	BasisLength int64
+	BasisHash   []byte
+
+	// ChunkCount is the number of chunks in the signature
+	ChunkCount int64
+
+	// SignatureHash is the SHA256 of the signature file the index was built from; see VerifySignatureFile
+	SignatureHash []byte
+
+	index         io.ReaderAt
+	mapping       []byte // the whole index, if it is memory mapped
+	entriesOffset int64
+	entrySize     int
+	lengths       []int
+	bucketBits    uint
+	buckets       []uint64
+	filterBits    uint
+	filter        []uint64
+	buffers       sync.Pool
+}
+
+var _ chunkFinder = (*SignatureIndex)(nil)
+
+// OpenSignatureIndex reads the metadata and tables of an index. The index is read from until the SignatureIndex
+// is no longer used, so must stay open until then.
+func OpenSignatureIndex(index io.ReaderAt, indexLength int64) (*SignatureIndex, error) {
+	return openSignatureIndex(index, indexLength)
+}
+
+// MapSignatureIndex memory maps an index file, so looking up chunks doesn't need a read from the file each time,
+// then reads it as OpenSignatureIndex does. The file can be closed once this returns, but Close must be called once
+// the SignatureIndex is no longer used to unmap it. Where memory mapping isn't supported, the index is read from the
+// file instead, which must then stay open.
+func MapSignatureIndex(file *os.File) (*SignatureIndex, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < signatureIndexFooterSize {
+		return nil, errors.New("the signature index appears to be corrupt")
+	}
+	mapping, err := mapFile(file, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	if mapping == nil {
+		return openSignatureIndex(file, info.Size())
+	}
+	s, err := openSignatureIndex(bytes.NewReader(mapping), int64(len(mapping)))
+	if err != nil {
+		_ = unmapFile(mapping)
+		return nil, err
+	}
+	s.mapping = mapping
+	return s, nil
+}
+
+// Close unmaps an index opened with MapSignatureIndex. It does nothing for one opened with OpenSignatureIndex.
+func (s *SignatureIndex) Close() error {
+	if s.mapping == nil {
+		return nil
+	}
+	mapping := s.mapping
+	s.mapping = nil
+	return unmapFile(mapping)
+}
+
+func openSignatureIndex(index io.ReaderAt, indexLength int64) (*SignatureIndex, error) {
+	corrupt := errors.New("the signature index appears to be corrupt")
+	if indexLength < signatureIndexFooterSize {
+		return nil, corrupt
+	}
+
+	input := &countingReader{reader: io.NewSectionReader(index, 0, indexLength)}
+	headerBytes := make([]byte, len(BinarySignatureIndexHeader))
+	_, err := io.ReadFull(input, headerBytes)
+	if err != nil || !bytes.Equal(headerBytes, BinarySignatureIndexHeader) {
+		return nil, corrupt
+	}
+	versionBytes := make([]byte, len(BinaryVersion))
+	_, err = io.ReadFull(input, versionBytes)
+	if err != nil {
+		return nil, corrupt
+	}
+	if !bytes.Equal(versionBytes, BinaryVersion) {
+		return nil, errors.New("the signature index uses a newer file format than this program can handle")
+	}
+
+	hashAlgorithmStr, _, err := readLengthPrefixedString(input)
+	if err != nil {
+		return nil, corrupt
+	}
+	rollingChecksumAlgorithmStr, _, err := readLengthPrefixedString(input)
+	if err != nil {
+		return nil, corrupt
+	}
+	hashAlgorithm, ok := LookupHashAlgorithm(hashAlgorithmStr)
+	if !ok {
+		return nil, fmt.Errorf("signature index uses unsupported hash algorithm %s", hashAlgorithmStr)
+	}
+	rollingChecksum, ok := LookupRollingChecksum(rollingChecksumAlgorithmStr)
+	if !ok {
+		return nil, fmt.Errorf("signature index uses unsupported rolling checksum algorithm %s", rollingChecksumAlgorithmStr)
+	}
+	hashLength := hashAlgorithm.HashLength()
+
+	s := &SignatureIndex{
+		HashAlgorithm:            hashAlgorithm,
+		RollingChecksumAlgorithm: rollingChecksum,
+		index:                    index,
+		entrySize:                16 + hashLength,
+	}
+
+	var basisHashLength int32
+	err = binary.Read(input, binary.LittleEndian, &s.BasisLength)
+	if err == nil {
+		err = binary.Read(input, binary.LittleEndian, &basisHashLength)
+	}
+	if err != nil || (basisHashLength != 0 && int(basisHashLength) != hashLength) {
+		return nil, corrupt
+	}
+	if basisHashLength != 0 {
+		s.BasisHash = make([]byte, basisHashLength)
+		_, err = io.ReadFull(input, s.BasisHash)
+		if err != nil {
+			return nil, corrupt
+		}
+	}
+	var signatureHashLength int32
+	err = binary.Read(input, binary.LittleEndian, &signatureHashLength)
+	if err != nil || int(signatureHashLength) != signatureIndexHashAlgorithm.HashLength() {
+		return nil, corrupt
+	}
+	s.SignatureHash = make([]byte, signatureHashLength)
+	_, err = io.ReadFull(input, s.SignatureHash)
+	if err != nil {
+		return nil, corrupt
+	}
+	endBytes := make([]byte, len(BinaryEndOfMetadata))
+	_, err = io.ReadFull(input, endBytes)
+	if err != nil || !bytes.Equal(endBytes, BinaryEndOfMetadata) {
+		return nil, corrupt
+	}
+	s.entriesOffset = input.count
+
+	var footer [2]int64
+	err = binary.Read(io.NewSectionReader(index, indexLength-signatureIndexFooterSize, signatureIndexFooterSize), binary.LittleEndian, &footer)
+	if err != nil {
+		return nil, err
+	}
+	s.ChunkCount = footer[0]
+	tablesOffset := footer[1]
+	tablesLength := indexLength - signatureIndexFooterSize - tablesOffset
+	if s.ChunkCount < 0 || tablesLength < 0 || s.ChunkCount > (tablesOffset-s.entriesOffset)/int64(s.entrySize) ||
+		s.entriesOffset+s.ChunkCount*int64(s.entrySize) != tablesOffset {
+		return nil, corrupt
+	}
+
+	err = s.readTables(bufio.NewReader(io.NewSectionReader(index, tablesOffset, tablesLength)), tablesLength)
+	if err != nil {
+		return nil, corrupt
+	}
+	return s, nil
+}
+
+func (s *SignatureIndex) readTables(input io.Reader, tablesLength int64) error {
+	var lengthCount uint32
+	err := binary.Read(input, binary.LittleEndian, &lengthCount)
+	if err != nil {
+		return err
+	}
+	if int64(lengthCount)*4 > tablesLength {
+		return io.ErrUnexpectedEOF
+	}
+	lengths := make([]uint32, lengthCount)
+	err = binary.Read(input, binary.LittleEndian, lengths)
+	if err != nil {
+		return err
+	}
+	for i, length := range lengths {
+		// DeltaBuilder allocates buffers to fit the longest chunk, so bound them as SignatureReader does
+		if length == 0 || int64(length) > int64(maximumChunkLength(true)) {
+			return errors.New("chunk length is out of range")
+		}
+		if i > 0 && length >= lengths[i-1] {
+			return errors.New("chunk lengths are out of order")
+		}
+		s.lengths = append(s.lengths, int(length))
+	}
+
+	var bucketBits, filterBits uint8
+	err = binary.Read(input, binary.LittleEndian, &bucketBits)
+	if err != nil {
+		return err
+	}
+	if bucketBits > 24 {
+		return errors.New("too many buckets")
+	}
+	s.bucketBits = uint(bucketBits)
+	s.buckets = make([]uint64, (1<<s.bucketBits)+1)
+	err = binary.Read(input, binary.LittleEndian, s.buckets)
+	if err != nil {
+		return err
+	}
+	for i := 1; i < len(s.buckets); i++ {
+		if s.buckets[i] < s.buckets[i-1] {
+			return errors.New("buckets are out of order")
+		}
+	}
+	if s.buckets[0] != 0 || s.buckets[len(s.buckets)-1] != uint64(s.ChunkCount) {
+		return errors.New("buckets don't cover the entries")
+	}
+
+	err = binary.Read(input, binary.LittleEndian, &filterBits)
+	if err != nil {
+		return err
+	}
+	if filterBits < 6 || filterBits > 30 {
+		return errors.New("invalid filter size")
+	}
+	s.filterBits = uint(filterBits)
+	s.filter = make([]uint64, (1<<s.filterBits)/64)
+	return binary.Read(input, binary.LittleEndian, s.filter)
+}
+
+// VerifySignatureFile checks that the index was built from signatureFile, so a signature file which has been
+// verified, with SignFile for example, can vouch for the index
+func (s *SignatureIndex) VerifySignatureFile(signatureFile io.Reader) error {
+	hash, err := signatureIndexHashAlgorithm.HashOverReader(signatureFile)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, s.SignatureHash) {
+		return errors.New("the signature index was not built from this signature file")
+	}
+	return nil
+}
+
+// signature returns the metadata of the signature, without any chunks
+func (s *SignatureIndex) signature() *Signature {
+	return &Signature{
+		HashAlgorithm:            s.HashAlgorithm,
+		RollingChecksumAlgorithm: s.RollingChecksumAlgorithm,
+		BasisLength:              s.BasisLength,
+		BasisHash:                s.BasisHash,
+	}
+}
+
+func (s *SignatureIndex) chunkLookup() *chunkLookup {
+	return &chunkLookup{signature: s.signature(), lengths: s.lengths, finder: s}
+}
+
+func (s *SignatureIndex) findChunk(checksum uint32, block []byte) (*ChunkSignature, error) {
+	index := checksumFilterIndex(checksum, s.filterBits)
+	if s.filter[index/64]&(1<<(index%64)) == 0 {
+		return nil, nil
+	}
+	bucket := checksum >> (32 - s.bucketBits)
+	start, end := s.buckets[bucket], s.buckets[bucket+1]
+	if start == end {
+		return nil, nil
+	}
+
+	buffer, _ := s.buffers.Get().(*[]byte)
+	if buffer == nil {
+		b := make([]byte, s.entrySize)
+		buffer = &b
+	}
+	defer s.buffers.Put(buffer)
+
+	// find the first entry with this checksum and length, then only hash the block if there is one
+	length := uint32(len(block))
+	first, err := s.searchEntries(int64(start), int64(end), *buffer, func(entry *indexEntry) bool {
+		return entry.checksum < checksum || (entry.checksum == checksum && entry.length < length)
+	})
+	if err != nil || first == int64(end) {
+		return nil, err
+	}
+	entry, err := s.readEntry(first, *buffer)
+	if err != nil || entry.checksum != checksum || entry.length != length {
+		return nil, err
+	}
+
+	hash := s.HashAlgorithm.HashOverData(block)
+	if !bytes.Equal(hash, entry.hash) {
+		// the entries with this checksum and length are ordered by hash
+		first, err = s.searchEntries(first+1, int64(end), *buffer, func(entry *indexEntry) bool {
+			return entry.checksum == checksum && entry.length == length && bytes.Compare(entry.hash, hash) < 0
+		})
+		if err != nil || first == int64(end) {
+			return nil, err
+		}
+		entry, err = s.readEntry(first, *buffer)
+		if err != nil || entry.checksum != checksum || entry.length != length || !bytes.Equal(hash, entry.hash) {
+			return nil, err
+		}
+	}
+	chunk := &ChunkSignature{
+		StartOffset:     entry.startOffset,
+		Hash:            hash,
+		RollingChecksum: entry.checksum,
+	}
+	chunk.setChunkLength(int(entry.length))
+	return chunk, nil
+}
+
+// searchEntries returns the first entry in [start, end) for which less is false. less must be true for every entry
+// before that one.
+func (s *SignatureIndex) searchEntries(start int64, end int64, buffer []byte, less func(entry *indexEntry) bool) (int64, error) {
+	for start < end {
+		middle := start + (end-start)/2
+		entry, err := s.readEntry(middle, buffer)
+		if err != nil {
+			return 0, err
+		}
+		if less(&entry) {
+			start = middle + 1
+		} else {
+			end = middle
+		}
+	}
+	return start, nil
+}
+
+// readEntry reads the entry at index i. Unless the index is memory mapped it is read into buffer, which it refers to.
+func (s *SignatureIndex) readEntry(i int64, buffer []byte) (indexEntry, error) {
+	offset := s.entriesOffset + i*int64(s.entrySize)
+	if s.mapping != nil {
+		return readIndexEntry(s.mapping[offset : offset+int64(s.entrySize)]), nil
+	}
+	n, err := s.index.ReadAt(buffer, offset)
+	if n < len(buffer) {
+		if err == nil || err == io.EOF {
+			err = errors.New("the signature index got shorter while the delta was being built")
+		}
+		return indexEntry{}, err
+	}
+	return readIndexEntry(buffer), nil
+}
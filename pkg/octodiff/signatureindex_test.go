@@ -0,0 +1,227 @@
+package octodiff_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func buildSignatureIndex(t *testing.T, signatureFile []byte, runSize int) []byte {
+	var output bytes.Buffer
+	builder := octodiff.NewSignatureIndexBuilder()
+	builder.RunSize = runSize
+	builder.TempDirectory = t.TempDir()
+	err := builder.Build(bytes.NewReader(signatureFile), int64(len(signatureFile)), &output)
+	assert.Nil(t, err)
+	return output.Bytes()
+}
+
+func buildDeltaWithIndex(t *testing.T, newFile []byte, indexFile []byte, concurrency int, segmentSize int64) []byte {
+	index, err := octodiff.OpenSignatureIndex(bytes.NewReader(indexFile), int64(len(indexFile)))
+	assert.Nil(t, err)
+
+	d := octodiff.NewDeltaBuilder()
+	d.Concurrency = concurrency
+	d.SegmentSize = segmentSize
+	var output bytes.Buffer
+	err = d.BuildWithIndex(bytes.NewReader(newFile), int64(len(newFile)), index, octodiff.NewBinaryDeltaWriter(&output))
+	assert.Nil(t, err)
+	return output.Bytes()
+}
+
+func TestDeltaBuiltWithIndexMatchesDeltaBuiltWithSignature(t *testing.T) {
+	basis, newFile := buildPatchedFileTestData()
+	signature := buildSignature(basis)
+	expected := buildDelta(newFile, signature)
+
+	// the test data repeats, so there are lots of chunks with the same checksum and hash, and the runs have to be
+	// merged so the first of them is still found first
+	for _, runSize := range []int{0, 10, 127} {
+		index := buildSignatureIndex(t, signature, runSize)
+		assert.Equal(t, expected, buildDeltaWithIndex(t, newFile, index, 1, 0), "run size %d", runSize)
+		assert.Equal(t, expected, buildDeltaWithIndex(t, newFile, index, 3, 10007), "run size %d", runSize)
+	}
+}
+
+func TestDeltaBuiltWithIndexMatchesEveryChunkLength(t *testing.T) {
+	basis, signature, newFile := buildMixedLengthTestData(12, 256*1024)
+
+	index := buildSignatureIndex(t, signature, 16)
+	delta := buildDeltaWithIndex(t, newFile, index, 1, 0)
+	assert.Equal(t, buildDelta(newFile, signature), delta)
+
+	var patched bytes.Buffer
+	err := octodiff.ApplyDeltaAndVerify(bytes.NewReader(basis), octodiff.NewBinaryDeltaReader(bytes.NewReader(delta)), &patched)
+	assert.Nil(t, err)
+	assert.Equal(t, newFile, patched.Bytes())
+}
+
+func TestSignatureIndexRecordsTheSignatureMetadata(t *testing.T) {
+	basis := randomTestData(100 * 1024)
+	b := octodiff.NewSignatureBuilder()
+	b.RecordBasisIdentity = true
+	signature := buildSignatureBuilder(b, basis)
+
+	indexFile := buildSignatureIndex(t, signature, 0)
+	index, err := octodiff.OpenSignatureIndex(bytes.NewReader(indexFile), int64(len(indexFile)))
+	assert.Nil(t, err)
+	assert.Equal(t, octodiff.DefaultHashAlgorithm, index.HashAlgorithm)
+	assert.Equal(t, octodiff.DefaultChecksumAlgorithm, index.RollingChecksumAlgorithm)
+	assert.Equal(t, int64(len(basis)), index.BasisLength)
+	assert.Equal(t, octodiff.DefaultHashAlgorithm.HashOverData(basis), index.BasisHash)
+	assert.Equal(t, int64(50), index.ChunkCount)
+
+	// the basis identity is written into the delta, and lets an unchanged file skip the scan
+	delta := buildDeltaWithIndex(t, basis, indexFile, 1, 0)
+	assert.Equal(t, []string{
+		"copy start=0, length=102400",
+	}, logDeltaFile(delta))
+	reader := octodiff.NewBinaryDeltaReader(bytes.NewReader(delta))
+	basisLength, basisHash, err := reader.BasisIdentity()
+	assert.Nil(t, err)
+	assert.Equal(t, index.BasisLength, basisLength)
+	assert.Equal(t, index.BasisHash, basisHash)
+}
+
+func TestSignatureIndexOfEmptySignature(t *testing.T) {
+	newFile := randomTestData(10000)
+	signature := buildSignature(nil)
+
+	index := buildSignatureIndex(t, signature, 0)
+	assert.Equal(t, buildDelta(newFile, signature), buildDeltaWithIndex(t, newFile, index, 1, 0))
+}
+
+func TestSignatureIndexWithLargeChunks(t *testing.T) {
+	basis := randomTestData(3 * 1024 * 1024)
+	newFile := append(append([]byte("a new header"), basis[:1024*1024]...), basis[1024*1024+100:]...)
+
+	b := octodiff.NewSignatureBuilder()
+	b.ChunkSize = 256 * 1024
+	b.LargeChunks = true
+	signature := buildSignatureBuilder(b, basis)
+
+	index := buildSignatureIndex(t, signature, 0)
+	assert.Equal(t, buildDelta(newFile, signature), buildDeltaWithIndex(t, newFile, index, 1, 0))
+}
+
+func TestSignatureIndexRejectsContentDefinedSignatures(t *testing.T) {
+	signature := buildContentDefinedSignature(randomTestData(64 * 1024))
+
+	builder := octodiff.NewSignatureIndexBuilder()
+	err := builder.Build(bytes.NewReader(signature), int64(len(signature)), &bytes.Buffer{})
+	assert.EqualError(t, err, "signatures built with content defined chunking can't be indexed")
+}
+
+func TestOpenSignatureIndexRejectsCorruptIndex(t *testing.T) {
+	signature := buildSignature(randomTestData(64 * 1024))
+	index := buildSignatureIndex(t, signature, 0)
+
+	for _, corrupt := range [][]byte{
+		nil,
+		index[:len(index)-1],
+		append(append([]byte(nil), index[:100]...), index[101:]...),
+		signature,
+	} {
+		_, err := octodiff.OpenSignatureIndex(bytes.NewReader(corrupt), int64(len(corrupt)))
+		assert.EqualError(t, err, "the signature index appears to be corrupt")
+	}
+}
+
+func TestSignatureIndexIsTiedToItsSignatureFile(t *testing.T) {
+	signature := buildSignature(randomTestData(64 * 1024))
+	indexFile := buildSignatureIndex(t, signature, 0)
+	index, err := octodiff.OpenSignatureIndex(bytes.NewReader(indexFile), int64(len(indexFile)))
+	assert.Nil(t, err)
+
+	assert.Nil(t, index.VerifySignatureFile(bytes.NewReader(signature)))
+
+	otherSignature := buildSignature(randomTestData(32 * 1024))
+	err = index.VerifySignatureFile(bytes.NewReader(otherSignature))
+	assert.EqualError(t, err, "the signature index was not built from this signature file")
+}
+
+func TestOpenSignatureIndexRejectsChunkLongerThanAllowed(t *testing.T) {
+	signature := buildSignature(randomTestData(64 * 1024))
+	index := buildSignatureIndex(t, signature, 0)
+
+	// the longest chunk length is the first in the tables, after the number of lengths. Like a forged signature,
+	// this would have DeltaBuilder allocate 4GB
+	tablesOffset := binary.LittleEndian.Uint64(index[len(index)-8:])
+	binary.LittleEndian.PutUint32(index[tablesOffset+4:], 0xF0000000)
+
+	_, err := octodiff.OpenSignatureIndex(bytes.NewReader(index), int64(len(index)))
+	assert.EqualError(t, err, "the signature index appears to be corrupt")
+}
+
+type countingReaderAt struct {
+	reader    io.ReaderAt
+	bytesRead int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.reader.ReadAt(p, off)
+	c.bytesRead += int64(n)
+	return n, err
+}
+
+func TestSignatureIndexSearchesALargeBucket(t *testing.T) {
+	// every chunk has the same checksum and length, as sparse data can, but only two have the hash of the new file.
+	// They all fall in one bucket
+	r := rand.New(rand.NewSource(14))
+	chunk := make([]byte, 700)
+	r.Read(chunk)
+	checksum := octodiff.DefaultChecksumAlgorithm.Calculate(chunk)
+	signature := bytes.NewBuffer(buildSignature(nil))
+	for i := 0; i < 50000; i++ {
+		hash := make([]byte, octodiff.DefaultHashAlgorithm.HashLength())
+		r.Read(hash)
+		if i == 30000 || i == 40000 {
+			hash = octodiff.DefaultHashAlgorithm.HashOverData(chunk)
+		}
+		_ = binary.Write(signature, binary.LittleEndian, uint16(len(chunk)))
+		_ = binary.Write(signature, binary.LittleEndian, checksum)
+		signature.Write(hash)
+	}
+	indexFile := buildSignatureIndex(t, signature.Bytes(), 0)
+
+	reader := &countingReaderAt{reader: bytes.NewReader(indexFile)}
+	index, err := octodiff.OpenSignatureIndex(reader, int64(len(indexFile)))
+	assert.Nil(t, err)
+	reader.bytesRead = 0
+
+	var delta bytes.Buffer
+	err = octodiff.NewDeltaBuilder().BuildWithIndex(bytes.NewReader(chunk), int64(len(chunk)), index, octodiff.NewBinaryDeltaWriter(&delta))
+	assert.Nil(t, err)
+	assert.Equal(t, buildDelta(chunk, signature.Bytes()), delta.Bytes())
+	assert.Equal(t, []string{
+		"copy start=21000000, length=700",
+	}, logDeltaFile(delta.Bytes()))
+
+	// the bucket is 2.6MB, but finding the chunk only reads a few entries of it
+	assert.Less(t, reader.bytesRead, int64(4*1024))
+}
+
+func TestMapSignatureIndex(t *testing.T) {
+	basis, newFile := buildPatchedFileTestData()
+	signature := buildSignature(basis)
+	indexPath := filepath.Join(t.TempDir(), "basis.octoidx")
+	assert.Nil(t, os.WriteFile(indexPath, buildSignatureIndex(t, signature, 0), 0o644))
+
+	file, err := os.Open(indexPath)
+	assert.Nil(t, err)
+	defer func() { _ = file.Close() }()
+	index, err := octodiff.MapSignatureIndex(file)
+	assert.Nil(t, err)
+
+	var delta bytes.Buffer
+	err = octodiff.NewDeltaBuilder().BuildWithIndex(bytes.NewReader(newFile), int64(len(newFile)), index, octodiff.NewBinaryDeltaWriter(&delta))
+	assert.Nil(t, err)
+	assert.Equal(t, buildDelta(newFile, signature), delta.Bytes())
+	assert.Nil(t, index.Close())
+}
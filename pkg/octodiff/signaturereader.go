@@ -2,6 +2,7 @@ package octodiff
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -18,6 +19,13 @@ func NewSignatureReader() *SignatureReader {
 }
 
 func (s *SignatureReader) ReadSignature(input io.Reader, inputLength int64) (*Signature, error) {
+	return s.readSignature(input, inputLength, nil)
+}
+
+// readSignature reads a signature, passing each chunk to onChunk rather than keeping it in Chunks if onChunk isn't
+// nil. onChunk is also given the signature's metadata, apart from the basis identity which comes after the chunks.
+// The chunk's Hash is only valid until onChunk returns.
+func (s *SignatureReader) readSignature(input io.Reader, inputLength int64, onChunk func(signature *Signature, chunk *ChunkSignature) error) (*Signature, error) {
 	pos := int64(0)
 	s.ProgressReporter.ReportProgress("Reading signature", pos, inputLength)
 
@@ -36,7 +44,8 @@ func (s *SignatureReader) ReadSignature(input io.Reader, inputLength int64) (*Si
 	if err != nil {
 		return nil, err
 	}
-	if bytesRead != len(BinaryVersion) || !bytes.Equal(versionBytes, BinaryVersion) {
+	isVersion2 := bytesRead == len(BinarySignatureVersion2) && bytes.Equal(versionBytes, BinarySignatureVersion2)
+	if !isVersion2 && (bytesRead != len(BinaryVersion) || !bytes.Equal(versionBytes, BinaryVersion)) {
 		return nil, errors.New("the signature file uses a newer file format than this program can handle")
 	}
 	pos += int64(bytesRead)
@@ -53,6 +62,36 @@ func (s *SignatureReader) ReadSignature(input io.Reader, inputLength int64) (*Si
 	}
 	pos += int64(bytesRead)
 
+	flags := SignatureFlags(0)
+	if isVersion2 {
+		err = binary.Read(input, binary.LittleEndian, &flags)
+		if err != nil {
+			return nil, err
+		}
+		if flags&^knownSignatureFlags != 0 {
+			return nil, errors.New("the signature file uses features this program can't handle")
+		}
+		pos += 1
+	}
+
+	var contentDefinedChunking *ContentDefinedChunking
+	if flags&SignatureFlagContentDefinedChunks != 0 {
+		var sizes [3]uint32
+		err = binary.Read(input, binary.LittleEndian, &sizes)
+		if err != nil {
+			return nil, err
+		}
+		contentDefinedChunking = &ContentDefinedChunking{
+			MinChunkSize:     int(sizes[0]),
+			AverageChunkSize: int(sizes[1]),
+			MaxChunkSize:     int(sizes[2]),
+		}
+		if contentDefinedChunking.validate(maximumChunkLength(flags&SignatureFlagLargeChunks != 0)) != nil {
+			return nil, errors.New("the signature file contains invalid content defined chunking parameters")
+		}
+		pos += 12
+	}
+
 	var endBytes = make([]byte, len(BinaryEndOfMetadata))
 	bytesRead, err = input.Read(endBytes)
 	if err != nil {
@@ -65,35 +104,55 @@ func (s *SignatureReader) ReadSignature(input io.Reader, inputLength int64) (*Si
 
 	s.ProgressReporter.ReportProgress("Reading signature", pos, inputLength)
 
-	if hashAlgorithmStr != DefaultHashAlgorithm.Name() {
+	hashAlgorithm, ok := LookupHashAlgorithm(hashAlgorithmStr)
+	if !ok {
 		return nil, fmt.Errorf("signature uses unsupported hash algorithm %s", hashAlgorithmStr)
 	}
-	hashAlgorithm := DefaultHashAlgorithm
 
-	var rollingChecksum RollingChecksum
-	switch rollingChecksumAlgorithmStr {
-	case Adler32RollingChecksumName:
-		rollingChecksum = NewAdler32RollingChecksum()
-	case Adler32RollingChecksumV2Name:
-		rollingChecksum = NewAdler32RollingChecksumV2()
-	default:
+	rollingChecksum, ok := LookupRollingChecksum(rollingChecksumAlgorithmStr)
+	if !ok {
 		return nil, fmt.Errorf("signature uses unsupported rolling checksum algorithm %s", rollingChecksumAlgorithmStr)
 	}
 
 	expectedHashLength := hashAlgorithm.HashLength()
 	remainingBytes := inputLength - pos
-	signatureSize := 2 + 4 + expectedHashLength
+	lengthSize := 2
+	if flags&SignatureFlagLargeChunks != 0 {
+		lengthSize = 4
+	}
+	signatureSize := lengthSize + 4 + expectedHashLength
+	// bound the chunk lengths, as DeltaBuilder allocates buffers to fit the longest
+	maxChunkLength := maximumChunkLength(flags&SignatureFlagLargeChunks != 0)
+
+	trailerSize := int64(0)
+	if flags&SignatureFlagBasisIdentity != 0 {
+		trailerSize += 8 + 4 + int64(expectedHashLength)
+	}
+	remainingBytes -= trailerSize
 
-	if remainingBytes%int64(signatureSize) != 0 {
+	if remainingBytes < 0 || remainingBytes%int64(signatureSize) != 0 {
 		return nil, errors.New("the signature file appears to be corrupt; at least one chunk has data missing")
 	}
 
 	expectedNumberOfChunks := remainingBytes / int64(signatureSize)
 
-	chunks := make([]*ChunkSignature, 0, expectedNumberOfChunks)
+	signature := &Signature{
+		HashAlgorithm:            hashAlgorithm,
+		RollingChecksumAlgorithm: rollingChecksum,
+		ContentDefinedChunking:   contentDefinedChunking,
+	}
+
+	var chunks []*ChunkSignature
+	if onChunk == nil {
+		chunks = make([]*ChunkSignature, 0, expectedNumberOfChunks)
+	}
 
 	chunkStart := int64(0)
-	iter := NewReaderIteratorSize(input, signatureSize)
+	chunkInput := input
+	if trailerSize != 0 {
+		chunkInput = io.LimitReader(input, remainingBytes) // stop before the trailer
+	}
+	iter := NewReaderIteratorSize(chunkInput, signatureSize)
 	for iter.Next() {
 		block := iter.Current
 		blockBytesRead := len(iter.Current)
@@ -102,16 +161,37 @@ func (s *SignatureReader) ReadSignature(input io.Reader, inputLength int64) (*Si
 		}
 		pos += int64(blockBytesRead)
 
-		length := uint16(block[0]) | uint16(block[1])<<8
-
-		checksum := uint32(block[2]) | uint32(block[3])<<8 | uint32(block[4])<<16 | uint32(block[5])<<24
-
-		chunks = append(chunks, &ChunkSignature{
-			StartOffset:     chunkStart,
-			Length:          length,
-			RollingChecksum: checksum,
-			Hash:            append([]byte(nil), block[6:]...), // copy the buffer as the next read around the loop is going to overwrite 'block'
-		})
+		length := uint32(block[0]) | uint32(block[1])<<8
+		if lengthSize == 4 {
+			length |= uint32(block[2])<<16 | uint32(block[3])<<24
+		}
+		if length == 0 || int64(length) > int64(maxChunkLength) {
+			return nil, errors.New("the signature file appears to be corrupt; a chunk has an invalid length")
+		}
+		block = block[lengthSize:]
+
+		checksum := uint32(block[0]) | uint32(block[1])<<8 | uint32(block[2])<<16 | uint32(block[3])<<24
+
+		if onChunk != nil {
+			chunk := &ChunkSignature{
+				StartOffset:     chunkStart,
+				RollingChecksum: checksum,
+				Hash:            block[4:],
+			}
+			chunk.setChunkLength(int(length))
+			err = onChunk(signature, chunk)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			chunk := &ChunkSignature{
+				StartOffset:     chunkStart,
+				RollingChecksum: checksum,
+				Hash:            append([]byte(nil), block[4:]...), // copy the buffer as the next read around the loop is going to overwrite 'block'
+			}
+			chunk.setChunkLength(int(length))
+			chunks = append(chunks, chunk)
+		}
 
 		chunkStart += int64(length)
 
@@ -121,9 +201,26 @@ func (s *SignatureReader) ReadSignature(input io.Reader, inputLength int64) (*Si
 		return nil, err
 	}
 
-	return &Signature{
-		HashAlgorithm:            hashAlgorithm,
-		RollingChecksumAlgorithm: rollingChecksum,
-		Chunks:                   chunks,
-	}, nil
+	signature.Chunks = chunks
+
+	if flags&SignatureFlagBasisIdentity != 0 {
+		err = binary.Read(input, binary.LittleEndian, &signature.BasisLength)
+		if err != nil {
+			return nil, err
+		}
+		var hashLength int32
+		err = binary.Read(input, binary.LittleEndian, &hashLength)
+		if err != nil {
+			return nil, err
+		}
+		if int(hashLength) != expectedHashLength {
+			return nil, errors.New("the signature file contains an invalid basis hash length")
+		}
+		signature.BasisHash = make([]byte, hashLength)
+		_, err = io.ReadFull(input, signature.BasisHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return signature, nil
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/hex"
 	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
+	"github.com/OctopusDeploy/go-octodiff/pkg/test"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -74,3 +75,79 @@ func TestReadsLargeChunkSizeSignatureOverLargeFile(t *testing.T) {
 	assertChunk(t, s.Chunks[2], 63488, 1591746682, 31744, "c605af9c2fd5a61b60f65600f5849f6ce1c53cf1")
 	assertChunk(t, s.Chunks[3], 95232, 4058619052, 7168, "94d25de18f219fa7832df14593cade50d8b0d2a2")
 }
+
+func TestReadsSha256Signature(t *testing.T) {
+	b := octodiff.NewSignatureBuilder()
+	b.HashAlgorithm = &octodiff.Sha256HashAlgorithm{}
+	input := buildSignatureBuilder(b, test.TestData())
+
+	s, err := readSignature(input)
+	assert.Nil(t, err)
+	assert.Equal(t, "SHA256", s.HashAlgorithm.Name())
+	assert.Equal(t, "Adler32", s.RollingChecksumAlgorithm.Name())
+
+	assert.Equal(t, 1, len(s.Chunks))
+	assertChunk(t, s.Chunks[0], 0, 4037189623, 520, hex.EncodeToString((&octodiff.Sha256HashAlgorithm{}).HashOverData(test.TestData())))
+}
+
+func TestRejectsSignatureWithUnknownHashAlgorithm(t *testing.T) {
+	// same as the standard signature, but with the hash algorithm name changed from SHA1 to SHA0
+	input, _ := hex.DecodeString("4f43544f5349470104534841300741646c657233323e3e3e0802f79fa2f0330bd06982d3b5dbda6c1a6ad16687a0cdb03c0d")
+
+	_, err := readSignature(input)
+	assert.EqualError(t, err, "signature uses unsupported hash algorithm SHA0")
+}
+
+func TestReadsSignatureWithBasisIdentity(t *testing.T) {
+	input, _ := hex.DecodeString("4f43544f5349470204534841310741646c65723332013e3e3e0802f79fa2f0330bd06982d3b5dbda6c1a6ad16687a0cdb03c0d080200000000000014000000330bd06982d3b5dbda6c1a6ad16687a0cdb03c0d")
+
+	s, err := readSignature(input)
+	assert.Nil(t, err)
+	assert.Equal(t, "SHA1", s.HashAlgorithm.Name())
+	assert.Equal(t, "Adler32", s.RollingChecksumAlgorithm.Name())
+
+	assert.Equal(t, 1, len(s.Chunks))
+	assertChunk(t, s.Chunks[0], 0, 4037189623, 520, "330bd06982d3b5dbda6c1a6ad16687a0cdb03c0d")
+
+	assert.Equal(t, int64(520), s.BasisLength)
+	assert.Equal(t, "330bd06982d3b5dbda6c1a6ad16687a0cdb03c0d", hex.EncodeToString(s.BasisHash))
+}
+
+func TestReadsSignatureWithBasisIdentityForEmptyFile(t *testing.T) {
+	b := octodiff.NewSignatureBuilder()
+	b.RecordBasisIdentity = true
+	input := buildSignatureBuilder(b, nil)
+
+	s, err := readSignature(input)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(s.Chunks))
+	assert.Equal(t, int64(0), s.BasisLength)
+	assert.Equal(t, "da39a3ee5e6b4b0d3255bfef95601890afd80709", hex.EncodeToString(s.BasisHash))
+}
+
+func TestStandardSignatureHasNoBasisIdentity(t *testing.T) {
+	input, _ := hex.DecodeString("4f43544f5349470104534841310741646c657233323e3e3e0802f79fa2f0330bd06982d3b5dbda6c1a6ad16687a0cdb03c0d")
+
+	s, err := readSignature(input)
+	assert.Nil(t, err)
+	assert.Nil(t, s.BasisHash)
+}
+
+func TestRejectsSignatureWithChunkLongerThanAllowed(t *testing.T) {
+	// a large chunk signature with one chunk of 0xF0000000 bytes, which would have DeltaBuilder allocate 4GB
+	input, _ := hex.DecodeString("4f43544f5349470204534841310741646c6572333204" + "3e3e3e" + "000000f0f79fa2f0330bd06982d3b5dbda6c1a6ad16687a0cdb03c0d")
+
+	_, err := readSignature(input)
+	assert.EqualError(t, err, "the signature file appears to be corrupt; a chunk has an invalid length")
+
+	var output bytes.Buffer
+	err = octodiff.NewDeltaBuilder().Build(bytes.NewReader([]byte("new file")), 8, bytes.NewReader(input), int64(len(input)), octodiff.NewBinaryDeltaWriter(&output))
+	assert.EqualError(t, err, "the signature file appears to be corrupt; a chunk has an invalid length")
+}
+
+func TestRejectsSignatureWithEmptyChunk(t *testing.T) {
+	input, _ := hex.DecodeString("4f43544f5349470104534841310741646c657233323e3e3e" + "0000f79fa2f0330bd06982d3b5dbda6c1a6ad16687a0cdb03c0d")
+
+	_, err := readSignature(input)
+	assert.EqualError(t, err, "the signature file appears to be corrupt; a chunk has an invalid length")
+}
@@ -0,0 +1,447 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/OctopusDeploy/go-octodiff/pkg/octodiff"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// DefaultMaxChainLength is how many deltas a version may be from a full snapshot before a new snapshot is taken
+const DefaultMaxChainLength = 10
+
+const manifestFileName = "manifest.json"
+
+// Store keeps a series of versions of a file in a directory, as a full snapshot followed by a chain of deltas,
+// each built against the version before it. When the chain gets too long, the next version is stored as a new
+// snapshot, so checking out any version never applies more than MaxChainLength deltas.
+//
+// The directory holds manifest.json, which lists the versions in the order they were added, alongside the
+// snapshot and delta files. A Store is not safe for concurrent use, including by several processes.
+type Store struct {
+	Directory      string
+	MaxChainLength int
+	CompressData   bool
+
+	hashAlgorithm octodiff.HashAlgorithm
+	versions      []Version
+}
+
+// Version is a version of the file in the store
+type Version struct {
+	Name   string
+	Length int64
+	Hash   []byte
+
+	// File is the snapshot or delta file, relative to the store directory
+	File string
+	// Basis is the name of the version the delta was built against, or empty for snapshots
+	Basis string
+	// ChainLength is the number of deltas between the version and its snapshot
+	ChainLength int
+}
+
+func (v Version) IsSnapshot() bool {
+	return v.Basis == ""
+}
+
+type jsonManifest struct {
+	HashAlgorithm string        `json:"hashAlgorithm"`
+	Versions      []jsonVersion `json:"versions"`
+}
+
+type jsonVersion struct {
+	Name        string `json:"name"`
+	Length      int64  `json:"length"`
+	Hash        string `json:"hash"`
+	File        string `json:"file"`
+	Basis       string `json:"basis,omitempty"`
+	ChainLength int    `json:"chainLength"`
+}
+
+// Open reads the manifest of the store in directory. If there isn't one, the store is empty, and the directory
+// and manifest are created when the first version is added.
+func Open(directory string) (*Store, error) {
+	s := &Store{
+		Directory:      directory,
+		MaxChainLength: DefaultMaxChainLength,
+		hashAlgorithm:  octodiff.DefaultHashAlgorithm,
+	}
+
+	manifestFile, err := os.ReadFile(filepath.Join(directory, manifestFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest jsonManifest
+	err = json.Unmarshal(manifestFile, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("the store manifest appears to be corrupt; %w", err)
+	}
+	hashAlgorithm, ok := octodiff.LookupHashAlgorithm(manifest.HashAlgorithm)
+	if !ok {
+		return nil, fmt.Errorf("the store uses an unsupported hashing algorithm %s", manifest.HashAlgorithm)
+	}
+	s.hashAlgorithm = hashAlgorithm
+
+	for _, v := range manifest.Versions {
+		hash, err := hex.DecodeString(v.Hash)
+		if err != nil || len(hash) != hashAlgorithm.HashLength() {
+			return nil, fmt.Errorf("the store manifest has an invalid hash for version %s", v.Name)
+		}
+		s.versions = append(s.versions, Version{
+			Name:        v.Name,
+			Length:      v.Length,
+			Hash:        hash,
+			File:        v.File,
+			Basis:       v.Basis,
+			ChainLength: v.ChainLength,
+		})
+	}
+	return s, nil
+}
+
+// Versions returns the versions in the order they were added
+func (s *Store) Versions() []Version {
+	return append([]Version(nil), s.versions...)
+}
+
+// Version returns the version with the given name
+func (s *Store) Version(name string) (Version, bool) {
+	for _, v := range s.versions {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return Version{}, false
+}
+
+// Add stores newFile as a new version, as a delta against the latest version, or as a snapshot if it is the first
+// version or the chain of deltas would get longer than MaxChainLength
+func (s *Store) Add(name string, newFile io.ReadSeeker) (Version, error) {
+	if name == "" {
+		return Version{}, errors.New("the version must have a name")
+	}
+	if _, exists := s.Version(name); exists {
+		return Version{}, fmt.Errorf("the store already has a version %s", name)
+	}
+	err := os.MkdirAll(s.Directory, 0o755)
+	if err != nil {
+		return Version{}, err
+	}
+
+	newFileLength, err := newFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return Version{}, err
+	}
+	_, err = newFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return Version{}, err
+	}
+	hash, err := s.hashAlgorithm.HashOverReader(bufio.NewReader(newFile))
+	if err != nil {
+		return Version{}, err
+	}
+	_, err = newFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return Version{}, err
+	}
+
+	version := Version{
+		Name:   name,
+		Length: newFileLength,
+		Hash:   hash,
+	}
+	if len(s.versions) == 0 || s.versions[len(s.versions)-1].ChainLength >= s.MaxChainLength {
+		version.File = fmt.Sprintf("%06d.full", len(s.versions)+1)
+		err = s.writeFile(version.File, func(output io.Writer) error {
+			_, err := io.Copy(output, newFile)
+			return err
+		})
+	} else {
+		basis := s.versions[len(s.versions)-1]
+		version.File = fmt.Sprintf("%06d.octodelta", len(s.versions)+1)
+		version.Basis = basis.Name
+		version.ChainLength = basis.ChainLength + 1
+		err = s.writeFile(version.File, func(output io.Writer) error {
+			return s.buildDelta(basis, newFile, newFileLength, output)
+		})
+	}
+	if err != nil {
+		return Version{}, err
+	}
+
+	s.versions = append(s.versions, version)
+	err = s.writeManifest()
+	if err != nil {
+		s.versions = s.versions[:len(s.versions)-1]
+		return Version{}, err
+	}
+	return version, nil
+}
+
+// buildDelta writes a delta from basis to newFile
+func (s *Store) buildDelta(basis Version, newFile io.ReadSeeker, newFileLength int64, output io.Writer) error {
+	basisFile, err := s.checkoutToTempFile(basis)
+	if err != nil {
+		return err
+	}
+	defer removeTempFile(basisFile)
+
+	var signature bytes.Buffer
+	signatureBuilder := octodiff.NewSignatureBuilder()
+	signatureBuilder.HashAlgorithm = s.hashAlgorithm
+	signatureBuilder.RecordBasisIdentity = true
+	err = signatureBuilder.Build(bufio.NewReader(basisFile), basis.Length, &signature)
+	if err != nil {
+		return err
+	}
+
+	deltaWriter := octodiff.NewBinaryDeltaWriter(output)
+	deltaWriter.CompressData = s.CompressData
+	return octodiff.NewDeltaBuilder().Build(newFile, newFileLength, &signature, int64(signature.Len()), deltaWriter)
+}
+
+// Checkout writes the named version to output, applying each delta between it and its snapshot
+func (s *Store) Checkout(name string, output io.Writer) error {
+	version, ok := s.Version(name)
+	if !ok {
+		return fmt.Errorf("the store has no version %s", name)
+	}
+
+	var chain []Version
+	for !version.IsSnapshot() {
+		chain = append([]Version{version}, chain...)
+		version, ok = s.Version(version.Basis)
+		if !ok {
+			return fmt.Errorf("the store manifest appears to be corrupt; version %s is missing", chain[0].Basis)
+		}
+	}
+
+	snapshot, err := os.Open(s.path(version))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = snapshot.Close() }()
+	if len(chain) == 0 {
+		return s.copyAndVerify(version, snapshot, output)
+	}
+
+	basisFile := snapshot
+	defer func() {
+		if basisFile != snapshot {
+			removeTempFile(basisFile)
+		}
+	}()
+	for i, version := range chain {
+		if i == len(chain)-1 {
+			return s.applyDelta(version, basisFile, output)
+		}
+
+		patchedFile, err := os.CreateTemp(s.Directory, ".checkout-*")
+		if err != nil {
+			return err
+		}
+		patchedFileWriter := bufio.NewWriter(patchedFile)
+		err = s.applyDelta(version, basisFile, patchedFileWriter)
+		if err == nil {
+			err = patchedFileWriter.Flush()
+		}
+
+		if basisFile != snapshot {
+			removeTempFile(basisFile)
+		}
+		basisFile = patchedFile
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verify checks every snapshot against the hash in the manifest, and applies every delta, checking that each was
+// built against the version before it and produces the version it claims to
+func (s *Store) Verify() error {
+	var basisFile *os.File
+	defer func() {
+		if basisFile != nil {
+			removeTempFile(basisFile)
+		}
+	}()
+
+	for i, version := range s.versions {
+		if !version.IsSnapshot() && (i == 0 || s.versions[i-1].Name != version.Basis) {
+			return fmt.Errorf("version %s: the delta is not against the version before it", version.Name)
+		}
+
+		patchedFile, err := os.CreateTemp(s.Directory, ".verify-*")
+		if err != nil {
+			return err
+		}
+		patchedFileWriter := bufio.NewWriter(patchedFile)
+		if version.IsSnapshot() {
+			err = s.verifySnapshot(version, patchedFileWriter)
+		} else {
+			err = s.applyDelta(version, basisFile, patchedFileWriter)
+		}
+		if err == nil {
+			err = patchedFileWriter.Flush()
+		}
+
+		if basisFile != nil {
+			removeTempFile(basisFile)
+		}
+		basisFile = patchedFile
+		if err != nil {
+			return fmt.Errorf("version %s: %w", version.Name, err)
+		}
+	}
+	return nil
+}
+
+func (s *Store) verifySnapshot(version Version, output io.Writer) error {
+	snapshot, err := os.Open(s.path(version))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = snapshot.Close() }()
+	return s.copyAndVerify(version, snapshot, output)
+}
+
+// applyDelta applies the delta for version to basisFile, checking it against the manifest
+func (s *Store) applyDelta(version Version, basisFile *os.File, output io.Writer) error {
+	basis, ok := s.Version(version.Basis)
+	if !ok {
+		return fmt.Errorf("the store manifest appears to be corrupt; version %s is missing", version.Basis)
+	}
+
+	deltaFile, err := os.Open(s.path(version))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = deltaFile.Close() }()
+	deltaReader := octodiff.NewBinaryDeltaReader(bufio.NewReader(deltaFile))
+
+	expectedHash, err := deltaReader.ExpectedHash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(expectedHash, version.Hash) {
+		return errors.New("the delta does not produce the file recorded in the manifest")
+	}
+	basisLength, basisHash, err := deltaReader.BasisIdentity()
+	if err != nil {
+		return err
+	}
+	if basisLength != basis.Length || !bytes.Equal(basisHash, basis.Hash) {
+		return fmt.Errorf("the delta was not built against version %s", basis.Name)
+	}
+
+	_, err = basisFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	return octodiff.ApplyDeltaAndVerify(basisFile, deltaReader, output)
+}
+
+func (s *Store) copyAndVerify(version Version, snapshot io.Reader, output io.Writer) error {
+	hash := s.hashAlgorithm.NewHash()
+	length, err := io.Copy(io.MultiWriter(output, hash), snapshot)
+	if err != nil {
+		return err
+	}
+	if length != version.Length || !bytes.Equal(hash.Sum(nil), version.Hash) {
+		return fmt.Errorf("the %s hash of the snapshot does not match the manifest", s.hashAlgorithm.Name())
+	}
+	return nil
+}
+
+func (s *Store) checkoutToTempFile(version Version) (*os.File, error) {
+	file, err := os.CreateTemp(s.Directory, ".checkout-*")
+	if err != nil {
+		return nil, err
+	}
+	fileWriter := bufio.NewWriter(file)
+	err = s.Checkout(version.Name, fileWriter)
+	if err == nil {
+		err = fileWriter.Flush()
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		removeTempFile(file)
+		return nil, err
+	}
+	return file, nil
+}
+
+func removeTempFile(file *os.File) {
+	_ = file.Close()
+	_ = os.Remove(file.Name())
+}
+
+func (s *Store) path(version Version) string {
+	return filepath.Join(s.Directory, version.File)
+}
+
+// writeFile writes a file into the store directory via a temporary file, so it only appears once it is complete
+func (s *Store) writeFile(name string, write func(io.Writer) error) error {
+	file, err := os.CreateTemp(s.Directory, ".add-*")
+	if err != nil {
+		return err
+	}
+	fileWriter := bufio.NewWriter(file)
+	err = write(fileWriter)
+	if err == nil {
+		err = fileWriter.Flush()
+	}
+	if err == nil {
+		err = file.Chmod(0o644) // CreateTemp only gives the owner access
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filepath.Join(s.Directory, name))
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+	}
+	return err
+}
+
+func (s *Store) writeManifest() error {
+	manifest := jsonManifest{
+		HashAlgorithm: s.hashAlgorithm.Name(),
+		Versions:      []jsonVersion{},
+	}
+	for _, v := range s.versions {
+		manifest.Versions = append(manifest.Versions, jsonVersion{
+			Name:        v.Name,
+			Length:      v.Length,
+			Hash:        hex.EncodeToString(v.Hash),
+			File:        v.File,
+			Basis:       v.Basis,
+			ChainLength: v.ChainLength,
+		})
+	}
+	manifestFile, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.writeFile(manifestFileName, func(output io.Writer) error {
+		_, err := output.Write(append(manifestFile, '\n'))
+		return err
+	})
+}
@@ -0,0 +1,123 @@
+package store_test
+
+import (
+	"bytes"
+	"github.com/OctopusDeploy/go-octodiff/pkg/store"
+	"github.com/OctopusDeploy/go-octodiff/pkg/test"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// buildVersions returns a series of versions of a file, each a small change to the one before
+func buildVersions(count int) [][]byte {
+	r := rand.New(rand.NewSource(6))
+	versions := [][]byte{test.GenerateTestData(64 * 1024)}
+	for len(versions) < count {
+		next := append([]byte(nil), versions[len(versions)-1]...)
+		change := make([]byte, 500)
+		r.Read(change)
+		offset := r.Intn(len(next) - len(change))
+		next = append(next[:offset], append(change, next[offset+100:]...)...)
+		versions = append(versions, next)
+	}
+	return versions
+}
+
+func addVersions(t *testing.T, s *store.Store, versions [][]byte) {
+	for i, version := range versions {
+		_, err := s.Add(versionName(i), bytes.NewReader(version))
+		assert.Nil(t, err)
+	}
+}
+
+func versionName(i int) string {
+	return "v" + string(rune('a'+i))
+}
+
+func checkout(s *store.Store, name string) ([]byte, error) {
+	var output bytes.Buffer
+	err := s.Checkout(name, &output)
+	return output.Bytes(), err
+}
+
+func TestChecksOutEveryVersion(t *testing.T) {
+	directory := t.TempDir()
+	versions := buildVersions(5)
+
+	s, err := store.Open(directory)
+	assert.Nil(t, err)
+	addVersions(t, s, versions)
+
+	// reopen the store to read the manifest back
+	s, err = store.Open(directory)
+	assert.Nil(t, err)
+	for i, version := range versions {
+		output, err := checkout(s, versionName(i))
+		assert.Nil(t, err)
+		assert.Equal(t, version, output)
+	}
+	assert.Nil(t, s.Verify())
+
+	var files []string
+	for _, version := range s.Versions() {
+		files = append(files, version.File)
+	}
+	assert.Equal(t, []string{"000001.full", "000002.octodelta", "000003.octodelta", "000004.octodelta", "000005.octodelta"}, files)
+}
+
+func TestTakesSnapshotWhenChainGetsTooLong(t *testing.T) {
+	directory := t.TempDir()
+	versions := buildVersions(6)
+
+	s, err := store.Open(directory)
+	assert.Nil(t, err)
+	s.MaxChainLength = 2
+	addVersions(t, s, versions)
+
+	var chainLengths []int
+	for _, version := range s.Versions() {
+		chainLengths = append(chainLengths, version.ChainLength)
+	}
+	assert.Equal(t, []int{0, 1, 2, 0, 1, 2}, chainLengths)
+
+	for i, version := range versions {
+		output, err := checkout(s, versionName(i))
+		assert.Nil(t, err)
+		assert.Equal(t, version, output)
+	}
+	assert.Nil(t, s.Verify())
+}
+
+func TestRefusesDuplicateVersion(t *testing.T) {
+	s, err := store.Open(t.TempDir())
+	assert.Nil(t, err)
+	addVersions(t, s, buildVersions(1))
+
+	_, err = s.Add("va", bytes.NewReader([]byte("different")))
+	assert.EqualError(t, err, "the store already has a version va")
+}
+
+func TestVerifyReportsDamagedDelta(t *testing.T) {
+	directory := t.TempDir()
+	s, err := store.Open(directory)
+	assert.Nil(t, err)
+	addVersions(t, s, buildVersions(3))
+
+	// swap the last delta for one which produces something else
+	version, _ := s.Version("vc")
+	other, err := store.Open(t.TempDir())
+	assert.Nil(t, err)
+	versions := buildVersions(2)
+	addVersions(t, other, [][]byte{versions[0], append(versions[1], 'x')})
+	otherVersion, _ := other.Version("vb")
+	delta, err := os.ReadFile(filepath.Join(other.Directory, otherVersion.File))
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(directory, version.File), delta, 0o644))
+
+	assert.EqualError(t, s.Verify(), "version vc: the delta does not produce the file recorded in the manifest")
+	_, err = checkout(s, "vc")
+	assert.EqualError(t, err, "the delta does not produce the file recorded in the manifest")
+}